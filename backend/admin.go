@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// backendStatus is a backend as listed by the admin API
+type backendStatus struct {
+	Address  string `json:"address"`
+	Ready    bool   `json:"ready"`
+	Draining bool   `json:"draining"`
+	InFlight int    `json:"inFlight"`
+	// traffic load reduction percentage of an overloaded backend
+	Overload int `json:"overload,omitempty"`
+}
+
+// ServeAdmin starts the admin HTTP API:
+//
+//	GET  /backends                    lists the backends
+//	POST /backends/{address}/drain    drains a backend
+//	POST /backends/{address}/undrain  lets a drained backend take new UEs
+//
+// The API is served over mutual TLS when TLS is enabled, and in plaintext on
+// a loopback address only otherwise.
+func ServeAdmin(cfg *config.Admin) (*http.Server, error) {
+	if cfg == nil || cfg.ListenAddr == "" {
+		return nil, nil
+	}
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && !loopback(cfg.ListenAddr) {
+		return nil, fmt.Errorf("admin API without TLS must listen on a loopback address, not %v", cfg.ListenAddr)
+	}
+	lis, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	server := &http.Server{Handler: adminHandler()}
+	go func() {
+		logger.AppLog.Infof("admin API listening on %v", lis.Addr())
+		if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			logger.AppLog.Errorf("admin API server error: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+// loopback returns true if address listens on a loopback address only
+func loopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /backends", listBackends)
+	mux.HandleFunc("POST /backends/{address}/drain", func(w http.ResponseWriter, r *http.Request) {
+		setDraining(w, r, true)
+	})
+	mux.HandleFunc("POST /backends/{address}/undrain", func(w http.ResponseWriter, r *http.Request) {
+		setDraining(w, r, false)
+	})
+	return mux
+}
+
+func listBackends(w http.ResponseWriter, _ *http.Request) {
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	statuses := make([]backendStatus, 0, len(ctx.Backends))
+	for _, instance := range ctx.Backends {
+		statuses = append(statuses, backendStatus{
+			Address:  instance.Address(),
+			Ready:    instance.State(),
+			Draining: draining(instance),
+			InFlight: inFlight(instance),
+			Overload: overloadReduction(instance),
+		})
+	}
+	ctx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		logger.AppLog.Warnf("admin API failed to write backends: %v", err)
+	}
+}
+
+func setDraining(w http.ResponseWriter, r *http.Request, drain bool) {
+	address := r.PathValue("address")
+	var d drainer
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	for _, instance := range ctx.Backends {
+		if instance.Address() == address {
+			d, _ = instance.(drainer)
+			break
+		}
+	}
+	ctx.Unlock()
+	if d == nil {
+		http.Error(w, "backend not found", http.StatusNotFound)
+		return
+	}
+	if drain {
+		logger.AppLog.Infof("admin API drains backend %v", address)
+		d.Drain()
+	} else {
+		logger.AppLog.Infof("admin API undrains backend %v", address)
+		d.Undrain()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,221 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+)
+
+func Test_AdminDrain(t *testing.T) {
+	b := &GrpcServer{address: "127.0.0.210", state: stateReady}
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	ctx.AddNF(b)
+	ctx.Unlock()
+	defer func() {
+		ctx.Lock()
+		ctx.DeleteNF(b)
+		ctx.Unlock()
+	}()
+	handler := adminHandler()
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		wantCode     int
+		wantDraining bool
+	}{
+		{
+			name:         "Drain",
+			method:       http.MethodPost,
+			path:         "/backends/127.0.0.210/drain",
+			wantCode:     http.StatusNoContent,
+			wantDraining: true,
+		},
+		{
+			name:         "List draining backend",
+			method:       http.MethodGet,
+			path:         "/backends",
+			wantCode:     http.StatusOK,
+			wantDraining: true,
+		},
+		{
+			name:     "Undrain",
+			method:   http.MethodPost,
+			path:     "/backends/127.0.0.210/undrain",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "Unknown backend",
+			method:   http.MethodPost,
+			path:     "/backends/127.0.0.211/drain",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "Unsupported method",
+			method:   http.MethodGet,
+			path:     "/backends/127.0.0.210/drain",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+				if recorder.Code != tt.wantCode {
+					t.Fatalf("status code mismatch. got = %v, want = %v", recorder.Code, tt.wantCode)
+				}
+				if b.Draining() != tt.wantDraining || b.State() == tt.wantDraining {
+					t.Errorf("Draining() = %v State() = %v, want draining %v", b.Draining(), b.State(), tt.wantDraining)
+				}
+				if tt.path != "/backends" {
+					return
+				}
+				var statuses []backendStatus
+				if err := json.NewDecoder(recorder.Body).Decode(&statuses); err != nil {
+					t.Fatalf("failed to decode backends: %v", err)
+				}
+				want := backendStatus{Address: b.address, Draining: true}
+				var found bool
+				for _, status := range statuses {
+					if status.Address == b.address {
+						found = reflect.DeepEqual(status, want)
+					}
+				}
+				if !found {
+					t.Errorf("backend %v not listed as %+v in %+v", b.address, want, statuses)
+				}
+			},
+		)
+	}
+}
+
+func Test_ServeAdmin(t *testing.T) {
+	saved := transportCredentials
+	defer func() { transportCredentials = saved }()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	otherCA := newTestCA(t, "other ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, caFile, ca.pem, time.Now())
+	serverCert, serverKey := ca.issue(t, "localhost", 2)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestFile(t, certFile, serverCert, time.Now())
+	writeTestFile(t, keyFile, serverKey, time.Now())
+	mutualTLS := &config.TLS{Enabled: true, CaFile: caFile, CertFile: certFile, KeyFile: keyFile}
+
+	tests := []struct {
+		name string
+		tls  *config.TLS
+		// listen address format of the port
+		listenAddr string
+		// client certificate issuer, none presented if nil
+		issuer  *testCA
+		wantErr bool
+		wantOK  bool
+	}{
+		{
+			name:       "Plaintext on a loopback address",
+			listenAddr: "127.0.0.1:%d",
+			wantOK:     true,
+		},
+		{
+			name:       "Plaintext on every address",
+			listenAddr: ":%d",
+			wantErr:    true,
+		},
+		{
+			name:       "TLS without CA",
+			tls:        &config.TLS{Enabled: true, CertFile: certFile, KeyFile: keyFile},
+			listenAddr: "127.0.0.1:%d",
+			wantErr:    true,
+		},
+		{
+			name:       "TLS with a trusted client certificate",
+			tls:        mutualTLS,
+			listenAddr: ":%d",
+			issuer:     ca,
+			wantOK:     true,
+		},
+		{
+			name:       "TLS with an untrusted client certificate",
+			tls:        mutualTLS,
+			listenAddr: ":%d",
+			issuer:     otherCA,
+		},
+		{
+			name:       "TLS without client certificate",
+			tls:        mutualTLS,
+			listenAddr: ":%d",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if err := SetTLS(tt.tls); err != nil {
+					t.Fatalf("SetTLS() error: %v", err)
+				}
+				lis, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatalf("listen failed: %v", err)
+				}
+				port := lis.Addr().(*net.TCPAddr).Port
+				lis.Close()
+				server, err := ServeAdmin(&config.Admin{ListenAddr: fmt.Sprintf(tt.listenAddr, port)})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ServeAdmin() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				defer server.Close()
+
+				url := fmt.Sprintf("http://127.0.0.1:%d/backends", port)
+				transport := &http.Transport{}
+				if tt.tls != nil {
+					url = fmt.Sprintf("https://localhost:%d/backends", port)
+					rootCAs := x509.NewCertPool()
+					rootCAs.AddCert(ca.cert)
+					transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+					if tt.issuer != nil {
+						cert, key := tt.issuer.issue(t, "operator", int64(10+i))
+						pair, err := tls.X509KeyPair(cert, key)
+						if err != nil {
+							t.Fatalf("failed to load client certificate: %v", err)
+						}
+						transport.TLSClientConfig.Certificates = []tls.Certificate{pair}
+					}
+				}
+				client := &http.Client{Transport: transport, Timeout: time.Second}
+				resp, err := client.Get(url)
+				if err == nil {
+					resp.Body.Close()
+				}
+				if ok := err == nil && resp.StatusCode == http.StatusOK; ok != tt.wantOK {
+					t.Errorf("GET /backends succeeded = %v (error %v), want %v", ok, err, tt.wantOK)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,379 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"github.com/omec-project/ngap/logger"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+)
+
+// learnDownlinkUEAssociation records the backend which owns the UE a downlink
+// PDU is addressed to. The AMF-UE-NGAP-ID is always learned, so that uplink
+// messages carrying only the AMF-UE-NGAP-ID (e.g. Handover Failure) reach the
+// right AMF, and the RAN-UE-NGAP-ID when present, so that UEs for which the
+// LB never saw an InitialUEMessage stay on the AMF which created them.
+func learnDownlinkUEAssociation(backend Backend, ran *context.Ran, amfMsg *ngapType.NGAPPDU) {
+	amfUeNgapID, ranUeNgapID := extractDownlinkUEIdentifiers(amfMsg)
+	if amfUeNgapID != nil {
+		pinStickySession(amfStickyKey(ran, amfUeNgapID), backend)
+	}
+	if ranUeNgapID != nil {
+		pinStickySession(stickyKey(ran, ranUeNgapID), backend)
+	}
+}
+
+// extractDownlinkUEIdentifiers returns the AMF-UE-NGAP-ID and RAN-UE-NGAP-ID
+// of a UE-associated PDU sent by an AMF
+func extractDownlinkUEIdentifiers(amfMsg *ngapType.NGAPPDU) (
+	amfUeNgapID *ngapType.AMFUENGAPID, ranUeNgapID *ngapType.RANUENGAPID,
+) {
+	switch amfMsg.Present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		initiatingMessage := amfMsg.InitiatingMessage
+		if initiatingMessage == nil {
+			return nil, nil
+		}
+		switch initiatingMessage.ProcedureCode.Value {
+		case ngapType.ProcedureCodeDownlinkNASTransport:
+			ngapMsg := initiatingMessage.Value.DownlinkNASTransport
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("DownlinkNASTransport is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeInitialContextSetup:
+			ngapMsg := initiatingMessage.Value.InitialContextSetupRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("InitialContextSetupRequest is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceSetup:
+			ngapMsg := initiatingMessage.Value.PDUSessionResourceSetupRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceSetupRequest is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceModify:
+			ngapMsg := initiatingMessage.Value.PDUSessionResourceModifyRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceModifyRequest is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceRelease:
+			ngapMsg := initiatingMessage.Value.PDUSessionResourceReleaseCommand
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceReleaseCommand is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUEContextModification:
+			ngapMsg := initiatingMessage.Value.UEContextModificationRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UEContextModificationRequest is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeHandoverResourceAllocation:
+			// the target gNB has not allocated its RAN-UE-NGAP-ID yet
+			ngapMsg := initiatingMessage.Value.HandoverRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverRequest is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeRerouteNASRequest:
+			ngapMsg := initiatingMessage.Value.RerouteNASRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("RerouteNASRequest is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeDownlinkRANStatusTransfer:
+			ngapMsg := initiatingMessage.Value.DownlinkRANStatusTransfer
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("DownlinkRANStatusTransfer is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeLocationReportingControl:
+			ngapMsg := initiatingMessage.Value.LocationReportingControl
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("LocationReportingControl is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeTraceStart:
+			ngapMsg := initiatingMessage.Value.TraceStart
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("TraceStart is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeDeactivateTrace:
+			ngapMsg := initiatingMessage.Value.DeactivateTrace
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("DeactivateTrace is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUERadioCapabilityCheck:
+			ngapMsg := initiatingMessage.Value.UERadioCapabilityCheckRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UERadioCapabilityCheckRequest is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUEContextRelease:
+			ngapMsg := initiatingMessage.Value.UEContextReleaseCommand
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UEContextReleaseCommand is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value != ngapType.ProtocolIEIDUENGAPIDs || ie.Value.UENGAPIDs == nil {
+					continue
+				}
+				switch ie.Value.UENGAPIDs.Present {
+				case ngapType.UENGAPIDsPresentUENGAPIDPair:
+					amfUeNgapID = &ie.Value.UENGAPIDs.UENGAPIDPair.AMFUENGAPID
+					ranUeNgapID = &ie.Value.UENGAPIDs.UENGAPIDPair.RANUENGAPID
+				case ngapType.UENGAPIDsPresentAMFUENGAPID:
+					amfUeNgapID = ie.Value.UENGAPIDs.AMFUENGAPID
+				}
+			}
+		}
+
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		successfulOutcome := amfMsg.SuccessfulOutcome
+		if successfulOutcome == nil {
+			return nil, nil
+		}
+		switch successfulOutcome.ProcedureCode.Value {
+		case ngapType.ProcedureCodeHandoverPreparation:
+			ngapMsg := successfulOutcome.Value.HandoverCommand
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverCommand is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePathSwitchRequest:
+			ngapMsg := successfulOutcome.Value.PathSwitchRequestAcknowledge
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PathSwitchRequestAcknowledge is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeHandoverCancel:
+			ngapMsg := successfulOutcome.Value.HandoverCancelAcknowledge
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverCancelAcknowledge is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceModifyIndication:
+			ngapMsg := successfulOutcome.Value.PDUSessionResourceModifyConfirm
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceModifyConfirm is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		}
+
+	case ngapType.NGAPPDUPresentUnsuccessfulOutcome:
+		unsuccessfulOutcome := amfMsg.UnsuccessfulOutcome
+		if unsuccessfulOutcome == nil {
+			return nil, nil
+		}
+		switch unsuccessfulOutcome.ProcedureCode.Value {
+		case ngapType.ProcedureCodeHandoverPreparation:
+			ngapMsg := unsuccessfulOutcome.Value.HandoverPreparationFailure
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverPreparationFailure is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePathSwitchRequest:
+			ngapMsg := unsuccessfulOutcome.Value.PathSwitchRequestFailure
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PathSwitchRequestFailure is nil")
+				return nil, nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				switch ie.Id.Value {
+				case ngapType.ProtocolIEIDAMFUENGAPID:
+					amfUeNgapID = ie.Value.AMFUENGAPID
+				case ngapType.ProtocolIEIDRANUENGAPID:
+					ranUeNgapID = ie.Value.RANUENGAPID
+				}
+			}
+		}
+	}
+	return amfUeNgapID, ranUeNgapID
+}
+
+// extractRelativeAMFCapacity returns the RelativeAMFCapacity of an NG Setup
+// Response or AMF Configuration Update, nil for any other PDU
+func extractRelativeAMFCapacity(amfMsg *ngapType.NGAPPDU) *ngapType.RelativeAMFCapacity {
+	switch amfMsg.Present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		initiatingMessage := amfMsg.InitiatingMessage
+		if initiatingMessage == nil || initiatingMessage.ProcedureCode.Value != ngapType.ProcedureCodeAMFConfigurationUpdate {
+			return nil
+		}
+		ngapMsg := initiatingMessage.Value.AMFConfigurationUpdate
+		if ngapMsg == nil {
+			logger.NgapLog.Errorln("AMFConfigurationUpdate is nil")
+			return nil
+		}
+		for _, ie := range ngapMsg.ProtocolIEs.List {
+			if ie.Id.Value == ngapType.ProtocolIEIDRelativeAMFCapacity {
+				return ie.Value.RelativeAMFCapacity
+			}
+		}
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		successfulOutcome := amfMsg.SuccessfulOutcome
+		if successfulOutcome == nil || successfulOutcome.ProcedureCode.Value != ngapType.ProcedureCodeNGSetup {
+			return nil
+		}
+		ngapMsg := successfulOutcome.Value.NGSetupResponse
+		if ngapMsg == nil {
+			logger.NgapLog.Errorln("NGSetupResponse is nil")
+			return nil
+		}
+		for _, ie := range ngapMsg.ProtocolIEs.List {
+			if ie.Id.Value == ngapType.ProtocolIEIDRelativeAMFCapacity {
+				return ie.Value.RelativeAMFCapacity
+			}
+		}
+	}
+	return nil
+}
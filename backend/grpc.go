@@ -8,92 +8,232 @@ import (
 	ctxt "context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
 	"github.com/omec-project/sctplb/context"
 	"github.com/omec-project/sctplb/logger"
 	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
+func newGrpcServer(address string, svc config.Service) *GrpcServer {
+	return &GrpcServer{
+		address: address,
+		weight:  svc.Weight,
+		snssais: svc.Snssais,
+		plmnIds: svc.PlmnIds,
+		queue:   newSendQueue(sendQueueDepth, sendQueueOverflow),
+	}
+}
+
+// ConnectToServer runs the lifecycle of the backend: it opens the stream,
+// and reopens it with a jittered exponential backoff whenever it breaks. The
+// backend keeps its sticky sessions and queues their messages while it is
+// CONNECTING, and is deleted once it could not be reached for
+// reconnectFailAfter.
 func (b *GrpcServer) ConnectToServer(port int) {
 	target := fmt.Sprintf("%s:%d", b.address, port)
 
 	logger.AppLog.Infoln("connecting to target", target)
 
 	var err error
-	b.conn, err = grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	b.conn, err = grpc.NewClient(target, dialOptions()...)
 	if err != nil {
 		logger.AppLog.Errorln("did not connect:", err)
+		b.setState(stateFailed)
 		deleteBackendNF(b)
 		return
 	}
+	defer b.conn.Close()
 
 	b.gc = gClient.NewNgapServiceClient(b.conn)
 
-	stream, err := b.gc.HandleMessage(ctxt.Background())
+	retry := newBackoff(reconnectInitialBackoff, reconnectMaxBackoff)
+	downSince := time.Now()
+	for {
+		connected, err := b.serve()
+		if b.stopped() {
+			return
+		}
+		if connected {
+			retry.reset()
+			downSince = time.Now()
+		}
+		logger.GrpcLog.Warnf("stream to server %v broken: %v", b.address, err)
+		if time.Since(downSince) >= reconnectFailAfter {
+			logger.GrpcLog.Errorf("server %v unreachable for %v", b.address, reconnectFailAfter)
+			b.setState(stateFailed)
+			deleteBackendNF(b)
+			return
+		}
+		b.setState(stateConnecting)
+		delay := retry.next()
+		logger.GrpcLog.Infof("reconnecting to server %v in %v", b.address, delay)
+		select {
+		case <-b.queue.done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// serve opens a stream to the backend and handles it until it breaks.
+// Returns true if the backend became READY.
+func (b *GrpcServer) serve() (bool, error) {
+	ctx, cancel := ctxt.WithCancel(ctxt.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-b.queue.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stream, err := b.gc.HandleMessage(ctx)
 	if err != nil {
-		logger.AppLog.Errorw("open stream error", err)
-		deleteBackendNF(b)
-		return
+		return false, err
+	}
+	// INIT message to new NF instance
+	context.Sctplb_Self().RanPool.Range(func(key, value any) bool {
+		req := gClient.SctplbMessage{}
+		req.VerboseMsg = "Hello From SCTP LB!"
+		req.Msgtype = gClient.MsgType_INIT_MSG
+		req.SctplbId = os.Getenv("HOSTNAME")
+		candidate := value.(*context.Ran)
+		if candidate.RanId != nil {
+			req.GnbId = *candidate.RanId
+		} else {
+			logger.AppLog.Infof("ran connection %v is exist without GnbId, so not sending this ran details to NF",
+				candidate.GnbIp)
+		}
+		if err = stream.Send(&req); err != nil {
+			logger.AppLog.Warnln("can not send:", err)
+			return false
+		}
+		logger.AppLog.Infoln("send Request message")
+		response, recvErr := stream.Recv()
+		if recvErr != nil {
+			logger.AppLog.Errorln("response from server: error", recvErr)
+			err = recvErr
+			return false
+		}
+		logger.AppLog.Infof("init Response from Server %s server: %s", response.AmfId, response.VerboseMsg)
+		return true
+	})
+	if err != nil {
+		return false, err
 	}
 
 	b.stream = stream
-	b.state = true
+	// the writer drains the queue before anything below takes the context
+	// lock or queues messages
+	go b.writeToServer(ctx, cancel, stream)
+	state := stateReady
+	if b.drainPinned.Load() {
+		state = stateDraining
+	}
+	previous := b.setState(state)
+	if previous != state {
+		logger.GrpcLog.Infof("server %v %v -> %v", b.address, previous, state)
+	}
+	resetOverload(b)
+	if localNGSetup {
+		b.notifyGnbSetups()
+		if previous != state {
+			ngSetupChanged()
+		}
+	}
+	go b.connectionOnState(ctx, cancel)
+	go b.checkHealth(ctx)
+	return true, b.readFromServer(stream)
+}
+
+// writeToServer drains the send queue into the stream until the stream is
+// closed. Messages queued meanwhile wait for the next stream. A stream which
+// does not take a message within sendTimeout is wedged and closed.
+func (b *GrpcServer) writeToServer(ctx ctxt.Context, cancel ctxt.CancelFunc,
+	stream gClient.NgapService_HandleMessageClient,
+) {
+	defer b.queue.attach()()
 	for {
-		// INIT message to new NF instance
-		context.Sctplb_Self().RanPool.Range(func(key, value any) bool {
-			req := gClient.SctplbMessage{}
-			req.VerboseMsg = "Hello From SCTP LB!"
-			req.Msgtype = gClient.MsgType_INIT_MSG
-			req.SctplbId = os.Getenv("HOSTNAME")
-			candidate := value.(*context.Ran)
-			if candidate.RanId != nil {
-				req.GnbId = *candidate.RanId
-			} else {
-				logger.AppLog.Infof("ran connection %v is exist without GnbId, so not sending this ran details to NF",
-					candidate.GnbIp)
-			}
-			if err := stream.Send(&req); err != nil {
-				logger.AppLog.Warnln("can not send:", err)
-			}
-			logger.AppLog.Infoln("send Request message")
-			response, err := stream.Recv()
-			if err != nil {
-				logger.AppLog.Errorln("response from server: error", err)
-				b.state = false
-			} else {
-				logger.AppLog.Infof("init Response from Server %s server: %s", response.AmfId, response.VerboseMsg)
-				b.state = true
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-b.queue.messages:
+			deadline := time.AfterFunc(sendTimeout, func() {
+				logger.GrpcLog.Errorf("send to server %v timed out after %v, closing the stream", b.address, sendTimeout)
+				cancel()
+			})
+			if err := stream.Send(message); err != nil {
+				logger.GrpcLog.Errorf("can not send to server %v: %v", b.address, err)
 			}
-			return true
-		})
-		break
+			deadline.Stop()
+			b.inFlight.Add(-1)
+		}
+	}
+}
+
+// enqueue hands a message to the writer of the backend
+func (b *GrpcServer) enqueue(message *gClient.SctplbMessage) error {
+	dropped, err := b.queue.push(message)
+	if err != nil {
+		return err
 	}
-	if b.state {
-		go b.connectionOnState()
-		go b.readFromServer()
+	if dropped {
+		logger.GrpcLog.Warnf("send queue of server %v full, dropped oldest message", b.address)
+	} else {
+		b.inFlight.Add(1)
+	}
+	return nil
+}
+
+func (b *GrpcServer) waitsForRoom() bool {
+	return b.queue.overflow == overflowBlock
+}
+
+// sendWait sends a message of a gNB, waiting for room in a full send queue.
+// Must not be called with the context lock held.
+func (b *GrpcServer) sendWait(msg []byte, ran *context.Ran) error {
+	if err := b.queue.pushWait(b.gnbMessage(msg, false, ran)); err != nil {
+		return err
+	}
+	b.inFlight.Add(1)
+	return nil
+}
+
+// stop ends the writer of a deleted backend
+func (b *GrpcServer) stop() {
+	if b.queue != nil {
+		b.queue.stop()
 	}
 }
 
-func (b *GrpcServer) readFromServer() {
+// readFromServer handles the messages of the backend until the stream breaks
+func (b *GrpcServer) readFromServer(stream gClient.NgapService_HandleMessageClient) error {
 	for {
-		response, err := b.stream.Recv()
+		response, err := stream.Recv()
 		if err != nil {
 			logger.GrpcLog.Errorf("error in Recv %v, Stop listening for this server %v", err, b.address)
-			deleteBackendNF(b)
-			return
+			return err
 		} else {
 			if response.Msgtype == gClient.MsgType_INIT_MSG {
 				logger.GrpcLog.Infof("init Response from Server %s server: %s", response.AmfId, response.VerboseMsg)
+			} else if response.Msgtype == gClient.MsgType_AMF_DRAIN {
+				logger.GrpcLog.Infof("drain requested by server %s: %s", response.AmfId, response.VerboseMsg)
+				b.drain()
 			} else if response.Msgtype == gClient.MsgType_REDIRECT_MSG {
 				var found bool
 				ctx := context.Sctplb_Self()
 				for _, instance := range ctx.Backends {
 					b1 := instance.(*GrpcServer)
 					if b1.address == response.RedirectId {
-						if !b1.state {
+						if !b1.State() {
 							logger.GrpcLog.Infoln("backend state is not in READY state, so not forwarding redirected Msg")
 						} else {
 							t := gClient.SctplbMessage{}
@@ -102,11 +242,11 @@ func (b *GrpcServer) readFromServer() {
 							t.SctplbId = os.Getenv("HOSTNAME")
 							t.Msg = response.Msg
 							t.GnbId = response.GnbId
-							err := b1.stream.Send(&t)
-							if err != nil {
-								logger.GrpcLog.Infoln("error forwarding msg")
+							if err := b1.enqueue(&t); err != nil {
+								logger.GrpcLog.Infoln("error forwarding msg:", err)
+							} else {
+								logger.GrpcLog.Infoln("successfully forwarded msg to correct AMF")
 							}
-							logger.GrpcLog.Infoln("successfully forwarded msg to correct AMF")
 							found = true
 						}
 						break
@@ -116,6 +256,19 @@ func (b *GrpcServer) readFromServer() {
 					logger.GrpcLog.Infof("dropping redirected message as backend ip [%v] is not exist", response.RedirectId)
 				}
 			} else {
+				amfMsg, err := ngap.Decoder(response.Msg)
+				if err != nil {
+					logger.GrpcLog.Errorf("NGAP decode error of AMF message: %+v", err)
+					amfMsg = nil
+				}
+				var setupChanged, overloadLearned bool
+				if amfMsg != nil {
+					b.learnCapacity(amfMsg)
+					b.learnGUAMIs(amfMsg)
+					setupChanged = learnAMFSetup(&b.setup, amfMsg)
+					overloadLearned = learnOverload(b, amfMsg)
+				}
+
 				var ran *context.Ran
 				// fetch ran connection based on GnbId
 				if response.GnbId == "" {
@@ -125,15 +278,21 @@ func (b *GrpcServer) readFromServer() {
 					ran, _ = context.Sctplb_Self().RanFindByGnbIp(response.GnbIpAddr)
 					if ran != nil && response.GnbId != "" {
 						ran.SetRanId(response.GnbId)
+						persistRanId(ran)
 						logger.RanLog.Infof("received GnbId: %v for GNbIpAddress: %v from NF", response.GnbId, response.GnbIpAddr)
 					}
 				} else if response.GnbId != "" {
 					ran, _ = context.Sctplb_Self().RanFindByGnbId(response.GnbId)
 				}
-				if ran != nil {
-					_, err := ran.Conn.Write(response.Msg)
-					if err != nil {
-						logger.RanLog.Infof("err %+v", err)
+				if localNGSetup && amfMsg != nil && isLocalNGSetupProcedure(amfMsg) {
+					// the gNBs are told the merged NG Setup data of the backends
+					b.answerLocalNGSetupProcedure(ran, amfMsg)
+					if setupChanged {
+						ngSetupChanged()
+					}
+				} else if targets := downlinkTargets(ran, response); len(targets) > 0 {
+					for _, target := range targets {
+						b.writeToRan(target, amfMsg, response.Msg, overloadLearned)
 					}
 				} else {
 					logger.RanLog.Infof("couldn't fetch sctp connection with GnbId: %v", response.GnbId)
@@ -143,21 +302,42 @@ func (b *GrpcServer) readFromServer() {
 	}
 }
 
-func (b *GrpcServer) connectionOnState() {
-	go func() {
-		// continue checking for state change
-		// until one of break states is found
-		for {
-			change := b.conn.WaitForStateChange(ctxt.Background(), b.conn.GetState())
-			if change && b.conn.GetState() == connectivity.Idle {
-				deleteBackendNF(b)
-				return
-			}
+// writeToRan passes a message of the backend on to a RAN, unless sctplb
+// consumes it
+func (b *GrpcServer) writeToRan(ran *context.Ran, amfMsg *ngapType.NGAPPDU, msg []byte, overloadLearned bool) {
+	if amfMsg != nil {
+		learnDownlinkUEAssociation(b, ran, amfMsg)
+		if handleDownlinkNGReset(b, ran, amfMsg) || handleBroadcastOutcome(b, ran, amfMsg, msg) ||
+			handleOverload(ran, amfMsg, overloadLearned) {
+			return
 		}
-	}()
+	}
+	if _, err := ran.Conn.Write(msg); err != nil {
+		logger.RanLog.Infof("err %+v", err)
+	}
+}
+
+// connectionOnState closes the stream once the connection goes Idle
+func (b *GrpcServer) connectionOnState(ctx ctxt.Context, cancel ctxt.CancelFunc) {
+	// continue checking for state change
+	// until one of break states is found
+	for {
+		if !b.conn.WaitForStateChange(ctx, b.conn.GetState()) {
+			return
+		}
+		if b.conn.GetState() == connectivity.Idle {
+			cancel()
+			return
+		}
+	}
 }
 
 func (b *GrpcServer) Send(msg []byte, end bool, ran *context.Ran) error {
+	return b.enqueue(b.gnbMessage(msg, end, ran))
+}
+
+// gnbMessage returns the message carrying an NGAP message of a gNB
+func (b *GrpcServer) gnbMessage(msg []byte, end bool, ran *context.Ran) *gClient.SctplbMessage {
 	t := gClient.SctplbMessage{}
 	if end {
 		t.VerboseMsg = "Bye From gNB Message !"
@@ -180,9 +360,196 @@ func (b *GrpcServer) Send(msg []byte, end bool, ran *context.Ran) error {
 		}
 		t.Msg = msg
 	}
-	return b.stream.Send(&t)
+	return &t
+}
+
+// InFlight returns the number of messages handed to the backend which are
+// queued or being written to the stream
+func (b *GrpcServer) InFlight() int {
+	return int(b.inFlight.Load())
+}
+
+// NotifyInherited sends a GNB_MSG without NGAP payload telling the backend
+// which UEs of a gNB were moved to it from the deleted backend from. The UEs
+// are listed in VerboseMsg by RAN-UE-NGAP-ID, or as amf_<AMF-UE-NGAP-ID> for
+// the UEs learned from downlink messages.
+func (b *GrpcServer) NotifyInherited(ran *context.Ran, from string, ueIDs []string) error {
+	t := gClient.SctplbMessage{}
+	t.VerboseMsg = fmt.Sprintf("Inherited UEs from %s: %s", from, strings.Join(ueIDs, ","))
+	t.Msgtype = gClient.MsgType_GNB_MSG
+	t.SctplbId = os.Getenv("HOSTNAME")
+	if ran.RanId != nil {
+		t.GnbId = *ran.RanId
+	} else {
+		t.GnbIpAddr = ran.GnbIp
+	}
+	return b.enqueue(&t)
+}
+
+// NotifyGnbSetup sends a GNB_CONN with the NG Setup Request of a gNB set up
+// by sctplb, which the AMF answers with its NG Setup data
+func (b *GrpcServer) NotifyGnbSetup(ran *context.Ran) error {
+	t := gClient.SctplbMessage{}
+	t.VerboseMsg = "Hello From gNB Setup !"
+	t.Msgtype = gClient.MsgType_GNB_CONN
+	t.SctplbId = os.Getenv("HOSTNAME")
+	t.GnbIpAddr = ran.GnbIp
+	if ran.RanId != nil {
+		t.GnbId = *ran.RanId
+	}
+	t.Msg = ran.SetupRequest
+	return b.enqueue(&t)
+}
+
+// notifyGnbSetups tells a backend which became READY about the gNBs set up
+// by sctplb
+func (b *GrpcServer) notifyGnbSetups() {
+	context.Sctplb_Self().RanPool.Range(func(key, value any) bool {
+		ran := value.(*context.Ran)
+		if ran.SetupRequest == nil {
+			return true
+		}
+		if err := b.NotifyGnbSetup(ran); err != nil {
+			ran.Log.Warnf("can not notify backend %v of NG Setup: %v", b.address, err)
+		}
+		return true
+	})
+}
+
+// answerLocalNGSetupProcedure acknowledges the AMF Configuration Updates of
+// the AMF in local NG Setup mode
+func (b *GrpcServer) answerLocalNGSetupProcedure(ran *context.Ran, amfMsg *ngapType.NGAPPDU) {
+	if ran == nil ||
+		!isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeAMFConfigurationUpdate) {
+		return
+	}
+	ack, err := amfConfigurationUpdateAcknowledge()
+	if err == nil {
+		err = b.Send(ack, false, ran)
+	}
+	if err != nil {
+		ran.Log.Warnf("can not acknowledge AMF Configuration Update of server %v: %v", b.address, err)
+	}
+}
+
+// AMFSetup returns the NG Setup data of the AMF, nil until it told them
+func (b *GrpcServer) AMFSetup() *amfSetup {
+	return b.setup.Load()
+}
+
+// learnCapacity records the RelativeAMFCapacity the AMF advertises in NG
+// Setup Response and AMF Configuration Update
+func (b *GrpcServer) learnCapacity(amfMsg *ngapType.NGAPPDU) {
+	if capacity := extractRelativeAMFCapacity(amfMsg); capacity != nil {
+		if b.capacity.Swap(capacity.Value) != capacity.Value {
+			logger.GrpcLog.Infof("backend %v RelativeAMFCapacity: %d", b.address, capacity.Value)
+		}
+	}
+}
+
+// learnGUAMIs records the GUAMIs the AMF advertises in NG Setup Response and
+// AMF Configuration Update
+func (b *GrpcServer) learnGUAMIs(amfMsg *ngapType.NGAPPDU) {
+	if list := extractServedGUAMIList(amfMsg); list != nil {
+		ids := servedAMFIdentities(list)
+		b.servedAMFs.Store(&ids)
+		logger.GrpcLog.Infof("backend %v serves %d GUAMIs", b.address, len(ids))
+	}
+}
+
+// ServesAMF returns true if one of the GUAMIs served by the AMF has the AMF
+// Set ID and AMF Pointer of id
+func (b *GrpcServer) ServesAMF(id amfIdentity) bool {
+	ids := b.servedAMFs.Load()
+	if ids == nil {
+		return false
+	}
+	for _, served := range *ids {
+		if served == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Snssais returns the slices served by the service of the backend
+func (b *GrpcServer) Snssais() []config.Snssai {
+	return b.snssais
+}
+
+// PlmnIds returns the PLMNs served by the service of the backend
+func (b *GrpcServer) PlmnIds() []config.PlmnId {
+	return b.plmnIds
+}
+
+// Weight returns the configured weight of the backend, or else the
+// RelativeAMFCapacity learned from the AMF, 0 if neither is known
+func (b *GrpcServer) Weight() int {
+	if b.weight > 0 {
+		return b.weight
+	}
+	return int(b.capacity.Load())
 }
 
+// State returns true if the backend takes new UEs
 func (b *GrpcServer) State() bool {
-	return b.state
+	return b.state.load() == stateReady && !b.notServing.Load()
+}
+
+// Draining returns true if the backend takes no new UEs, but still serves
+// its sticky UEs until they are released or expire
+func (b *GrpcServer) Draining() bool {
+	return b.state.load() == stateDraining
+}
+
+// Drain stops sending new UEs to the backend until Undrain, even across
+// reconnects
+func (b *GrpcServer) Drain() {
+	b.drainPinned.Store(true)
+	b.drain()
+}
+
+// Undrain lets the backend take new UEs again, and tells it about the gNBs
+// set up meanwhile
+func (b *GrpcServer) Undrain() {
+	b.drainPinned.Store(false)
+	if b.state.compareAndSwap(stateDraining, stateReady) {
+		logger.GrpcLog.Infof("server %v %v -> %v", b.address, stateDraining, stateReady)
+		if localNGSetup {
+			b.notifyGnbSetups()
+			ngSetupChanged()
+		}
+	}
+}
+
+// drain moves a READY backend to DRAINING until its stream is reopened
+func (b *GrpcServer) drain() {
+	if b.state.compareAndSwap(stateReady, stateDraining) {
+		logger.GrpcLog.Infof("server %v %v -> %v", b.address, stateReady, stateDraining)
+		ngSetupChanged()
+	}
+}
+
+// Reachable returns true unless the backend FAILED. A backend reconnecting
+// after a short outage queues the messages of its sticky UEs meanwhile.
+func (b *GrpcServer) Reachable() bool {
+	return b.state.load() != stateFailed
+}
+
+func (b *GrpcServer) setState(state backendState) backendState {
+	return b.state.store(state)
+}
+
+// stopped returns true once the backend is deleted
+func (b *GrpcServer) stopped() bool {
+	select {
+	case <-b.queue.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *GrpcServer) Address() string {
+	return b.address
 }
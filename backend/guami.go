@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/logger"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+)
+
+// amfIdentity is the part of a GUAMI which a 5G-S-TMSI carries, enough to
+// tell the AMFs of one AMF Region apart
+type amfIdentity struct {
+	setID   uint16
+	pointer uint8
+}
+
+// guamiServer is implemented by the backends which know the GUAMIs they serve
+type guamiServer interface {
+	ServesAMF(id amfIdentity) bool
+}
+
+func bitStringValue(b aper.BitString) uint64 {
+	var value uint64
+	for _, octet := range b.Bytes {
+		value = value<<8 | uint64(octet)
+	}
+	if unused := uint64(len(b.Bytes))*8 - b.BitLength; unused < 64 {
+		value >>= unused
+	}
+	return value
+}
+
+func newAMFIdentity(setID *ngapType.AMFSetID, pointer *ngapType.AMFPointer) amfIdentity {
+	return amfIdentity{
+		setID:   uint16(bitStringValue(setID.Value)),
+		pointer: uint8(bitStringValue(pointer.Value)),
+	}
+}
+
+// servedAMFIdentities returns the AMF identities of a ServedGUAMIList
+func servedAMFIdentities(list *ngapType.ServedGUAMIList) []amfIdentity {
+	ids := make([]amfIdentity, 0, len(list.List))
+	for i := range list.List {
+		guami := &list.List[i].GUAMI
+		ids = append(ids, newAMFIdentity(&guami.AMFSetID, &guami.AMFPointer))
+	}
+	return ids
+}
+
+// extractServedGUAMIList returns the ServedGUAMIList of an NG Setup Response
+// or AMF Configuration Update, nil for any other PDU
+func extractServedGUAMIList(amfMsg *ngapType.NGAPPDU) *ngapType.ServedGUAMIList {
+	switch amfMsg.Present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		initiatingMessage := amfMsg.InitiatingMessage
+		if initiatingMessage == nil || initiatingMessage.ProcedureCode.Value != ngapType.ProcedureCodeAMFConfigurationUpdate {
+			return nil
+		}
+		ngapMsg := initiatingMessage.Value.AMFConfigurationUpdate
+		if ngapMsg == nil {
+			logger.NgapLog.Errorln("AMFConfigurationUpdate is nil")
+			return nil
+		}
+		for _, ie := range ngapMsg.ProtocolIEs.List {
+			if ie.Id.Value == ngapType.ProtocolIEIDServedGUAMIList {
+				return ie.Value.ServedGUAMIList
+			}
+		}
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		successfulOutcome := amfMsg.SuccessfulOutcome
+		if successfulOutcome == nil || successfulOutcome.ProcedureCode.Value != ngapType.ProcedureCodeNGSetup {
+			return nil
+		}
+		ngapMsg := successfulOutcome.Value.NGSetupResponse
+		if ngapMsg == nil {
+			logger.NgapLog.Errorln("NGSetupResponse is nil")
+			return nil
+		}
+		for _, ie := range ngapMsg.ProtocolIEs.List {
+			if ie.Id.Value == ngapType.ProtocolIEIDServedGUAMIList {
+				return ie.Value.ServedGUAMIList
+			}
+		}
+	}
+	return nil
+}
+
+// extractFiveGSTMSI returns the 5G-S-TMSI of an InitialUEMessage, nil for any
+// other PDU or when the UE did not provide one
+func extractFiveGSTMSI(ranMsg *ngapType.NGAPPDU) *ngapType.FiveGSTMSI {
+	if ranMsg.Present != ngapType.NGAPPDUPresentInitiatingMessage {
+		return nil
+	}
+	initiatingMessage := ranMsg.InitiatingMessage
+	if initiatingMessage == nil || initiatingMessage.ProcedureCode.Value != ngapType.ProcedureCodeInitialUEMessage {
+		return nil
+	}
+	ngapMsg := initiatingMessage.Value.InitialUEMessage
+	if ngapMsg == nil {
+		logger.NgapLog.Errorln("InitialUEMessage is nil")
+		return nil
+	}
+	for _, ie := range ngapMsg.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDFiveGSTMSI {
+			return ie.Value.FiveGSTMSI
+		}
+	}
+	return nil
+}
+
+// guamiBackend returns the READY backend serving the AMF which allocated the
+// 5G-S-TMSI of an InitialUEMessage, so that a registered UE comes back to its
+// AMF instead of forcing a context transfer. Returns nil when the message
+// has no 5G-S-TMSI or its AMF is unknown.
+func guamiBackend(ranMsg *ngapType.NGAPPDU, backends []context.NF) Backend {
+	tmsi := extractFiveGSTMSI(ranMsg)
+	if tmsi == nil {
+		return nil
+	}
+	id := newAMFIdentity(&tmsi.AMFSetID, &tmsi.AMFPointer)
+	for _, instance := range backends {
+		if server, ok := instance.(guamiServer); ok && instance.State() && server.ServesAMF(id) {
+			return instance
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+)
+
+// AMF Set ID 5 and AMF Pointer 2 as encoded in a GUAMI or 5G-S-TMSI
+var (
+	testAMFSetID   = ngapType.AMFSetID{Value: aper.BitString{Bytes: []byte{0x01, 0x40}, BitLength: 10}}
+	testAMFPointer = ngapType.AMFPointer{Value: aper.BitString{Bytes: []byte{0x08}, BitLength: 6}}
+)
+
+func ngSetupResponse(guamis ...ngapType.GUAMI) *ngapType.NGAPPDU {
+	list := &ngapType.ServedGUAMIList{}
+	for _, guami := range guamis {
+		list.List = append(list.List, ngapType.ServedGUAMIItem{GUAMI: guami})
+	}
+	response := &ngapType.NGSetupResponse{}
+	response.ProtocolIEs.List = append(response.ProtocolIEs.List, ngapType.NGSetupResponseIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDServedGUAMIList},
+		Value: ngapType.NGSetupResponseIEsValue{
+			Present:         ngapType.NGSetupResponseIEsPresentServedGUAMIList,
+			ServedGUAMIList: list,
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentSuccessfulOutcome,
+		SuccessfulOutcome: &ngapType.SuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeNGSetup},
+			Value: ngapType.SuccessfulOutcomeValue{
+				Present:         ngapType.SuccessfulOutcomePresentNGSetupResponse,
+				NGSetupResponse: response,
+			},
+		},
+	}
+}
+
+func initialUEMessage(tmsi *ngapType.FiveGSTMSI) *ngapType.NGAPPDU {
+	message := &ngapType.InitialUEMessage{}
+	message.ProtocolIEs.List = append(message.ProtocolIEs.List, ngapType.InitialUEMessageIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDRANUENGAPID},
+		Value: ngapType.InitialUEMessageIEsValue{
+			Present:     ngapType.InitialUEMessageIEsPresentRANUENGAPID,
+			RANUENGAPID: &ngapType.RANUENGAPID{Value: 1},
+		},
+	})
+	if tmsi != nil {
+		message.ProtocolIEs.List = append(message.ProtocolIEs.List, ngapType.InitialUEMessageIEs{
+			Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDFiveGSTMSI},
+			Value: ngapType.InitialUEMessageIEsValue{
+				Present:    ngapType.InitialUEMessageIEsPresentFiveGSTMSI,
+				FiveGSTMSI: tmsi,
+			},
+		})
+	}
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeInitialUEMessage},
+			Value: ngapType.InitiatingMessageValue{
+				Present:          ngapType.InitiatingMessagePresentInitialUEMessage,
+				InitialUEMessage: message,
+			},
+		},
+	}
+}
+
+func Test_GUAMIBackend(t *testing.T) {
+	other := &GrpcServer{address: "127.0.0.1", state: stateReady}
+	other.learnGUAMIs(ngSetupResponse(ngapType.GUAMI{
+		AMFSetID:   testAMFSetID,
+		AMFPointer: ngapType.AMFPointer{Value: aper.BitString{Bytes: []byte{0x04}, BitLength: 6}},
+	}))
+	owner := &GrpcServer{address: "127.0.0.2", state: stateReady}
+	owner.learnGUAMIs(ngSetupResponse(ngapType.GUAMI{AMFSetID: testAMFSetID, AMFPointer: testAMFPointer}))
+	ownerDown := &GrpcServer{address: "127.0.0.3"}
+	ownerDown.learnGUAMIs(ngSetupResponse(ngapType.GUAMI{AMFSetID: testAMFSetID, AMFPointer: testAMFPointer}))
+
+	tmsi := &ngapType.FiveGSTMSI{AMFSetID: testAMFSetID, AMFPointer: testAMFPointer}
+
+	tests := []struct {
+		name     string
+		msg      *ngapType.NGAPPDU
+		backends []context.NF
+		want     string
+	}{
+		{
+			name:     "5G-S-TMSI of a known AMF",
+			msg:      initialUEMessage(tmsi),
+			backends: []context.NF{other, owner},
+			want:     "127.0.0.2",
+		},
+		{
+			name:     "No 5G-S-TMSI",
+			msg:      initialUEMessage(nil),
+			backends: []context.NF{other, owner},
+			want:     "",
+		},
+		{
+			name:     "5G-S-TMSI of an unknown AMF",
+			msg:      initialUEMessage(tmsi),
+			backends: []context.NF{other},
+			want:     "",
+		},
+		{
+			name:     "AMF not ready",
+			msg:      initialUEMessage(tmsi),
+			backends: []context.NF{other, ownerDown},
+			want:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				var got string
+				if backend := guamiBackend(tt.msg, tt.backends); backend != nil {
+					got = backend.Address()
+				}
+				if got != tt.want {
+					t.Errorf("guamiBackend() mismatch. got = %q, want = %q", got, tt.want)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+)
+
+const (
+	// number of points each backend gets on a hash ring
+	hashRingReplicas = 160
+	// rings, or current weights, kept for the backend pools before starting
+	// over
+	maxHashRings = 64
+)
+
+type ringPoint struct {
+	hash    uint64
+	backend Backend
+}
+
+// consistentHashScheduler places the UEs on a hash ring of the READY
+// backends, keyed on the gNB and RAN-UE-NGAP-ID of the UE, and takes the
+// first candidate clockwise from the key. The ring does not depend on the
+// candidates of a message, so adding or removing one of N backends moves only
+// about 1/N of the UEs, and the messages of a UE keep reaching the same
+// backend without a sticky session while the backends are unchanged. A
+// drained backend is no longer READY and leaves the ring, so without sticky
+// sessions its UEs move to the other backends. Selections which are not for a
+// UE, such as the messages carrying only an AMF-UE-NGAP-ID, fall back to
+// round robin.
+type consistentHashScheduler struct {
+	rings    map[string][]ringPoint // by the backends on the ring
+	fallback roundRobinScheduler
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV alone spreads close keys such as <ranID>_1, <ranID>_2 poorly
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// poolKey identifies a pool of backends
+func poolKey(backends []context.NF) string {
+	// a backend discovered again at the same address is a new instance
+	ids := make([]string, len(backends))
+	for i, instance := range backends {
+		ids[i] = fmt.Sprintf("%v@%p", instance.Address(), instance)
+	}
+	return strings.Join(ids, ",")
+}
+
+// ring returns the hash ring of a pool of backends, building it the first
+// time the pool is seen
+func (s *consistentHashScheduler) ring(backends []context.NF) []ringPoint {
+	members := poolKey(backends)
+	if ring, found := s.rings[members]; found {
+		return ring
+	}
+	if s.rings == nil || len(s.rings) >= maxHashRings {
+		s.rings = make(map[string][]ringPoint)
+	}
+	ring := make([]ringPoint, 0, len(backends)*hashRingReplicas)
+	for _, instance := range backends {
+		for i := 0; i < hashRingReplicas; i++ {
+			ring = append(ring, ringPoint{
+				hash:    hashKey(fmt.Sprintf("%v#%d", instance.Address(), i)),
+				backend: instance,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	s.rings[members] = ring
+	return ring
+}
+
+func (s *consistentHashScheduler) Select(ran *context.Ran, ngapID *ngapType.RANUENGAPID, backends []context.NF) Backend {
+	if ran == nil || ngapID == nil || len(backends) == 0 {
+		return s.fallback.Select(ran, ngapID, backends)
+	}
+	var members []context.NF
+	for _, instance := range context.Sctplb_Self().Backends {
+		if instance.State() {
+			members = append(members, instance)
+		}
+	}
+	candidates := make(map[Backend]bool, len(backends))
+	for _, instance := range backends {
+		candidates[instance] = true
+	}
+	ring := s.ring(members)
+	h := hashKey(stickyKey(ran, ngapID))
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+	// first candidate clockwise from the key
+	for i := range ring {
+		point := ring[(start+i)%len(ring)]
+		if candidates[point.backend] {
+			return point.backend
+		}
+	}
+	return nil
+}
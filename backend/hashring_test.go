@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+)
+
+// placeUEs returns the backend address of n UEs of a gNB, the backends being
+// the ones of sctplb
+func placeUEs(s Scheduler, ran *context.Ran, backends []context.NF, n int) []string {
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	defer ctx.Unlock()
+	for _, instance := range backends {
+		ctx.AddNF(instance)
+	}
+	defer func() {
+		for _, instance := range backends {
+			ctx.DeleteNF(instance)
+		}
+	}()
+	placement := make([]string, n)
+	for i := range placement {
+		if backend := s.Select(ran, &ngapType.RANUENGAPID{Value: int64(i)}, backends); backend != nil {
+			placement[i] = backend.Address()
+		}
+	}
+	return placement
+}
+
+func Test_ConsistentHashScheduler(t *testing.T) {
+	const ues = 4000
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412"}
+	backends := []context.NF{
+		&GrpcServer{address: "127.0.0.1", state: stateReady},
+		&GrpcServer{address: "127.0.0.2", state: stateReady},
+		&GrpcServer{address: "127.0.0.3", state: stateReady},
+		&GrpcServer{address: "127.0.0.4", state: stateReady},
+	}
+	s := &consistentHashScheduler{}
+	before := placeUEs(s, ran, backends, ues)
+
+	tests := []struct {
+		name     string
+		backends []context.NF
+		// backend whose UEs may move, "" if none may move
+		moved string
+	}{
+		{
+			name:     "Same placement for the same backends",
+			backends: backends,
+		},
+		{
+			name:     "Backend removed",
+			backends: []context.NF{backends[0], backends[1], backends[3]},
+			moved:    "127.0.0.3",
+		},
+		{
+			name:     "Backend not ready",
+			backends: []context.NF{backends[0], &GrpcServer{address: "127.0.0.2"}, backends[2], backends[3]},
+			moved:    "127.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				after := placeUEs(s, ran, tt.backends, ues)
+				var moved int
+				for i := range before {
+					if before[i] == after[i] {
+						continue
+					}
+					if before[i] != tt.moved {
+						t.Fatalf("UE %d moved from %v to %v", i, before[i], after[i])
+					}
+					moved++
+				}
+				// each backend holds about a quarter of the UEs
+				if tt.moved != "" && (moved < ues/8 || moved > ues*3/8) {
+					t.Errorf("%d of %d UEs moved, want about %d", moved, ues, ues/4)
+				}
+			},
+		)
+	}
+}
+
+func Test_ConsistentHashSchedulerAdd(t *testing.T) {
+	const ues = 4000
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412"}
+	backends := []context.NF{
+		&GrpcServer{address: "127.0.0.1", state: stateReady},
+		&GrpcServer{address: "127.0.0.2", state: stateReady},
+		&GrpcServer{address: "127.0.0.3", state: stateReady},
+	}
+	s := &consistentHashScheduler{}
+	before := placeUEs(s, ran, backends, ues)
+	added := append(backends, &GrpcServer{address: "127.0.0.4", state: stateReady})
+	after := placeUEs(s, ran, added, ues)
+
+	var moved int
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		if after[i] != "127.0.0.4" {
+			t.Fatalf("UE %d moved from %v to %v", i, before[i], after[i])
+		}
+		moved++
+	}
+	if moved < ues/8 || moved > ues*3/8 {
+		t.Errorf("%d of %d UEs moved, want about %d", moved, ues, ues/4)
+	}
+}
+
+func Test_ConsistentHashSchedulerCandidates(t *testing.T) {
+	const ues = 4000
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412"}
+	backends := []context.NF{
+		&GrpcServer{address: "127.0.0.1", state: stateReady},
+		&GrpcServer{address: "127.0.0.2", state: stateReady},
+		&GrpcServer{address: "127.0.0.3", state: stateReady},
+	}
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	for _, instance := range backends {
+		ctx.AddNF(instance)
+	}
+	ctx.Unlock()
+	defer func() {
+		ctx.Lock()
+		defer ctx.Unlock()
+		for _, instance := range backends {
+			ctx.DeleteNF(instance)
+		}
+	}()
+
+	// the ring holds every READY backend whatever the candidates, only the
+	// UEs of the backend left out move
+	s := &consistentHashScheduler{}
+	ctx.Lock()
+	defer ctx.Unlock()
+	for i := 0; i < ues; i++ {
+		ngapID := &ngapType.RANUENGAPID{Value: int64(i)}
+		owner := s.Select(ran, ngapID, backends)
+		candidates := []context.NF{backends[0], backends[2]}
+		got := s.Select(ran, ngapID, candidates)
+		if owner != backends[1] && got != owner {
+			t.Fatalf("UE %d moved from %v to %v", i, owner.Address(), got.Address())
+		}
+		if got == backends[1] {
+			t.Fatalf("UE %d placed on %v which is not a candidate", i, got.Address())
+		}
+	}
+	if len(s.rings) != 1 {
+		t.Errorf("%d hash rings built, want 1", len(s.rings))
+	}
+}
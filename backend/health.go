@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	ctxt "context"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+var (
+	// keepaliveParams are nil when no keepalive pings are sent, the default
+	// as backends refuse pings more frequent than their enforcement policy
+	keepaliveParams *keepalive.ClientParameters
+
+	healthCheckDisabled bool
+	healthCheckInterval = defaultHealthCheckInterval
+	healthCheckTimeout  = defaultHealthCheckTimeout
+	healthCheckService  string
+)
+
+// SetKeepalive sets the keepalive pings of the connections to the backends
+// created from now on
+func SetKeepalive(cfg *config.Keepalive) {
+	keepaliveParams = nil
+	if cfg == nil || cfg.Time <= 0 {
+		logger.GrpcLog.Infoln("keepalive pings to the backends disabled")
+		return
+	}
+	keepaliveParams = &keepalive.ClientParameters{
+		Time:                cfg.Time,
+		Timeout:             cfg.Timeout,
+		PermitWithoutStream: cfg.PermitWithoutStream,
+	}
+	logger.GrpcLog.Infof("keepalive time: %v timeout: %v permit without stream: %v",
+		cfg.Time, cfg.Timeout, cfg.PermitWithoutStream)
+}
+
+// SetHealthCheck sets how the health of the backends is polled
+func SetHealthCheck(cfg *config.HealthCheck) {
+	healthCheckDisabled = false
+	healthCheckInterval = defaultHealthCheckInterval
+	healthCheckTimeout = defaultHealthCheckTimeout
+	healthCheckService = ""
+	if cfg != nil {
+		healthCheckDisabled = cfg.Disabled
+		if cfg.Interval > 0 {
+			healthCheckInterval = cfg.Interval
+		}
+		if cfg.Timeout > 0 {
+			healthCheckTimeout = cfg.Timeout
+		}
+		healthCheckService = cfg.Service
+	}
+	if healthCheckDisabled {
+		logger.GrpcLog.Infoln("health check of the backends disabled")
+		return
+	}
+	logger.GrpcLog.Infof("health check interval: %v timeout: %v service: %q",
+		healthCheckInterval, healthCheckTimeout, healthCheckService)
+}
+
+// dialOptions returns the options of the connections to the backends
+func dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(transportCredentials)}
+	if keepaliveParams != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(*keepaliveParams))
+	}
+	return opts
+}
+
+// checkHealth polls the health of the backend until ctx is done. Backends
+// which do not implement grpc.health.v1 are considered serving.
+func (b *GrpcServer) checkHealth(ctx ctxt.Context) {
+	if healthCheckDisabled {
+		return
+	}
+	client := healthpb.NewHealthClient(b.conn)
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := ctxt.WithTimeout(ctx, healthCheckTimeout)
+		response, err := client.Check(checkCtx, &healthpb.HealthCheckRequest{Service: healthCheckService})
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case status.Code(err) == codes.Unimplemented:
+			logger.GrpcLog.Infof("server %v does not implement health checking", b.address)
+			b.setServing(true)
+			return
+		case err != nil:
+			logger.GrpcLog.Warnf("health check of server %v failed: %v", b.address, err)
+			b.setServing(false)
+		default:
+			b.setServing(response.Status == healthpb.HealthCheckResponse_SERVING)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setServing records the health of the backend, a backend which is not
+// serving takes no new UEs
+func (b *GrpcServer) setServing(serving bool) {
+	if b.notServing.Swap(!serving) != !serving {
+		logger.GrpcLog.Infof("server %v serving: %v", b.address, serving)
+	}
+}
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// connectTestServer starts a gRPC server with the services registered by
+// register, and a backend connected to it
+func connectTestServer(t *testing.T, register func(*grpc.Server), opts ...grpc.ServerOption) *GrpcServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	server := grpc.NewServer(opts...)
+	register(server)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	ctx := context.Sctplb_Self()
+	b := newGrpcServer("127.0.0.1", config.Service{})
+	ctx.Lock()
+	ctx.AddNF(b)
+	ctx.Unlock()
+	t.Cleanup(func() { deleteBackendNF(b) })
+	go b.ConnectToServer(lis.Addr().(*net.TCPAddr).Port)
+	return b
+}
+
+func waitForServing(t *testing.T, b *GrpcServer, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("server State() mismatch. got = %v, want = %v", b.State(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_HealthCheck(t *testing.T) {
+	savedInterval := healthCheckInterval
+	defer func() { healthCheckInterval = savedInterval }()
+	healthCheckInterval = 20 * time.Millisecond
+
+	t.Run("Serving status followed", func(t *testing.T) {
+		healthServer := health.NewServer()
+		b := connectTestServer(t, func(server *grpc.Server) {
+			gClient.RegisterNgapServiceServer(server, &fakeAMF{})
+			healthpb.RegisterHealthServer(server, healthServer)
+		})
+		waitForServing(t, b, true)
+
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+		waitForServing(t, b, false)
+		if state := b.state.load(); state != stateReady {
+			t.Errorf("server not serving state mismatch. got = %v, want = %v", state, stateReady)
+		}
+
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+		waitForServing(t, b, true)
+	})
+
+	t.Run("Health checking not implemented", func(t *testing.T) {
+		b := connectTestServer(t, func(server *grpc.Server) {
+			gClient.RegisterNgapServiceServer(server, &fakeAMF{})
+		})
+		waitForServing(t, b, true)
+		time.Sleep(5 * healthCheckInterval)
+		if !b.State() {
+			t.Errorf("server without health checking is not serving")
+		}
+	})
+}
+
+// wedgedAMF never reads the messages of its streams
+type wedgedAMF struct {
+	gClient.UnimplementedNgapServiceServer
+	streams atomic.Int32
+}
+
+func (w *wedgedAMF) HandleMessage(stream gClient.NgapService_HandleMessageServer) error {
+	w.streams.Add(1)
+	<-stream.Context().Done()
+	return nil
+}
+
+func Test_SendTimeout(t *testing.T) {
+	savedTimeout, savedInitial := sendTimeout, reconnectInitialBackoff
+	defer func() { sendTimeout, reconnectInitialBackoff = savedTimeout, savedInitial }()
+	sendTimeout = 100 * time.Millisecond
+	reconnectInitialBackoff = 10 * time.Millisecond
+
+	amf := &wedgedAMF{}
+	// a fixed flow control window the message does not fit in
+	b := connectTestServer(t, func(server *grpc.Server) {
+		gClient.RegisterNgapServiceServer(server, amf)
+	}, grpc.InitialWindowSize(1<<16), grpc.InitialConnWindowSize(1<<16))
+	waitForState(t, b, stateReady)
+
+	gnbId := "208:93:000001"
+	// the first message is taken by the transport, the second one waits for it
+	for i := 0; i < 2; i++ {
+		if err := b.Send(make([]byte, 1<<20), false, &context.Ran{RanId: &gnbId}); err != nil {
+			t.Fatalf("Send() error: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for amf.streams.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("wedged stream not reopened, streams: %v", amf.streams.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := b.InFlight(); got != 0 {
+		t.Errorf("InFlight() after timeout = %v, want 0", got)
+	}
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// backendState is the lifecycle state of a backend
+type backendState int32
+
+const (
+	// opening, or re-opening after a failure, the stream to the backend
+	stateConnecting backendState = iota
+	// taking new UEs
+	stateReady
+	// serving its sticky UEs only
+	stateDraining
+	// given up on, the backend is deleted
+	stateFailed
+)
+
+func (s backendState) String() string {
+	switch s {
+	case stateConnecting:
+		return "CONNECTING"
+	case stateReady:
+		return "READY"
+	case stateDraining:
+		return "DRAINING"
+	case stateFailed:
+		return "FAILED"
+	}
+	return "UNKNOWN"
+}
+
+func (s *backendState) load() backendState {
+	return backendState(atomic.LoadInt32((*int32)(s)))
+}
+
+func (s *backendState) store(state backendState) backendState {
+	return backendState(atomic.SwapInt32((*int32)(s), int32(state)))
+}
+
+func (s *backendState) compareAndSwap(old, state backendState) bool {
+	return atomic.CompareAndSwapInt32((*int32)(s), int32(old), int32(state))
+}
+
+const (
+	defaultReconnectInitialBackoff = 500 * time.Millisecond
+	defaultReconnectMaxBackoff     = 10 * time.Second
+	defaultReconnectFailAfter      = time.Minute
+)
+
+var (
+	reconnectInitialBackoff = defaultReconnectInitialBackoff
+	reconnectMaxBackoff     = defaultReconnectMaxBackoff
+	reconnectFailAfter      = defaultReconnectFailAfter
+)
+
+// SetReconnect sets how backends whose stream broke are reconnected
+func SetReconnect(cfg *config.Reconnect) {
+	reconnectInitialBackoff = defaultReconnectInitialBackoff
+	reconnectMaxBackoff = defaultReconnectMaxBackoff
+	reconnectFailAfter = defaultReconnectFailAfter
+	if cfg != nil {
+		if cfg.InitialBackoff > 0 {
+			reconnectInitialBackoff = cfg.InitialBackoff
+		}
+		if cfg.MaxBackoff > 0 {
+			reconnectMaxBackoff = cfg.MaxBackoff
+		}
+		if cfg.FailAfter > 0 {
+			reconnectFailAfter = cfg.FailAfter
+		}
+	}
+	logger.DispatchLog.Infof("reconnect initial backoff: %v max backoff: %v fail after: %v",
+		reconnectInitialBackoff, reconnectMaxBackoff, reconnectFailAfter)
+}
+
+// backoff returns the exponentially growing delays between reconnection
+// attempts, each picked at random in [d/2, d) so that the replicas of sctplb
+// do not reconnect in lockstep
+type backoff struct {
+	initial  time.Duration
+	max      time.Duration
+	attempts int
+	float64  func() float64
+}
+
+func newBackoff(initial, maxDelay time.Duration) *backoff {
+	return &backoff{
+		initial: initial,
+		max:     maxDelay,
+		float64: rand.Float64,
+	}
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempts < 32 {
+		delay = min(b.initial<<b.attempts, b.max)
+	}
+	b.attempts++
+	return delay/2 + time.Duration(b.float64()*float64(delay/2))
+}
+
+func (b *backoff) reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,251 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+	"google.golang.org/grpc"
+)
+
+func Test_Backoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		random float64
+		want   []time.Duration
+	}{
+		{
+			name:   "Shortest delays",
+			random: 0,
+			want:   []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond},
+		},
+		{
+			name:   "Longest delays",
+			random: 0.5,
+			want:   []time.Duration{75 * time.Millisecond, 150 * time.Millisecond, 300 * time.Millisecond, 375 * time.Millisecond, 375 * time.Millisecond},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				retry := newBackoff(100*time.Millisecond, 500*time.Millisecond)
+				retry.float64 = func() float64 { return tt.random }
+				for i, want := range tt.want {
+					if got := retry.next(); got != want {
+						t.Errorf("next() attempt %d = %v, want %v", i, got, want)
+					}
+				}
+				retry.reset()
+				if got := retry.next(); got != tt.want[0] {
+					t.Errorf("next() after reset = %v, want %v", got, tt.want[0])
+				}
+			},
+		)
+	}
+}
+
+// fakeAMF answers the INIT messages of sctplb and passes on the others. A
+// draining fakeAMF asks sctplb to drain it on every stream.
+type fakeAMF struct {
+	gClient.UnimplementedNgapServiceServer
+	received chan *gClient.SctplbMessage
+	draining bool
+}
+
+func (f *fakeAMF) HandleMessage(stream gClient.NgapService_HandleMessageServer) error {
+	if f.draining {
+		if err := stream.Send(&gClient.AmfMessage{Msgtype: gClient.MsgType_AMF_DRAIN, AmfId: "amf"}); err != nil {
+			return err
+		}
+	}
+	for {
+		message, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if message.Msgtype == gClient.MsgType_INIT_MSG {
+			if err := stream.Send(&gClient.AmfMessage{Msgtype: gClient.MsgType_INIT_MSG, AmfId: "amf"}); err != nil {
+				return err
+			}
+			continue
+		}
+		f.received <- message
+	}
+}
+
+func startFakeAMF(t *testing.T, amf *fakeAMF, address string, opts ...grpc.ServerOption) *grpc.Server {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	server := grpc.NewServer(opts...)
+	gClient.RegisterNgapServiceServer(server, amf)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	return server
+}
+
+func waitForState(t *testing.T, b *GrpcServer, want backendState) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for b.state.load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("server state mismatch. got = %v, want = %v", b.state.load(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForMessage(t *testing.T, amf *fakeAMF, want string) {
+	t.Helper()
+	select {
+	case message := <-amf.received:
+		if message.GnbId != want {
+			t.Errorf("received message mismatch. got = %v, want = %v", message.GnbId, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message %v not received", want)
+	}
+}
+
+func Test_GrpcServerReconnect(t *testing.T) {
+	savedInitial, savedMax, savedFailAfter := reconnectInitialBackoff, reconnectMaxBackoff, reconnectFailAfter
+	defer func() {
+		reconnectInitialBackoff, reconnectMaxBackoff, reconnectFailAfter = savedInitial, savedMax, savedFailAfter
+	}()
+	reconnectInitialBackoff = 10 * time.Millisecond
+	reconnectMaxBackoff = 50 * time.Millisecond
+	reconnectFailAfter = 3 * time.Second
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	address := lis.Addr().String()
+	port := lis.Addr().(*net.TCPAddr).Port
+	lis.Close()
+
+	amf := &fakeAMF{received: make(chan *gClient.SctplbMessage, 10)}
+	server := startFakeAMF(t, amf, address)
+
+	ctx := context.Sctplb_Self()
+	b := newGrpcServer("127.0.0.1", config.Service{})
+	ctx.Lock()
+	ctx.AddNF(b)
+	ctx.Unlock()
+	go b.ConnectToServer(port)
+
+	gnbId := "208:93:000001"
+	ran := &context.Ran{RanId: &gnbId}
+
+	waitForState(t, b, stateReady)
+	if err := b.Send([]byte{1}, false, ran); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	waitForMessage(t, amf, gnbId)
+
+	// short outage, the messages wait for the new stream
+	server.Stop()
+	waitForState(t, b, stateConnecting)
+	if b.State() || !b.Reachable() {
+		t.Errorf("reconnecting server State() = %v Reachable() = %v", b.State(), b.Reachable())
+	}
+	if err := b.Send([]byte{2}, false, ran); err != nil {
+		t.Fatalf("Send() error while reconnecting: %v", err)
+	}
+	server = startFakeAMF(t, amf, address)
+	waitForState(t, b, stateReady)
+	waitForMessage(t, amf, gnbId)
+
+	// long outage, the server is deleted
+	server.Stop()
+	waitForState(t, b, stateFailed)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx.Lock()
+		var found bool
+		for _, instance := range ctx.Backends {
+			found = found || instance == context.NF(b)
+		}
+		ctx.Unlock()
+		if !found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed server %v not deleted", b.address)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_GrpcServerDrain(t *testing.T) {
+	savedInitial := reconnectInitialBackoff
+	defer func() { reconnectInitialBackoff = savedInitial }()
+	reconnectInitialBackoff = 10 * time.Millisecond
+
+	gnbId := "208:93:000001"
+	ran := &context.Ran{RanId: &gnbId}
+
+	t.Run("Drain requested by the AMF", func(t *testing.T) {
+		amf := &fakeAMF{received: make(chan *gClient.SctplbMessage, 10), draining: true}
+		b := connectTestServer(t, func(server *grpc.Server) {
+			gClient.RegisterNgapServiceServer(server, amf)
+		})
+		waitForState(t, b, stateDraining)
+		if b.State() || !reachable(b) {
+			t.Errorf("draining server State() = %v reachable() = %v", b.State(), reachable(b))
+		}
+		// the sticky UEs keep flowing
+		if err := b.Send([]byte{1}, false, ran); err != nil {
+			t.Fatalf("Send() error: %v", err)
+		}
+		waitForMessage(t, amf, gnbId)
+	})
+
+	t.Run("Drain requested by the operator", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		address := lis.Addr().String()
+		port := lis.Addr().(*net.TCPAddr).Port
+		lis.Close()
+		amf := &fakeAMF{received: make(chan *gClient.SctplbMessage, 10)}
+		server := startFakeAMF(t, amf, address)
+
+		ctx := context.Sctplb_Self()
+		b := newGrpcServer("127.0.0.1", config.Service{})
+		ctx.Lock()
+		ctx.AddNF(b)
+		ctx.Unlock()
+		defer deleteBackendNF(b)
+		go b.ConnectToServer(port)
+		waitForState(t, b, stateReady)
+
+		b.Drain()
+		if !b.Draining() || b.State() {
+			t.Errorf("drained server Draining() = %v State() = %v", b.Draining(), b.State())
+		}
+
+		// still draining once reconnected
+		server.Stop()
+		waitForState(t, b, stateConnecting)
+		server = startFakeAMF(t, amf, address)
+		defer server.Stop()
+		waitForState(t, b, stateDraining)
+
+		b.Undrain()
+		if b.Draining() || !b.State() {
+			t.Errorf("undrained server Draining() = %v State() = %v", b.Draining(), b.State())
+		}
+	})
+}
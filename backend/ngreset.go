@@ -0,0 +1,471 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// time the backends have to acknowledge an NG Reset of a gNB before sctplb
+// acknowledges it on their behalf
+var ngResetTimeout = 5 * time.Second
+
+// pendingNGReset is an NG Reset of a gNB fanned out to the backends owning
+// its UEs, acknowledged to the gNB once every backend acknowledged it
+type pendingNGReset struct {
+	ran     *context.Ran
+	partial bool
+	// UE-associated logical NG-connections acknowledged so far
+	acked []ngapType.UEAssociatedLogicalNGConnectionItem
+	// connections sent to the backends yet to acknowledge, by address
+	waiting map[string][]ngapType.UEAssociatedLogicalNGConnectionItem
+	timer   *time.Timer
+}
+
+var (
+	// NG Resets of the gNBs waiting for acknowledgements, guarded by the
+	// context lock
+	ngResets = make(map[*context.Ran]*pendingNGReset)
+	// backends which reset a gNB, in the order of their NG Resets, waiting
+	// for the acknowledgement of the gNB, nil for an NG Reset sctplb already
+	// acknowledged to its backend. Guarded by the context lock.
+	ngResetInitiators = make(map[*context.Ran][]Backend)
+)
+
+func ngResetType(ngReset *ngapType.NGReset) *ngapType.ResetType {
+	for _, ie := range ngReset.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDResetType {
+			return ie.Value.ResetType
+		}
+	}
+	return nil
+}
+
+// handleUplinkNGReset fans an NG Reset of a gNB out to the backends owning
+// its UEs, and passes the acknowledgement of an NG Reset of a backend back to
+// that backend. Returns true if the message was handled. Caller must hold
+// the context lock.
+func handleUplinkNGReset(ran *context.Ran, ranMsg *ngapType.NGAPPDU, msg []byte) bool {
+	switch {
+	case isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGReset):
+		return fanOutNGReset(ran, ranMsg.InitiatingMessage.Value.NGReset, msg)
+	case isProcedure(ranMsg, ngapType.NGAPPDUPresentSuccessfulOutcome, ngapType.ProcedureCodeNGReset):
+		initiators := ngResetInitiators[ran]
+		if len(initiators) == 0 {
+			return false
+		}
+		backend := initiators[0]
+		if len(initiators) == 1 {
+			delete(ngResetInitiators, ran)
+		} else {
+			ngResetInitiators[ran] = initiators[1:]
+		}
+		if backend == nil {
+			ran.Log.Infoln("dropped NG Reset Acknowledge of an NG Reset acknowledged by sctplb")
+			return true
+		}
+		ran.Log.Infof("NG Reset Acknowledge sent to backend %v", backend.Address())
+		if err := sendDispatched(backend, ran, msg); err != nil {
+			logger.SctpLog.Errorln("can not send:", err)
+		}
+		return true
+	}
+	return false
+}
+
+// fanOutNGReset sends an NG Reset of a gNB to every backend owning UEs of the
+// gNB, each partial reset filtered down to the UEs of the backend. A reset of
+// the whole NG interface goes to every backend when no UE of the gNB is
+// known. Connections no backend owns are acknowledged by sctplb. The backends
+// whose send queue is full wait for room once the NG Reset is recorded.
+// Caller must hold the context lock.
+func fanOutNGReset(ran *context.Ran, ngReset *ngapType.NGReset, msg []byte) bool {
+	if ngReset == nil {
+		return false
+	}
+	resetType := ngResetType(ngReset)
+	if resetType == nil {
+		ran.Log.Errorln("ResetType is nil")
+		return false
+	}
+	pending := &pendingNGReset{
+		ran:     ran,
+		waiting: make(map[string][]ngapType.UEAssociatedLogicalNGConnectionItem),
+	}
+	owners := make(map[string][]ngapType.UEAssociatedLogicalNGConnectionItem)
+	switch resetType.Present {
+	case ngapType.ResetTypePresentNGInterface:
+		prefix := getRanID(ran) + "_"
+		for key, address := range stickySessions.Snapshot() {
+			if strings.HasPrefix(key, prefix) {
+				owners[address] = nil
+			}
+		}
+		if len(owners) == 0 {
+			for _, instance := range context.Sctplb_Self().Backends {
+				owners[instance.Address()] = nil
+			}
+		}
+	case ngapType.ResetTypePresentPartOfNGInterface:
+		if resetType.PartOfNGInterface == nil {
+			ran.Log.Errorln("PartOfNGInterface is nil")
+			return false
+		}
+		pending.partial = true
+		for _, item := range resetType.PartOfNGInterface.List {
+			backend, found := lookupStickySession(ran, item.RANUENGAPID, item.AMFUENGAPID)
+			if !found {
+				pending.acked = append(pending.acked, item)
+				continue
+			}
+			owners[backend.Address()] = append(owners[backend.Address()], item)
+		}
+	default:
+		return false
+	}
+
+	type blockedReset struct {
+		backend Backend
+		reset   []byte
+	}
+	var blocked []blockedReset
+	for address, items := range owners {
+		backend := findBackend(address)
+		if backend == nil || !reachable(backend) {
+			pending.acked = append(pending.acked, items...)
+			continue
+		}
+		reset := msg
+		if pending.partial {
+			var err error
+			if reset, err = partialNGReset(ngReset, items); err != nil {
+				ran.Log.Errorf("NGAP encode error: %+v", err)
+				pending.acked = append(pending.acked, items...)
+				continue
+			}
+		}
+		if err := backend.Send(reset, false, ran); waitsForRoom(backend, err) {
+			blocked = append(blocked, blockedReset{backend: backend, reset: reset})
+		} else if err != nil {
+			logger.SctpLog.Errorln("can not send:", err)
+			pending.acked = append(pending.acked, items...)
+			continue
+		}
+		pending.waiting[address] = items
+	}
+	if count := evictNGResetStickySessions(ran, ngReset); count > 0 {
+		ran.Log.Infof("evicted %d sticky sessions", count)
+	}
+
+	if previous, ok := ngResets[ran]; ok {
+		ran.Log.Warnln("NG Reset while the previous one is not acknowledged")
+		completeNGReset(previous)
+	}
+	if len(pending.waiting) == 0 {
+		completeNGReset(pending)
+		return true
+	}
+	ran.Log.Infof("NG Reset sent to %d backends", len(pending.waiting))
+	ngResets[ran] = pending
+	pending.timer = time.AfterFunc(ngResetTimeout, func() {
+		ctx := context.Sctplb_Self()
+		ctx.Lock()
+		defer ctx.Unlock()
+		if ngResets[ran] != pending {
+			return
+		}
+		for address, items := range pending.waiting {
+			ran.Log.Warnf("NG Reset not acknowledged by backend %v within %v", address, ngResetTimeout)
+			pending.acked = append(pending.acked, items...)
+		}
+		completeNGReset(pending)
+	})
+	for _, b := range blocked {
+		if err := sendWaiting(b.backend, ran, b.reset); err != nil {
+			logger.SctpLog.Errorln("can not send:", err)
+			failNGReset(pending, b.backend.Address())
+		}
+	}
+	return true
+}
+
+// failNGReset acknowledges the connections of an NG Reset owned by a backend
+// the NG Reset could not be sent to. Caller must hold the context lock.
+func failNGReset(pending *pendingNGReset, address string) {
+	items, ok := pending.waiting[address]
+	if !ok {
+		return
+	}
+	delete(pending.waiting, address)
+	pending.acked = append(pending.acked, items...)
+	if len(pending.waiting) == 0 && ngResets[pending.ran] == pending {
+		completeNGReset(pending)
+	}
+}
+
+// partialNGReset returns an NG Reset resetting only the given connections
+func partialNGReset(ngReset *ngapType.NGReset, items []ngapType.UEAssociatedLogicalNGConnectionItem) ([]byte, error) {
+	filtered := &ngapType.NGReset{}
+	for _, ie := range ngReset.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDResetType {
+			ie.Value.ResetType = &ngapType.ResetType{
+				Present:           ngapType.ResetTypePresentPartOfNGInterface,
+				PartOfNGInterface: &ngapType.UEAssociatedLogicalNGConnectionList{List: items},
+			}
+		}
+		filtered.ProtocolIEs.List = append(filtered.ProtocolIEs.List, ie)
+	}
+	return ngap.Encoder(ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeNGReset},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+			Value: ngapType.InitiatingMessageValue{
+				Present: ngapType.InitiatingMessagePresentNGReset,
+				NGReset: filtered,
+			},
+		},
+	})
+}
+
+// handleDownlinkNGReset collects the acknowledgement of a backend to an NG
+// Reset of a gNB, and evicts the sticky sessions an NG Reset of a backend
+// resets. The NG interface of the gNB is shared by every backend, so an NG
+// Reset of the whole NG interface by a backend is acknowledged by sctplb and
+// passed on to the gNB as a reset of the UEs of the backend only. Returns
+// true if the message was consumed by sctplb.
+func handleDownlinkNGReset(backend Backend, ran *context.Ran, amfMsg *ngapType.NGAPPDU) bool {
+	switch {
+	case isProcedure(amfMsg, ngapType.NGAPPDUPresentSuccessfulOutcome, ngapType.ProcedureCodeNGReset):
+		ctx := context.Sctplb_Self()
+		ctx.Lock()
+		defer ctx.Unlock()
+		pending, ok := ngResets[ran]
+		if !ok {
+			return false
+		}
+		items, ok := pending.waiting[backend.Address()]
+		if !ok {
+			ran.Log.Infof("dropped NG Reset Acknowledge of backend %v", backend.Address())
+			return true
+		}
+		delete(pending.waiting, backend.Address())
+		if acked := ngResetAcknowledgedConnections(amfMsg.SuccessfulOutcome.Value.NGResetAcknowledge); acked != nil {
+			items = acked
+		}
+		pending.acked = append(pending.acked, items...)
+		if len(pending.waiting) == 0 {
+			completeNGReset(pending)
+		}
+		return true
+	case isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGReset):
+		ngReset := amfMsg.InitiatingMessage.Value.NGReset
+		if ngReset == nil {
+			return false
+		}
+		ctx := context.Sctplb_Self()
+		ctx.Lock()
+		defer ctx.Unlock()
+		if resetType := ngResetType(ngReset); resetType != nil && resetType.Present == ngapType.ResetTypePresentNGInterface {
+			resetBackendUEs(backend, ran, ngReset)
+			return true
+		}
+		if count := evictBackendNGResetStickySessions(backend, ran, ngReset); count > 0 {
+			ran.Log.Infof("NG Reset of backend %v evicted %d sticky sessions", backend.Address(), count)
+		}
+		ngResetInitiators[ran] = append(ngResetInitiators[ran], backend)
+	}
+	return false
+}
+
+// resetBackendUEs acknowledges an NG Reset of the whole NG interface of a
+// gNB by a backend, and resets the UEs of the gNB the backend owns with a
+// partial NG Reset. Caller must hold the context lock.
+func resetBackendUEs(backend Backend, ran *context.Ran, ngReset *ngapType.NGReset) {
+	keys := backendStickyKeys(backend, ran)
+	items := stickyNGConnections(ran, keys)
+	for _, key := range keys {
+		stickySessions.Delete(key)
+	}
+	resetRanUEs(backend, ran, ngReset, items)
+	if ack, err := ngap.Encoder(*ngResetAcknowledgePDU(nil)); err != nil {
+		ran.Log.Errorf("NGAP encode error: %+v", err)
+	} else if err := sendDispatched(backend, ran, ack); err != nil {
+		logger.SctpLog.Errorln("can not send:", err)
+	}
+}
+
+// resetRanUEs sends to a gNB the partial NG Reset of the UE connections a
+// backend owns. Caller must hold the context lock.
+func resetRanUEs(backend Backend, ran *context.Ran, ngReset *ngapType.NGReset,
+	items []ngapType.UEAssociatedLogicalNGConnectionItem,
+) {
+	if len(items) == 0 {
+		ran.Log.Infof("NG Reset of backend %v owning no UE acknowledged", backend.Address())
+		return
+	}
+	reset, err := partialNGReset(ngReset, items)
+	if err != nil {
+		ran.Log.Errorf("NGAP encode error: %+v", err)
+		return
+	}
+	ran.Log.Infof("NG Reset of backend %v sent as a reset of its %d UE connections", backend.Address(), len(items))
+	if _, err := ran.Conn.Write(reset); err != nil {
+		ran.Log.Infof("err %+v", err)
+		return
+	}
+	ngResetInitiators[ran] = append(ngResetInitiators[ran], nil)
+}
+
+// backendStickyKeys returns the sticky session keys of the UEs of a gNB a
+// backend owns
+func backendStickyKeys(backend Backend, ran *context.Ran) []string {
+	prefix := getRanID(ran) + "_"
+	var keys []string
+	for key, address := range stickySessions.Snapshot() {
+		if strings.HasPrefix(key, prefix) && address == backend.Address() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// stickyNGConnections returns the UE-associated logical NG-connections of the
+// sticky session keys of a gNB, by RAN-UE-NGAP-ID or by AMF-UE-NGAP-ID
+func stickyNGConnections(ran *context.Ran, keys []string) []ngapType.UEAssociatedLogicalNGConnectionItem {
+	prefix := getRanID(ran) + "_"
+	var items []ngapType.UEAssociatedLogicalNGConnectionItem
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, prefix)
+		if amfID, ok := strings.CutPrefix(id, "amf_"); ok {
+			if value, err := strconv.ParseInt(amfID, 10, 64); err == nil {
+				items = append(items, ngapType.UEAssociatedLogicalNGConnectionItem{
+					AMFUENGAPID: &ngapType.AMFUENGAPID{Value: value},
+				})
+			}
+		} else if value, err := strconv.ParseInt(id, 10, 64); err == nil {
+			items = append(items, ngapType.UEAssociatedLogicalNGConnectionItem{
+				RANUENGAPID: &ngapType.RANUENGAPID{Value: value},
+			})
+		}
+	}
+	return items
+}
+
+func ngResetAcknowledgedConnections(ack *ngapType.NGResetAcknowledge) []ngapType.UEAssociatedLogicalNGConnectionItem {
+	if ack == nil {
+		return nil
+	}
+	for _, ie := range ack.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDUEAssociatedLogicalNGConnectionList &&
+			ie.Value.UEAssociatedLogicalNGConnectionList != nil {
+			return ie.Value.UEAssociatedLogicalNGConnectionList.List
+		}
+	}
+	return nil
+}
+
+// evictBackendNGResetStickySessions removes the sticky sessions of a backend
+// reset by its NG Reset of a gNB. The UEs of the gNB owned by the other
+// backends are kept.
+func evictBackendNGResetStickySessions(backend Backend, ran *context.Ran, ngReset *ngapType.NGReset) int {
+	resetType := ngResetType(ngReset)
+	if resetType == nil {
+		ran.Log.Errorln("ResetType is nil")
+		return 0
+	}
+	var keys []string
+	switch resetType.Present {
+	case ngapType.ResetTypePresentNGInterface:
+		prefix := getRanID(ran) + "_"
+		for key, address := range stickySessions.Snapshot() {
+			if strings.HasPrefix(key, prefix) && address == backend.Address() {
+				keys = append(keys, key)
+			}
+		}
+	case ngapType.ResetTypePresentPartOfNGInterface:
+		if resetType.PartOfNGInterface == nil {
+			ran.Log.Errorln("PartOfNGInterface is nil")
+			return 0
+		}
+		for _, item := range resetType.PartOfNGInterface.List {
+			if item.RANUENGAPID != nil {
+				keys = append(keys, stickyKey(ran, item.RANUENGAPID))
+			}
+			if item.AMFUENGAPID != nil {
+				keys = append(keys, amfStickyKey(ran, item.AMFUENGAPID))
+			}
+		}
+	}
+	var count int
+	for _, key := range keys {
+		if address, found := stickySessions.Get(key); found && address == backend.Address() &&
+			stickySessions.Delete(key) {
+			count++
+		}
+	}
+	return count
+}
+
+// completeNGReset acknowledges an NG Reset to the gNB. Caller must hold the
+// context lock.
+func completeNGReset(pending *pendingNGReset) {
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	if ngResets[pending.ran] == pending {
+		delete(ngResets, pending.ran)
+	}
+	var acked []ngapType.UEAssociatedLogicalNGConnectionItem
+	if pending.partial {
+		acked = pending.acked
+	}
+	pending.ran.Log.Infoln("send NG Reset Acknowledge")
+	writeNGAP(pending.ran, ngResetAcknowledgePDU(acked))
+}
+
+// ngResetAcknowledgePDU returns an NG Reset Acknowledge of the given
+// connections, of the whole NG interface without any
+func ngResetAcknowledgePDU(acked []ngapType.UEAssociatedLogicalNGConnectionItem) *ngapType.NGAPPDU {
+	ack := &ngapType.NGResetAcknowledge{}
+	if len(acked) > 0 {
+		ack.ProtocolIEs.List = append(ack.ProtocolIEs.List, ngapType.NGResetAcknowledgeIEs{
+			Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDUEAssociatedLogicalNGConnectionList},
+			Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+			Value: ngapType.NGResetAcknowledgeIEsValue{
+				Present:                             ngapType.NGResetAcknowledgeIEsPresentUEAssociatedLogicalNGConnectionList,
+				UEAssociatedLogicalNGConnectionList: &ngapType.UEAssociatedLogicalNGConnectionList{List: acked},
+			},
+		})
+	}
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentSuccessfulOutcome,
+		SuccessfulOutcome: &ngapType.SuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeNGReset},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+			Value: ngapType.SuccessfulOutcomeValue{
+				Present:            ngapType.SuccessfulOutcomePresentNGResetAcknowledge,
+				NGResetAcknowledge: ack,
+			},
+		},
+	}
+}
+
+// forgetNGReset drops the NG Resets of a closed gNB. Caller must hold the
+// context lock.
+func forgetNGReset(ran *context.Ran) {
+	if pending, ok := ngResets[ran]; ok {
+		pending.timer.Stop()
+		delete(ngResets, ran)
+	}
+	delete(ngResetInitiators, ran)
+}
@@ -0,0 +1,422 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// resetOf returns an encodable NG Reset of the UEs of the given
+// RAN-UE-NGAP-IDs, of the whole NG interface without any
+func resetOf(ranUeNgapIDs ...int64) *ngapType.NGAPPDU {
+	resetType := &ngapType.ResetType{
+		Present:     ngapType.ResetTypePresentNGInterface,
+		NGInterface: &ngapType.ResetAll{Value: ngapType.ResetAllPresentResetAll},
+	}
+	if len(ranUeNgapIDs) > 0 {
+		list := &ngapType.UEAssociatedLogicalNGConnectionList{}
+		for _, id := range ranUeNgapIDs {
+			list.List = append(list.List, ngapType.UEAssociatedLogicalNGConnectionItem{
+				RANUENGAPID: &ngapType.RANUENGAPID{Value: id},
+			})
+		}
+		resetType = &ngapType.ResetType{
+			Present:           ngapType.ResetTypePresentPartOfNGInterface,
+			PartOfNGInterface: list,
+		}
+	}
+	pdu := ngReset(resetType)
+	ngapMsg := pdu.InitiatingMessage.Value.NGReset
+	ngapMsg.ProtocolIEs.List = append([]ngapType.NGResetIEs{{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDCause},
+		Value: ngapType.NGResetIEsValue{
+			Present: ngapType.NGResetIEsPresentCause,
+			Cause: &ngapType.Cause{
+				Present: ngapType.CausePresentMisc,
+				Misc:    &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentUnspecified},
+			},
+		},
+	}}, ngapMsg.ProtocolIEs.List...)
+	return pdu
+}
+
+func ngResetAcknowledge(ranUeNgapIDs ...int64) *ngapType.NGAPPDU {
+	pending := &pendingNGReset{partial: len(ranUeNgapIDs) > 0}
+	for _, id := range ranUeNgapIDs {
+		pending.acked = append(pending.acked, ngapType.UEAssociatedLogicalNGConnectionItem{
+			RANUENGAPID: &ngapType.RANUENGAPID{Value: id},
+		})
+	}
+	conn := &recordingConn{}
+	pending.ran = &context.Ran{Conn: conn, Log: logger.RanLog}
+	completeNGReset(pending)
+	pdu, err := ngap.Decoder(conn.written[0])
+	if err != nil {
+		panic(err)
+	}
+	return pdu
+}
+
+// resetUEs returns the RAN-UE-NGAP-IDs an NG Reset or NG Reset Acknowledge
+// lists, nil for the whole NG interface
+func resetUEs(t *testing.T, pdu *ngapType.NGAPPDU) []int64 {
+	t.Helper()
+	var list *ngapType.UEAssociatedLogicalNGConnectionList
+	switch {
+	case isProcedure(pdu, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGReset):
+		list = ngResetType(pdu.InitiatingMessage.Value.NGReset).PartOfNGInterface
+	case isProcedure(pdu, ngapType.NGAPPDUPresentSuccessfulOutcome, ngapType.ProcedureCodeNGReset):
+		list = &ngapType.UEAssociatedLogicalNGConnectionList{
+			List: ngResetAcknowledgedConnections(pdu.SuccessfulOutcome.Value.NGResetAcknowledge),
+		}
+	default:
+		t.Fatalf("not an NG Reset procedure: %+v", pdu)
+	}
+	var ids []int64
+	if list != nil {
+		for _, item := range list.List {
+			ids = append(ids, item.RANUENGAPID.Value)
+		}
+	}
+	return ids
+}
+
+// receivedReset returns the UEs of the NG Reset a backend was sent, fails if
+// it was sent none
+func receivedReset(t *testing.T, b *GrpcServer) []int64 {
+	t.Helper()
+	select {
+	case message := <-b.queue.messages:
+		pdu, err := ngap.Decoder(message.Msg)
+		if err != nil {
+			t.Fatalf("NGAP decode error: %v", err)
+		}
+		return resetUEs(t, pdu)
+	default:
+		t.Fatalf("backend %v was sent no NG Reset", b.address)
+	}
+	return nil
+}
+
+func equalIDs(got, want []int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	counts := make(map[int64]int)
+	for _, id := range got {
+		counts[id]++
+	}
+	for _, id := range want {
+		counts[id]--
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_NGResetFanOut(t *testing.T) {
+	savedTimeout, saved := ngResetTimeout, stickySessions
+	defer func() { ngResetTimeout, stickySessions = savedTimeout, saved }()
+
+	ctx := context.Sctplb_Self()
+	first := setupBackend(stateReady, nil)
+	second := setupBackend(stateReady, nil)
+	second.address = "127.0.0.2"
+	ctx.Lock()
+	ctx.AddNF(first)
+	ctx.AddNF(second)
+	ctx.Unlock()
+	defer deleteBackendNF(first)
+	defer deleteBackendNF(second)
+
+	tests := []struct {
+		name      string
+		reset     *ngapType.NGAPPDU
+		acks      map[*GrpcServer]*ngapType.NGAPPDU
+		wantFirst []int64
+		// second backend not sent the NG Reset if nil
+		wantSecond []int64
+		wantAck    []int64
+		timeout    bool
+	}{
+		{
+			name:  "Partial reset filtered per backend",
+			reset: resetOf(1, 2, 3),
+			acks: map[*GrpcServer]*ngapType.NGAPPDU{
+				first:  ngResetAcknowledge(1),
+				second: ngResetAcknowledge(),
+			},
+			wantFirst:  []int64{1},
+			wantSecond: []int64{2},
+			wantAck:    []int64{1, 2, 3},
+		},
+		{
+			name:      "Partial reset of a single backend",
+			reset:     resetOf(1),
+			acks:      map[*GrpcServer]*ngapType.NGAPPDU{first: ngResetAcknowledge(1)},
+			wantFirst: []int64{1},
+			wantAck:   []int64{1},
+		},
+		{
+			name:  "Whole reset sent to the owners",
+			reset: resetOf(),
+			acks: map[*GrpcServer]*ngapType.NGAPPDU{
+				first:  ngResetAcknowledge(),
+				second: ngResetAcknowledge(),
+			},
+			wantSecond: []int64{},
+		},
+		{
+			name:       "Unacknowledged reset times out",
+			reset:      resetOf(1, 2),
+			acks:       map[*GrpcServer]*ngapType.NGAPPDU{first: ngResetAcknowledge(1)},
+			wantFirst:  []int64{1},
+			wantSecond: []int64{2},
+			wantAck:    []int64{1, 2},
+			timeout:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				ngResetTimeout = time.Minute
+				if tt.timeout {
+					ngResetTimeout = 50 * time.Millisecond
+				}
+				conn := &recordingConn{}
+				ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+				stickySessions = newMemoryStore(time.Minute, 0)
+				stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: 1}), first.address)
+				stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: 2}), second.address)
+
+				ctx.Lock()
+				handled := handleUplinkNGReset(ran, tt.reset, encodeNGAP(t, tt.reset))
+				ctx.Unlock()
+				if !handled {
+					t.Fatalf("NG Reset not handled")
+				}
+				if got := receivedReset(t, first); !equalIDs(got, tt.wantFirst) {
+					t.Errorf("first backend reset mismatch. got = %v, want = %v", got, tt.wantFirst)
+				}
+				if tt.wantSecond != nil {
+					if got := receivedReset(t, second); !equalIDs(got, tt.wantSecond) {
+						t.Errorf("second backend reset mismatch. got = %v, want = %v", got, tt.wantSecond)
+					}
+				} else if len(second.queue.messages) != 0 {
+					t.Errorf("second backend owning no reset UE was sent the NG Reset")
+				}
+				if _, found := stickySessions.Get(stickyKey(ran, &ngapType.RANUENGAPID{Value: 1})); found {
+					t.Errorf("sticky session of the reset UE not evicted")
+				}
+
+				for b, ack := range tt.acks {
+					if len(conn.messages(t)) != 0 {
+						t.Fatalf("NG Reset acknowledged before every backend did")
+					}
+					if !handleDownlinkNGReset(b, ran, ack) {
+						t.Errorf("NG Reset Acknowledge of backend %v passed on to the gNB", b.address)
+					}
+				}
+				if tt.timeout {
+					time.Sleep(10 * ngResetTimeout)
+				}
+				pdus := conn.messages(t)
+				if len(pdus) != 1 {
+					t.Fatalf("gNB messages mismatch. got = %d, want = 1", len(pdus))
+				}
+				if got := resetUEs(t, pdus[0]); !equalIDs(got, tt.wantAck) {
+					t.Errorf("NG Reset Acknowledge mismatch. got = %v, want = %v", got, tt.wantAck)
+				}
+				if len(ngResets) != 0 {
+					t.Errorf("NG Reset still pending once acknowledged")
+				}
+			},
+		)
+	}
+}
+
+func Test_AMFNGReset(t *testing.T) {
+	saved := stickySessions
+	defer func() { stickySessions = saved }()
+
+	ctx := context.Sctplb_Self()
+	first := setupBackend(stateReady, nil)
+	second := setupBackend(stateReady, nil)
+	second.address = "127.0.0.2"
+	ctx.Lock()
+	ctx.AddNF(first)
+	ctx.AddNF(second)
+	ctx.Unlock()
+	defer deleteBackendNF(first)
+	defer deleteBackendNF(second)
+
+	conn := &recordingConn{}
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+	stickySessions = newMemoryStore(time.Minute, 0)
+	stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: 1}), first.address)
+	stickySessions.Put(amfStickyKey(ran, &ngapType.AMFUENGAPID{Value: 7}), first.address)
+	stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: 2}), second.address)
+	stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: 3}), second.address)
+
+	// the NG Reset of the whole NG interface by the first backend is
+	// acknowledged by sctplb and only resets the UEs of the backend
+	if !handleDownlinkNGReset(first, ran, resetOf()) {
+		t.Fatalf("NG Reset of the whole NG interface passed on to the gNB")
+	}
+	if got := receivedReset(t, first); got != nil {
+		t.Errorf("backend sent an acknowledgement of UEs %v, want the whole NG interface", got)
+	}
+	if len(second.queue.messages) != 0 {
+		t.Errorf("NG Reset Acknowledge sent to the wrong backend")
+	}
+	pdus := conn.messages(t)
+	if len(pdus) != 1 || !isProcedure(pdus[0], ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGReset) {
+		t.Fatalf("gNB was sent %+v, want a single NG Reset", pdus)
+	}
+	resetType := ngResetType(pdus[0].InitiatingMessage.Value.NGReset)
+	if resetType.Present != ngapType.ResetTypePresentPartOfNGInterface {
+		t.Fatalf("gNB was sent an NG Reset of the whole NG interface")
+	}
+	var ranUeNgapIDs, amfUeNgapIDs []int64
+	for _, item := range resetType.PartOfNGInterface.List {
+		if item.RANUENGAPID != nil {
+			ranUeNgapIDs = append(ranUeNgapIDs, item.RANUENGAPID.Value)
+		}
+		if item.AMFUENGAPID != nil {
+			amfUeNgapIDs = append(amfUeNgapIDs, item.AMFUENGAPID.Value)
+		}
+	}
+	if !equalIDs(ranUeNgapIDs, []int64{1}) || !equalIDs(amfUeNgapIDs, []int64{7}) {
+		t.Errorf("gNB was sent a reset of RAN UEs %v and AMF UEs %v, want %v and %v",
+			ranUeNgapIDs, amfUeNgapIDs, []int64{1}, []int64{7})
+	}
+	if stickySessions.Len() != 2 {
+		t.Errorf("stickySessions length mismatch. got = %d, want = 2", stickySessions.Len())
+	}
+	for _, id := range []int64{2, 3} {
+		if _, found := stickySessions.Get(stickyKey(ran, &ngapType.RANUENGAPID{Value: id})); !found {
+			t.Errorf("sticky session %d of another backend evicted", id)
+		}
+	}
+
+	// the acknowledgement of the gNB is not passed on
+	ack := ngResetAcknowledge(1)
+	ctx.Lock()
+	handled := handleUplinkNGReset(ran, ack, encodeNGAP(t, ack))
+	ctx.Unlock()
+	if !handled {
+		t.Fatalf("NG Reset Acknowledge of the gNB not handled")
+	}
+	if len(first.queue.messages) != 0 || len(second.queue.messages) != 0 {
+		t.Errorf("NG Reset Acknowledge of an NG Reset acknowledged by sctplb sent to a backend")
+	}
+
+	// a partial NG Reset of the second backend is passed on, and so is the
+	// acknowledgement of the gNB
+	if handleDownlinkNGReset(second, ran, resetOf(2)) {
+		t.Errorf("partial NG Reset of a backend not passed on to the gNB")
+	}
+	if _, found := stickySessions.Get(stickyKey(ran, &ngapType.RANUENGAPID{Value: 2})); found {
+		t.Errorf("sticky session reset by the backend not evicted")
+	}
+	if stickySessions.Len() != 1 {
+		t.Errorf("stickySessions length mismatch. got = %d, want = 1", stickySessions.Len())
+	}
+	ack = ngResetAcknowledge(2)
+	ctx.Lock()
+	handled = handleUplinkNGReset(ran, ack, encodeNGAP(t, ack))
+	ctx.Unlock()
+	if !handled {
+		t.Fatalf("NG Reset Acknowledge of the gNB not handled")
+	}
+	if len(first.queue.messages) != 0 || len(second.queue.messages) != 1 {
+		t.Errorf("NG Reset Acknowledge sent to the wrong backend")
+	}
+	if len(ngResetInitiators) != 0 {
+		t.Errorf("NG Reset of the backend still waiting for acknowledgement")
+	}
+}
+
+func Test_NGResetFanOutFullQueue(t *testing.T) {
+	savedTimeout, saved := ngResetTimeout, stickySessions
+	defer func() { ngResetTimeout, stickySessions = savedTimeout, saved }()
+	ngResetTimeout = time.Minute
+
+	ctx := context.Sctplb_Self()
+	first := setupBackend(stateReady, nil)
+	first.queue = newSendQueue(1, overflowBlock)
+	defer first.queue.attach()()
+	second := setupBackend(stateReady, nil)
+	second.address = "127.0.0.2"
+	ctx.Lock()
+	ctx.AddNF(first)
+	ctx.AddNF(second)
+	ctx.Unlock()
+	defer deleteBackendNF(first)
+	defer deleteBackendNF(second)
+
+	conn := &recordingConn{}
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+	stickySessions = newMemoryStore(time.Minute, 0)
+	stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: 1}), first.address)
+	stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: 2}), second.address)
+	if err := first.Send([]byte{0}, false, ran); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+
+	reset := resetOf(1, 2)
+	firstAck, secondAck := ngResetAcknowledge(1), ngResetAcknowledge(2)
+	handled := make(chan bool, 1)
+	go func() {
+		ctx.Lock()
+		defer ctx.Unlock()
+		handled <- handleUplinkNGReset(ran, reset, encodeNGAP(t, reset))
+	}()
+	select {
+	case <-handled:
+		t.Fatalf("NG Reset handled while the queue of backend %v is full", first.address)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the other backend acknowledges while the first one waits for room
+	if !handleDownlinkNGReset(second, ran, secondAck) {
+		t.Errorf("NG Reset Acknowledge of backend %v passed on to the gNB", second.address)
+	}
+	if len(conn.messages(t)) != 0 {
+		t.Fatalf("NG Reset acknowledged before every backend did")
+	}
+
+	<-first.queue.messages
+	select {
+	case ok := <-handled:
+		if !ok {
+			t.Fatalf("NG Reset not handled")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("NG Reset still waiting once the queue has room")
+	}
+	if got := receivedReset(t, first); !equalIDs(got, []int64{1}) {
+		t.Errorf("first backend reset mismatch. got = %v, want = %v", got, []int64{1})
+	}
+	if !handleDownlinkNGReset(first, ran, firstAck) {
+		t.Errorf("NG Reset Acknowledge of backend %v passed on to the gNB", first.address)
+	}
+	pdus := conn.messages(t)
+	if len(pdus) != 1 {
+		t.Fatalf("gNB messages mismatch. got = %d, want = 1", len(pdus))
+	}
+	if got := resetUEs(t, pdus[0]); !equalIDs(got, []int64{1, 2}) {
+		t.Errorf("NG Reset Acknowledge mismatch. got = %v, want = %v", got, []int64{1, 2})
+	}
+}
@@ -0,0 +1,428 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+const (
+	defaultAMFName = "sctplb"
+	// largest RelativeAMFCapacity
+	maxRelativeAMFCapacity = 255
+)
+
+var (
+	localNGSetup bool
+	localAMFName = defaultAMFName
+)
+
+// ngSetups tracks the gNBs set up by sctplb, guarded by the context lock
+var ngSetups = struct {
+	// gNBs waiting for a backend to tell its NG Setup data
+	pending map[*context.Ran]bool
+	// gNBs sent the merged NG Setup data
+	answered map[*context.Ran]bool
+	// merged NG Setup data the answered gNBs know
+	announced *amfSetup
+}{
+	pending:  make(map[*context.Ran]bool),
+	answered: make(map[*context.Ran]bool),
+}
+
+// SetNGSetup sets whether sctplb answers the NG Setup Requests of the gNBs
+// itself, presenting the backends as a single AMF
+func SetNGSetup(cfg *config.NgSetup) {
+	localNGSetup = cfg != nil && cfg.Local
+	localAMFName = defaultAMFName
+	if cfg != nil && cfg.AmfName != "" {
+		localAMFName = cfg.AmfName
+	}
+	if localNGSetup {
+		logger.DispatchLog.Infof("NG Setup handled by sctplb as AMF %v", localAMFName)
+	} else {
+		logger.DispatchLog.Infoln("NG Setup forwarded to the backends")
+	}
+}
+
+// amfSetup is what an AMF tells the gNBs about itself in NG Setup Response
+// and AMF Configuration Update
+type amfSetup struct {
+	name     string
+	guamis   []ngapType.ServedGUAMIItem
+	plmns    []ngapType.PLMNSupportItem
+	capacity int64
+}
+
+// setupServer is implemented by the backends which learn the NG Setup data
+// of their AMF
+type setupServer interface {
+	AMFSetup() *amfSetup
+}
+
+// gnbSetupNotifier is implemented by the backends told about the gNBs set up
+// by sctplb, which answer with the NG Setup data of their AMF
+type gnbSetupNotifier interface {
+	NotifyGnbSetup(ran *context.Ran) error
+}
+
+// isProcedure returns true if a PDU is the message of present type of a
+// procedure
+func isProcedure(pdu *ngapType.NGAPPDU, present int, procedureCode int64) bool {
+	if pdu.Present != present {
+		return false
+	}
+	switch present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		return pdu.InitiatingMessage != nil && pdu.InitiatingMessage.ProcedureCode.Value == procedureCode
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		return pdu.SuccessfulOutcome != nil && pdu.SuccessfulOutcome.ProcedureCode.Value == procedureCode
+	case ngapType.NGAPPDUPresentUnsuccessfulOutcome:
+		return pdu.UnsuccessfulOutcome != nil && pdu.UnsuccessfulOutcome.ProcedureCode.Value == procedureCode
+	}
+	return false
+}
+
+func isNGSetupOutcome(amfMsg *ngapType.NGAPPDU) bool {
+	return isProcedure(amfMsg, ngapType.NGAPPDUPresentSuccessfulOutcome, ngapType.ProcedureCodeNGSetup) ||
+		isProcedure(amfMsg, ngapType.NGAPPDUPresentUnsuccessfulOutcome, ngapType.ProcedureCodeNGSetup)
+}
+
+// isLocalNGSetupProcedure returns true if an AMF message belongs to the
+// procedures sctplb handles itself in local NG Setup mode
+func isLocalNGSetupProcedure(amfMsg *ngapType.NGAPPDU) bool {
+	return isNGSetupOutcome(amfMsg) ||
+		isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeAMFConfigurationUpdate)
+}
+
+// isAMFConfigurationUpdateOutcome returns true if a gNB message answers an
+// AMF Configuration Update
+func isAMFConfigurationUpdateOutcome(ranMsg *ngapType.NGAPPDU) bool {
+	return isProcedure(ranMsg, ngapType.NGAPPDUPresentSuccessfulOutcome, ngapType.ProcedureCodeAMFConfigurationUpdate) ||
+		isProcedure(ranMsg, ngapType.NGAPPDUPresentUnsuccessfulOutcome, ngapType.ProcedureCodeAMFConfigurationUpdate)
+}
+
+// updateAMFSetup returns the NG Setup data of an AMF once it sent an NG Setup
+// Response or AMF Configuration Update, nil for any other PDU
+func updateAMFSetup(previous *amfSetup, amfMsg *ngapType.NGAPPDU) *amfSetup {
+	setup := &amfSetup{}
+	apply := func(name *ngapType.AMFName, guamis *ngapType.ServedGUAMIList,
+		capacity *ngapType.RelativeAMFCapacity, plmns *ngapType.PLMNSupportList,
+	) {
+		if name != nil {
+			setup.name = name.Value
+		}
+		if guamis != nil {
+			setup.guamis = guamis.List
+		}
+		if capacity != nil {
+			setup.capacity = capacity.Value
+		}
+		if plmns != nil {
+			setup.plmns = plmns.List
+		}
+	}
+	switch {
+	case isProcedure(amfMsg, ngapType.NGAPPDUPresentSuccessfulOutcome, ngapType.ProcedureCodeNGSetup):
+		ngapMsg := amfMsg.SuccessfulOutcome.Value.NGSetupResponse
+		if ngapMsg == nil {
+			return nil
+		}
+		for _, ie := range ngapMsg.ProtocolIEs.List {
+			apply(ie.Value.AMFName, ie.Value.ServedGUAMIList, ie.Value.RelativeAMFCapacity, ie.Value.PLMNSupportList)
+		}
+	case isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeAMFConfigurationUpdate):
+		ngapMsg := amfMsg.InitiatingMessage.Value.AMFConfigurationUpdate
+		if ngapMsg == nil {
+			return nil
+		}
+		if previous != nil {
+			*setup = *previous
+		}
+		for _, ie := range ngapMsg.ProtocolIEs.List {
+			apply(ie.Value.AMFName, ie.Value.ServedGUAMIList, ie.Value.RelativeAMFCapacity, ie.Value.PLMNSupportList)
+		}
+	default:
+		return nil
+	}
+	return setup
+}
+
+// learnAMFSetup records the NG Setup data an AMF message carries. Returns
+// true if it changed.
+func learnAMFSetup(learned *atomic.Pointer[amfSetup], amfMsg *ngapType.NGAPPDU) bool {
+	setup := updateAMFSetup(learned.Load(), amfMsg)
+	if setup == nil {
+		return false
+	}
+	previous := learned.Swap(setup)
+	return previous == nil || !reflect.DeepEqual(previous, setup)
+}
+
+// mergeAMFSetups returns the NG Setup data of the READY backends presented as
+// a single AMF: the union of their GUAMIs and slices, and the sum of their
+// capacities. The gNBs are not told about the GUAMIs of a DRAINING backend,
+// which takes no new UEs. Returns nil until a READY backend told its NG Setup
+// data.
+func mergeAMFSetups(backends []context.NF) *amfSetup {
+	var merged *amfSetup
+	for _, instance := range readyBackends(backends) {
+		server, ok := instance.(setupServer)
+		if !ok {
+			continue
+		}
+		setup := server.AMFSetup()
+		if setup == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &amfSetup{name: localAMFName}
+		}
+		for _, guami := range setup.guamis {
+			if !containsGUAMI(merged.guamis, guami) {
+				merged.guamis = append(merged.guamis, guami)
+			}
+		}
+		for _, plmn := range setup.plmns {
+			merged.plmns = mergePLMNSupport(merged.plmns, plmn)
+		}
+		merged.capacity = min(merged.capacity+setup.capacity, maxRelativeAMFCapacity)
+	}
+	return merged
+}
+
+func containsGUAMI(guamis []ngapType.ServedGUAMIItem, guami ngapType.ServedGUAMIItem) bool {
+	for _, served := range guamis {
+		if reflect.DeepEqual(served.GUAMI, guami.GUAMI) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergePLMNSupport adds the slices of a PLMN to the supported PLMNs
+func mergePLMNSupport(plmns []ngapType.PLMNSupportItem, plmn ngapType.PLMNSupportItem) []ngapType.PLMNSupportItem {
+	for i := range plmns {
+		if !bytes.Equal(plmns[i].PLMNIdentity.Value, plmn.PLMNIdentity.Value) {
+			continue
+		}
+		slices := &plmns[i].SliceSupportList
+		for _, slice := range plmn.SliceSupportList.List {
+			var found bool
+			for _, supported := range slices.List {
+				found = found || reflect.DeepEqual(supported.SNSSAI, slice.SNSSAI)
+			}
+			if !found {
+				slices.List = append(slices.List, slice)
+			}
+		}
+		return plmns
+	}
+	plmn.SliceSupportList.List = append([]ngapType.SliceSupportItem(nil), plmn.SliceSupportList.List...)
+	return append(plmns, plmn)
+}
+
+// isLocalNGSetupRequest handles the NG Setup procedures of a gNB in local NG
+// Setup mode. Returns true if the message was handled by sctplb. Caller must
+// hold the context lock.
+func isLocalNGSetupRequest(ran *context.Ran, ranMsg *ngapType.NGAPPDU) bool {
+	switch {
+	case isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGSetup):
+		ran.Log.Infoln("NG Setup Request handled by sctplb")
+		handleLocalNGSetup(ran)
+		return true
+	case isAMFConfigurationUpdateOutcome(ranMsg):
+		ran.Log.Infof("AMF Configuration Update answered with %v", ranMsg.Present)
+		return true
+	}
+	return false
+}
+
+// handleLocalNGSetup answers the NG Setup Request of a gNB with the merged NG
+// Setup data of the backends, once one of them told its own, and tells every
+// READY backend about the gNB. Caller must hold the context lock.
+func handleLocalNGSetup(ran *context.Ran) {
+	for _, instance := range readyBackends(context.Sctplb_Self().Backends) {
+		notifier, ok := instance.(gnbSetupNotifier)
+		if !ok {
+			continue
+		}
+		if err := notifier.NotifyGnbSetup(ran); err != nil {
+			ran.Log.Warnf("can not notify backend %v of NG Setup: %v", instance.Address(), err)
+		}
+	}
+	delete(ngSetups.answered, ran)
+	ngSetups.pending[ran] = true
+	announceNGSetup()
+}
+
+// ngSetupChanged announces the NG Setup data of the backends once a backend
+// told new NG Setup data
+func ngSetupChanged() {
+	if !localNGSetup {
+		return
+	}
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	defer ctx.Unlock()
+	announceNGSetup()
+}
+
+// announceNGSetup answers the pending NG Setup Requests, and sends an AMF
+// Configuration Update to the gNBs set up earlier if the merged NG Setup data
+// of the backends changed. Caller must hold the context lock.
+func announceNGSetup() {
+	merged := mergeAMFSetups(context.Sctplb_Self().Backends)
+	if merged == nil {
+		if len(ngSetups.pending) > 0 {
+			logger.DispatchLog.Infof("%d gNBs waiting for the NG Setup data of a backend", len(ngSetups.pending))
+		}
+		return
+	}
+	if !reflect.DeepEqual(merged, ngSetups.announced) {
+		for ran := range ngSetups.answered {
+			ran.Log.Infoln("send AMF Configuration Update")
+			writeNGAP(ran, amfConfigurationUpdatePDU(merged))
+		}
+		ngSetups.announced = merged
+	}
+	for ran := range ngSetups.pending {
+		ran.Log.Infoln("send NG Setup Response")
+		writeNGAP(ran, ngSetupResponsePDU(merged))
+		ngSetups.answered[ran] = true
+		delete(ngSetups.pending, ran)
+	}
+}
+
+// forgetNGSetup drops a closed gNB. Caller must hold the context lock.
+func forgetNGSetup(ran *context.Ran) {
+	delete(ngSetups.pending, ran)
+	delete(ngSetups.answered, ran)
+}
+
+func writeNGAP(ran *context.Ran, pdu *ngapType.NGAPPDU) {
+	msg, err := ngap.Encoder(*pdu)
+	if err != nil {
+		ran.Log.Errorf("NGAP encode error: %+v", err)
+		return
+	}
+	if _, err := ran.Conn.Write(msg); err != nil {
+		ran.Log.Infof("err %+v", err)
+	}
+}
+
+func ngSetupResponsePDU(setup *amfSetup) *ngapType.NGAPPDU {
+	response := &ngapType.NGSetupResponse{}
+	ies := &response.ProtocolIEs.List
+	*ies = append(*ies, ngapType.NGSetupResponseIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDAMFName},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+		Value: ngapType.NGSetupResponseIEsValue{
+			Present: ngapType.NGSetupResponseIEsPresentAMFName,
+			AMFName: &ngapType.AMFName{Value: setup.name},
+		},
+	}, ngapType.NGSetupResponseIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDServedGUAMIList},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+		Value: ngapType.NGSetupResponseIEsValue{
+			Present:         ngapType.NGSetupResponseIEsPresentServedGUAMIList,
+			ServedGUAMIList: &ngapType.ServedGUAMIList{List: setup.guamis},
+		},
+	}, ngapType.NGSetupResponseIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDRelativeAMFCapacity},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+		Value: ngapType.NGSetupResponseIEsValue{
+			Present:             ngapType.NGSetupResponseIEsPresentRelativeAMFCapacity,
+			RelativeAMFCapacity: &ngapType.RelativeAMFCapacity{Value: setup.capacity},
+		},
+	}, ngapType.NGSetupResponseIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDPLMNSupportList},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+		Value: ngapType.NGSetupResponseIEsValue{
+			Present:         ngapType.NGSetupResponseIEsPresentPLMNSupportList,
+			PLMNSupportList: &ngapType.PLMNSupportList{List: setup.plmns},
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentSuccessfulOutcome,
+		SuccessfulOutcome: &ngapType.SuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeNGSetup},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+			Value: ngapType.SuccessfulOutcomeValue{
+				Present:         ngapType.SuccessfulOutcomePresentNGSetupResponse,
+				NGSetupResponse: response,
+			},
+		},
+	}
+}
+
+func amfConfigurationUpdatePDU(setup *amfSetup) *ngapType.NGAPPDU {
+	update := &ngapType.AMFConfigurationUpdate{}
+	ies := &update.ProtocolIEs.List
+	*ies = append(*ies, ngapType.AMFConfigurationUpdateIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDAMFName},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+		Value: ngapType.AMFConfigurationUpdateIEsValue{
+			Present: ngapType.AMFConfigurationUpdateIEsPresentAMFName,
+			AMFName: &ngapType.AMFName{Value: setup.name},
+		},
+	}, ngapType.AMFConfigurationUpdateIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDServedGUAMIList},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+		Value: ngapType.AMFConfigurationUpdateIEsValue{
+			Present:         ngapType.AMFConfigurationUpdateIEsPresentServedGUAMIList,
+			ServedGUAMIList: &ngapType.ServedGUAMIList{List: setup.guamis},
+		},
+	}, ngapType.AMFConfigurationUpdateIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDRelativeAMFCapacity},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+		Value: ngapType.AMFConfigurationUpdateIEsValue{
+			Present:             ngapType.AMFConfigurationUpdateIEsPresentRelativeAMFCapacity,
+			RelativeAMFCapacity: &ngapType.RelativeAMFCapacity{Value: setup.capacity},
+		},
+	}, ngapType.AMFConfigurationUpdateIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDPLMNSupportList},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+		Value: ngapType.AMFConfigurationUpdateIEsValue{
+			Present:         ngapType.AMFConfigurationUpdateIEsPresentPLMNSupportList,
+			PLMNSupportList: &ngapType.PLMNSupportList{List: setup.plmns},
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeAMFConfigurationUpdate},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+			Value: ngapType.InitiatingMessageValue{
+				Present:                ngapType.InitiatingMessagePresentAMFConfigurationUpdate,
+				AMFConfigurationUpdate: update,
+			},
+		},
+	}
+}
+
+// amfConfigurationUpdateAcknowledge returns the acknowledge sctplb answers
+// the AMF Configuration Update of a backend with in local NG Setup mode
+func amfConfigurationUpdateAcknowledge() ([]byte, error) {
+	return ngap.Encoder(ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentSuccessfulOutcome,
+		SuccessfulOutcome: &ngapType.SuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeAMFConfigurationUpdate},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+			Value: ngapType.SuccessfulOutcomeValue{
+				Present:                           ngapType.SuccessfulOutcomePresentAMFConfigurationUpdateAcknowledge,
+				AMFConfigurationUpdateAcknowledge: &ngapType.AMFConfigurationUpdateAcknowledge{},
+			},
+		},
+	})
+}
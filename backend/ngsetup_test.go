@@ -0,0 +1,320 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+)
+
+// testAMFSetup returns the NG Setup data of an AMF of region serving the
+// slice of SST sst
+func testAMFSetup(region byte, capacity int64, sst byte) *amfSetup {
+	plmn := ngapType.PLMNIdentity{Value: aper.OctetString{0x02, 0xf8, 0x39}}
+	return &amfSetup{
+		name: "amf",
+		guamis: []ngapType.ServedGUAMIItem{{GUAMI: ngapType.GUAMI{
+			PLMNIdentity: plmn,
+			AMFRegionID:  ngapType.AMFRegionID{Value: aper.BitString{Bytes: []byte{region}, BitLength: 8}},
+			AMFSetID:     testAMFSetID,
+			AMFPointer:   testAMFPointer,
+		}}},
+		plmns: []ngapType.PLMNSupportItem{{
+			PLMNIdentity: plmn,
+			SliceSupportList: ngapType.SliceSupportList{List: []ngapType.SliceSupportItem{{
+				SNSSAI: ngapType.SNSSAI{SST: ngapType.SST{Value: aper.OctetString{sst}}},
+			}}},
+		}},
+		capacity: capacity,
+	}
+}
+
+// otherPLMNSetup moves the GUAMIs and slices of setup to another PLMN
+func otherPLMNSetup(setup *amfSetup) *amfSetup {
+	plmn := ngapType.PLMNIdentity{Value: aper.OctetString{0x13, 0x40, 0x01}}
+	for i := range setup.guamis {
+		setup.guamis[i].GUAMI.PLMNIdentity = plmn
+	}
+	for i := range setup.plmns {
+		setup.plmns[i].PLMNIdentity = plmn
+	}
+	return setup
+}
+
+func setupBackend(state backendState, setup *amfSetup) *GrpcServer {
+	b := newGrpcServer("127.0.0.1", config.Service{})
+	b.state.store(state)
+	if setup != nil {
+		b.setup.Store(setup)
+	}
+	return b
+}
+
+func Test_MergeAMFSetups(t *testing.T) {
+	tests := []struct {
+		name         string
+		backends     []context.NF
+		wantNil      bool
+		wantGUAMIs   int
+		wantSlices   int
+		wantCapacity int64
+	}{
+		{
+			name:     "No NG Setup data learned",
+			backends: []context.NF{setupBackend(stateReady, nil)},
+			wantNil:  true,
+		},
+		{
+			name: "GUAMIs and slices merged, capacities summed",
+			backends: []context.NF{
+				setupBackend(stateReady, testAMFSetup(1, 100, 1)),
+				setupBackend(stateReady, testAMFSetup(2, 50, 2)),
+				setupBackend(stateReady, nil),
+			},
+			wantGUAMIs:   2,
+			wantSlices:   2,
+			wantCapacity: 150,
+		},
+		{
+			name: "Duplicates merged once, capacity capped",
+			backends: []context.NF{
+				setupBackend(stateReady, testAMFSetup(1, 200, 1)),
+				setupBackend(stateReady, testAMFSetup(1, 200, 1)),
+			},
+			wantGUAMIs:   1,
+			wantSlices:   1,
+			wantCapacity: maxRelativeAMFCapacity,
+		},
+		{
+			name: "Draining and connecting backends skipped",
+			backends: []context.NF{
+				setupBackend(stateReady, testAMFSetup(1, 100, 1)),
+				setupBackend(stateDraining, otherPLMNSetup(testAMFSetup(2, 100, 2))),
+				setupBackend(stateConnecting, otherPLMNSetup(testAMFSetup(3, 100, 3))),
+			},
+			wantGUAMIs:   1,
+			wantSlices:   1,
+			wantCapacity: 100,
+		},
+		{
+			name:     "Only draining backends",
+			backends: []context.NF{setupBackend(stateDraining, testAMFSetup(1, 100, 1))},
+			wantNil:  true,
+		},
+		{
+			name: "Failed backends skipped",
+			backends: []context.NF{
+				setupBackend(stateReady, testAMFSetup(1, 100, 1)),
+				setupBackend(stateFailed, testAMFSetup(2, 100, 2)),
+			},
+			wantGUAMIs:   1,
+			wantSlices:   1,
+			wantCapacity: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				merged := mergeAMFSetups(tt.backends)
+				if tt.wantNil {
+					if merged != nil {
+						t.Errorf("mergeAMFSetups() = %+v, want nil", merged)
+					}
+					return
+				}
+				if merged == nil {
+					t.Fatalf("mergeAMFSetups() = nil")
+				}
+				if merged.name != localAMFName {
+					t.Errorf("merged name mismatch. got = %v, want = %v", merged.name, localAMFName)
+				}
+				if got := len(merged.guamis); got != tt.wantGUAMIs {
+					t.Errorf("merged GUAMIs mismatch. got = %v, want = %v", got, tt.wantGUAMIs)
+				}
+				if len(merged.plmns) != 1 {
+					t.Fatalf("merged PLMNs mismatch. got = %v, want = 1", len(merged.plmns))
+				}
+				if got := len(merged.plmns[0].SliceSupportList.List); got != tt.wantSlices {
+					t.Errorf("merged slices mismatch. got = %v, want = %v", got, tt.wantSlices)
+				}
+				if merged.capacity != tt.wantCapacity {
+					t.Errorf("merged capacity mismatch. got = %v, want = %v", merged.capacity, tt.wantCapacity)
+				}
+			},
+		)
+	}
+}
+
+func Test_UpdateAMFSetup(t *testing.T) {
+	previous := testAMFSetup(1, 100, 1)
+	capacityUpdate := amfConfigurationUpdatePDU(testAMFSetup(2, 10, 2))
+	update := capacityUpdate.InitiatingMessage.Value.AMFConfigurationUpdate
+	update.ProtocolIEs.List = update.ProtocolIEs.List[2:3]
+	wantUpdated := testAMFSetup(1, 10, 1)
+
+	tests := []struct {
+		name     string
+		previous *amfSetup
+		amfMsg   *ngapType.NGAPPDU
+		want     *amfSetup
+	}{
+		{
+			name:   "NG Setup Response",
+			amfMsg: ngSetupResponsePDU(previous),
+			want:   previous,
+		},
+		{
+			name:     "AMF Configuration Update overlays the previous data",
+			previous: previous,
+			amfMsg:   capacityUpdate,
+			want:     wantUpdated,
+		},
+		{
+			name:     "Other procedures carry no NG Setup data",
+			previous: previous,
+			amfMsg:   initialUEMessage(nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if got := updateAMFSetup(tt.previous, tt.amfMsg); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("updateAMFSetup() = %+v, want %+v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+// recordingConn records the messages sctplb writes to a gNB
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *recordingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 38412}
+}
+
+// messages returns the procedures written to the gNB since the last call
+func (c *recordingConn) messages(t *testing.T) []*ngapType.NGAPPDU {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pdus []*ngapType.NGAPPDU
+	for _, msg := range c.written {
+		pdu, err := ngap.Decoder(msg)
+		if err != nil {
+			t.Fatalf("NGAP decode error: %v", err)
+		}
+		pdus = append(pdus, pdu)
+	}
+	c.written = nil
+	return pdus
+}
+
+func Test_LocalNGSetup(t *testing.T) {
+	savedLocal := localNGSetup
+	defer func() { localNGSetup = savedLocal }()
+	SetNGSetup(&config.NgSetup{Local: true})
+
+	ctx := context.Sctplb_Self()
+	first := setupBackend(stateReady, nil)
+	second := setupBackend(stateReady, nil)
+	ctx.Lock()
+	ctx.AddNF(first)
+	ctx.AddNF(second)
+	ctx.Unlock()
+	defer deleteBackendNF(first)
+
+	conn := &recordingConn{}
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+	ran.SetupRequest = []byte("NG Setup Request")
+	ctx.Lock()
+	handled := isLocalNGSetupRequest(ran, ngSetupRequest([]byte{0x02, 0xf8, 0x39}))
+	ctx.Unlock()
+	defer func() {
+		ctx.Lock()
+		forgetNGSetup(ran)
+		ngSetups.announced = nil
+		ctx.Unlock()
+	}()
+	if !handled {
+		t.Fatalf("NG Setup Request not handled by sctplb")
+	}
+
+	// the backends are told about the gNB, which waits for their NG Setup data
+	for _, b := range []*GrpcServer{first, second} {
+		message := <-b.queue.messages
+		if message.Msgtype != gClient.MsgType_GNB_CONN || string(message.Msg) != string(ran.SetupRequest) ||
+			message.GnbIpAddr != ran.GnbIp {
+			t.Errorf("backend %v notification mismatch. got = %v", b.address, message)
+		}
+	}
+	if got := conn.messages(t); len(got) != 0 {
+		t.Fatalf("gNB answered before NG Setup data was learned: %v", got)
+	}
+
+	expect := func(procedureCode int64, present int, capacity int64) {
+		t.Helper()
+		pdus := conn.messages(t)
+		if len(pdus) != 1 || !isProcedure(pdus[0], present, procedureCode) {
+			t.Fatalf("gNB messages mismatch. got = %+v, want procedure %v", pdus, procedureCode)
+		}
+		if setup := updateAMFSetup(nil, pdus[0]); setup.capacity != capacity {
+			t.Errorf("announced capacity mismatch. got = %v, want = %v", setup.capacity, capacity)
+		}
+	}
+
+	if learnAMFSetup(&first.setup, ngSetupResponsePDU(testAMFSetup(1, 100, 1))) {
+		ngSetupChanged()
+	}
+	expect(ngapType.ProcedureCodeNGSetup, ngapType.NGAPPDUPresentSuccessfulOutcome, 100)
+
+	if learnAMFSetup(&second.setup, ngSetupResponsePDU(testAMFSetup(2, 50, 2))) {
+		ngSetupChanged()
+	}
+	expect(ngapType.ProcedureCodeAMFConfigurationUpdate, ngapType.NGAPPDUPresentInitiatingMessage, 150)
+
+	// the same NG Setup data again is not announced
+	if learnAMFSetup(&second.setup, ngSetupResponsePDU(testAMFSetup(2, 50, 2))) {
+		t.Errorf("unchanged NG Setup data learned as changed")
+	}
+
+	deleteBackendNF(second)
+	expect(ngapType.ProcedureCodeAMFConfigurationUpdate, ngapType.NGAPPDUPresentInitiatingMessage, 100)
+
+	ctx.Lock()
+	handled = isLocalNGSetupRequest(ran, &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentSuccessfulOutcome,
+		SuccessfulOutcome: &ngapType.SuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeAMFConfigurationUpdate},
+		},
+	})
+	ctx.Unlock()
+	if !handled {
+		t.Errorf("AMF Configuration Update Acknowledge passed on to the backends")
+	}
+}
@@ -0,0 +1,279 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"math/rand/v2"
+
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// amfOverload is the overload a backend reported with Overload Start
+type amfOverload struct {
+	// overload action, nil if the backend gave none
+	action *aper.Enumerated
+	// percentage of the new UEs to steer away from the backend, 100 if the
+	// backend gave none
+	reduction int
+}
+
+// overloaded backends, guarded by the context lock
+var overloads = make(map[Backend]*amfOverload)
+
+// gNBs told Overload Start by sctplb because every backend of their pool is
+// overloaded, guarded by the context lock
+var overloadedRans = make(map[*context.Ran]bool)
+
+// overloadIntN draws the new UEs steered away from an overloaded backend
+var overloadIntN = rand.IntN
+
+// extractOverload returns the overload an Overload Start of a backend
+// reports, nil for any other PDU or an Overload Start of some slices only
+func extractOverload(amfMsg *ngapType.NGAPPDU) *amfOverload {
+	if !isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeOverloadStart) {
+		return nil
+	}
+	ngapMsg := amfMsg.InitiatingMessage.Value.OverloadStart
+	if ngapMsg == nil {
+		return nil
+	}
+	overload := &amfOverload{reduction: 100}
+	var slices bool
+	for _, ie := range ngapMsg.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFOverloadResponse:
+			if response := ie.Value.AMFOverloadResponse; response != nil && response.OverloadAction != nil {
+				overload.action = &response.OverloadAction.Value
+			}
+		case ngapType.ProtocolIEIDAMFTrafficLoadReductionIndication:
+			if indication := ie.Value.AMFTrafficLoadReductionIndication; indication != nil {
+				overload.reduction = int(indication.Value)
+			}
+		case ngapType.ProtocolIEIDOverloadStartNSSAIList:
+			slices = true
+		}
+	}
+	if slices && overload.action == nil && overload.reduction == 100 {
+		return nil
+	}
+	return overload
+}
+
+// learnOverload records the overload state of a backend from its Overload
+// Start and Overload Stop. Returns true if the message started or stopped an
+// overload of the backend.
+func learnOverload(backend Backend, amfMsg *ngapType.NGAPPDU) bool {
+	overload := extractOverload(amfMsg)
+	stop := isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeOverloadStop)
+	if overload == nil && !stop {
+		return false
+	}
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	defer ctx.Unlock()
+	if overload != nil {
+		if _, ok := overloads[backend]; !ok {
+			logger.DispatchLog.Infof("backend %v overloaded, traffic load reduction %d%%", backend.Address(),
+				overload.reduction)
+		}
+		overloads[backend] = overload
+		return true
+	}
+	if _, ok := overloads[backend]; !ok {
+		return false
+	}
+	logger.DispatchLog.Infof("backend %v no longer overloaded", backend.Address())
+	delete(overloads, backend)
+	stopRanOverloads()
+	return true
+}
+
+// handleOverload decides whether an Overload Start or Overload Stop of a
+// backend is passed on to a gNB: Overload Start is only once every READY
+// backend of the pool of the gNB is overloaded, Overload Stop is sent by
+// sctplb once it is no longer the case. Returns true if the message was
+// consumed by sctplb.
+func handleOverload(ran *context.Ran, amfMsg *ngapType.NGAPPDU, learned bool) bool {
+	start := isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeOverloadStart)
+	stop := isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeOverloadStop)
+	if !start && !stop {
+		return false
+	}
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	defer ctx.Unlock()
+	switch {
+	case stop:
+		return learned || overloadedRans[ran]
+	case !learned:
+		// overload of some slices only
+		return false
+	case poolOverloaded(ran):
+		if !overloadedRans[ran] {
+			ran.Log.Infoln("every backend overloaded, send Overload Start")
+		}
+		overloadedRans[ran] = true
+		return false
+	default:
+		return true
+	}
+}
+
+// poolOverloaded returns true if every READY backend of the pool of a gNB is
+// overloaded. Caller must hold the context lock.
+func poolOverloaded(ran *context.Ran) bool {
+	return allOverloaded(plmnPool(ran, context.Sctplb_Self().Backends))
+}
+
+// stopRanOverloads sends Overload Stop to the gNBs told Overload Start whose
+// pool is no longer overloaded. Caller must hold the context lock.
+func stopRanOverloads() {
+	for ran := range overloadedRans {
+		if poolOverloaded(ran) {
+			continue
+		}
+		ran.Log.Infoln("backend no longer overloaded, send Overload Stop")
+		writeNGAP(ran, overloadStopPDU())
+		delete(overloadedRans, ran)
+	}
+}
+
+// resetOverload drops the overload state of a reconnected backend, its AMF
+// starts over
+func resetOverload(backend Backend) {
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	defer ctx.Unlock()
+	forgetOverload(backend)
+}
+
+// forgetOverload drops the overload state of a backend which is deleted or
+// reconnected. Caller must hold the context lock.
+func forgetOverload(backend Backend) {
+	delete(overloads, backend)
+	stopRanOverloads()
+}
+
+// overloadReduction returns the traffic load reduction percentage of an
+// overloaded backend, 0 if it is not overloaded. Caller must hold the
+// context lock.
+func overloadReduction(backend Backend) int {
+	if overload, ok := overloads[backend]; ok {
+		return overload.reduction
+	}
+	return 0
+}
+
+// forgetRanOverload drops the overload state of a closed gNB. Caller must
+// hold the context lock.
+func forgetRanOverload(ran *context.Ran) {
+	delete(overloadedRans, ran)
+}
+
+// extractRRCEstablishmentCause returns the RRC Establishment Cause an
+// InitialUEMessage carries, nil for any other PDU
+func extractRRCEstablishmentCause(ranMsg *ngapType.NGAPPDU) *ngapType.RRCEstablishmentCause {
+	if !isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeInitialUEMessage) {
+		return nil
+	}
+	ngapMsg := ranMsg.InitiatingMessage.Value.InitialUEMessage
+	if ngapMsg == nil {
+		return nil
+	}
+	for _, ie := range ngapMsg.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDRRCEstablishmentCause {
+			return ie.Value.RRCEstablishmentCause
+		}
+	}
+	return nil
+}
+
+// overloadPermits returns true if an overload action lets an overloaded AMF
+// take a UE establishing its RRC connection for cause, as NG-RAN would
+func overloadPermits(action *aper.Enumerated, cause *ngapType.RRCEstablishmentCause) bool {
+	if action == nil || cause == nil {
+		return false
+	}
+	switch *action {
+	case ngapType.OverloadActionPresentRejectNonEmergencyMoDt:
+		return cause.Value != ngapType.RRCEstablishmentCausePresentMoData
+	case ngapType.OverloadActionPresentRejectRrcCrSignalling:
+		return cause.Value != ngapType.RRCEstablishmentCausePresentMoData &&
+			cause.Value != ngapType.RRCEstablishmentCausePresentMoSignalling
+	case ngapType.OverloadActionPresentPermitEmergencySessionsAndMobileTerminatedServicesOnly:
+		return cause.Value == ngapType.RRCEstablishmentCausePresentEmergency ||
+			cause.Value == ngapType.RRCEstablishmentCausePresentMtAccess
+	case ngapType.OverloadActionPresentPermitHighPrioritySessionsAndMobileTerminatedServicesOnly:
+		switch cause.Value {
+		case ngapType.RRCEstablishmentCausePresentEmergency, ngapType.RRCEstablishmentCausePresentMtAccess,
+			ngapType.RRCEstablishmentCausePresentHighPriorityAccess, ngapType.RRCEstablishmentCausePresentMpsPriorityAccess,
+			ngapType.RRCEstablishmentCausePresentMcsPriorityAccess:
+			return true
+		}
+	}
+	return false
+}
+
+// overloadPool returns the backends a new UE may be scheduled on: the
+// overloaded backends are left out for their traffic load reduction share of
+// the UEs their overload action does not permit. The share is drawn from the
+// sticky key ue of the UE when known, so that every message of a UE without
+// sticky session sees the same backends. When every READY backend is
+// overloaded, the gNBs reduce the load themselves and every backend is a
+// candidate. Caller must hold the context lock.
+func overloadPool(ranMsg *ngapType.NGAPPDU, backends []context.NF, ue string) []context.NF {
+	if len(overloads) == 0 || allOverloaded(backends) {
+		return backends
+	}
+	var cause *ngapType.RRCEstablishmentCause
+	if ranMsg != nil {
+		cause = extractRRCEstablishmentCause(ranMsg)
+	}
+	draw := func() int {
+		if ue != "" {
+			return int(hashKey(ue) % 100)
+		}
+		return overloadIntN(100)
+	}
+	pool := make([]context.NF, 0, len(backends))
+	for _, instance := range backends {
+		if overload, ok := overloads[instance]; ok && !overloadPermits(overload.action, cause) {
+			if draw() < overload.reduction {
+				continue
+			}
+		}
+		pool = append(pool, instance)
+	}
+	return pool
+}
+
+// allOverloaded returns true if there are READY backends and all of them are
+// overloaded. Caller must hold the context lock.
+func allOverloaded(backends []context.NF) bool {
+	ready := readyBackends(backends)
+	for _, instance := range ready {
+		if _, ok := overloads[instance]; !ok {
+			return false
+		}
+	}
+	return len(ready) > 0
+}
+
+func overloadStopPDU() *ngapType.NGAPPDU {
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeOverloadStop},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+			Value: ngapType.InitiatingMessageValue{
+				Present:      ngapType.InitiatingMessagePresentOverloadStop,
+				OverloadStop: &ngapType.OverloadStop{},
+			},
+		},
+	}
+}
@@ -0,0 +1,203 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// overloadStart returns an Overload Start with an overload action, when not
+// nil, and a traffic load reduction, when not 0
+func overloadStart(action *aper.Enumerated, reduction int64) *ngapType.NGAPPDU {
+	start := &ngapType.OverloadStart{}
+	if action != nil {
+		start.ProtocolIEs.List = append(start.ProtocolIEs.List, ngapType.OverloadStartIEs{
+			Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDAMFOverloadResponse},
+			Value: ngapType.OverloadStartIEsValue{
+				Present: ngapType.OverloadStartIEsPresentAMFOverloadResponse,
+				AMFOverloadResponse: &ngapType.OverloadResponse{
+					Present:        ngapType.OverloadResponsePresentOverloadAction,
+					OverloadAction: &ngapType.OverloadAction{Value: *action},
+				},
+			},
+		})
+	}
+	if reduction != 0 {
+		start.ProtocolIEs.List = append(start.ProtocolIEs.List, ngapType.OverloadStartIEs{
+			Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDAMFTrafficLoadReductionIndication},
+			Value: ngapType.OverloadStartIEsValue{
+				Present:                           ngapType.OverloadStartIEsPresentAMFTrafficLoadReductionIndication,
+				AMFTrafficLoadReductionIndication: &ngapType.TrafficLoadReductionIndication{Value: reduction},
+			},
+		})
+	}
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeOverloadStart},
+			Value: ngapType.InitiatingMessageValue{
+				Present:       ngapType.InitiatingMessagePresentOverloadStart,
+				OverloadStart: start,
+			},
+		},
+	}
+}
+
+// initialUEMessageFor returns an InitialUEMessage of a UE establishing its
+// RRC connection for cause
+func initialUEMessageFor(cause aper.Enumerated) *ngapType.NGAPPDU {
+	pdu := initialUEMessage(nil)
+	ngapMsg := pdu.InitiatingMessage.Value.InitialUEMessage
+	ngapMsg.ProtocolIEs.List = append(ngapMsg.ProtocolIEs.List, ngapType.InitialUEMessageIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDRRCEstablishmentCause},
+		Value: ngapType.InitialUEMessageIEsValue{
+			Present:               ngapType.InitialUEMessageIEsPresentRRCEstablishmentCause,
+			RRCEstablishmentCause: &ngapType.RRCEstablishmentCause{Value: cause},
+		},
+	})
+	return pdu
+}
+
+func Test_OverloadPool(t *testing.T) {
+	savedIntN := overloadIntN
+	defer func() {
+		overloadIntN = savedIntN
+		overloads = make(map[Backend]*amfOverload)
+	}()
+
+	first := setupBackend(stateReady, nil)
+	second := setupBackend(stateReady, nil)
+	second.address = "127.0.0.2"
+	backends := []context.NF{first, second}
+	permitEmergency := ngapType.OverloadActionPresentPermitEmergencySessionsAndMobileTerminatedServicesOnly
+
+	tests := []struct {
+		name      string
+		overloads map[Backend]*amfOverload
+		ranMsg    *ngapType.NGAPPDU
+		draw      int
+		want      []context.NF
+	}{
+		{
+			name: "No overloaded backend",
+			want: backends,
+		},
+		{
+			name:      "Overloaded backend left out",
+			overloads: map[Backend]*amfOverload{first: {reduction: 100}},
+			want:      []context.NF{second},
+		},
+		{
+			name:      "Overloaded backend within its share",
+			overloads: map[Backend]*amfOverload{first: {reduction: 30}},
+			draw:      70,
+			want:      backends,
+		},
+		{
+			name:      "Overloaded backend beyond its share",
+			overloads: map[Backend]*amfOverload{first: {reduction: 30}},
+			draw:      20,
+			want:      []context.NF{second},
+		},
+		{
+			name:      "UE permitted by the overload action",
+			overloads: map[Backend]*amfOverload{first: {action: &permitEmergency, reduction: 100}},
+			ranMsg:    initialUEMessageFor(ngapType.RRCEstablishmentCausePresentEmergency),
+			want:      backends,
+		},
+		{
+			name:      "UE not permitted by the overload action",
+			overloads: map[Backend]*amfOverload{first: {action: &permitEmergency, reduction: 100}},
+			ranMsg:    initialUEMessageFor(ngapType.RRCEstablishmentCausePresentMoData),
+			want:      []context.NF{second},
+		},
+		{
+			name: "Every backend overloaded",
+			overloads: map[Backend]*amfOverload{
+				first:  {reduction: 100},
+				second: {reduction: 100},
+			},
+			want: backends,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				overloads = tt.overloads
+				if overloads == nil {
+					overloads = make(map[Backend]*amfOverload)
+				}
+				overloadIntN = func(int) int { return tt.draw }
+				if got := overloadPool(tt.ranMsg, backends, ""); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("overloadPool() = %v, want %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_OverloadPropagation(t *testing.T) {
+	ctx := context.Sctplb_Self()
+	first := setupBackend(stateReady, nil)
+	second := setupBackend(stateReady, nil)
+	second.address = "127.0.0.2"
+	ctx.Lock()
+	ctx.AddNF(first)
+	ctx.AddNF(second)
+	ctx.Unlock()
+	defer deleteBackendNF(first)
+	defer deleteBackendNF(second)
+
+	conn := &recordingConn{}
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+	defer func() {
+		ctx.Lock()
+		forgetRanOverload(ran)
+		ctx.Unlock()
+	}()
+	start := overloadStart(nil, 40)
+	stop := procedureMessage(ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeOverloadStop)
+
+	// one overloaded backend is kept from the gNB
+	if !handleOverload(ran, start, learnOverload(first, start)) {
+		t.Errorf("Overload Start of a single backend passed on to the gNB")
+	}
+	ctx.Lock()
+	reduction := overloadReduction(first)
+	ctx.Unlock()
+	if reduction != 40 {
+		t.Errorf("traffic load reduction mismatch. got = %d, want = 40", reduction)
+	}
+
+	// the gNB is told once every backend is overloaded
+	if handleOverload(ran, start, learnOverload(second, start)) {
+		t.Errorf("Overload Start of the last backend not passed on to the gNB")
+	}
+
+	// and told the overload is over once one backend is no longer overloaded
+	if !handleOverload(ran, stop, learnOverload(first, stop)) {
+		t.Errorf("Overload Stop of a backend passed on to the gNB")
+	}
+	pdus := conn.messages(t)
+	if len(pdus) != 1 || !isProcedure(pdus[0], ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeOverloadStop) {
+		t.Fatalf("gNB not sent Overload Stop: %+v", pdus)
+	}
+	if !handleOverload(ran, stop, learnOverload(second, stop)) {
+		t.Errorf("Overload Stop of the last backend passed on to the gNB")
+	}
+	if len(conn.messages(t)) != 0 {
+		t.Errorf("gNB sent Overload Stop twice")
+	}
+	if len(overloads) != 0 {
+		t.Errorf("overloads length mismatch. got = %d, want = 0", len(overloads))
+	}
+}
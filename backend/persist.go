@@ -0,0 +1,331 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "sessions.wal"
+
+	defaultCompactThreshold = 10000
+)
+
+// write-ahead log record operations
+const (
+	walPut          = "put"
+	walDelete       = "delete"
+	walDeletePrefix = "deletePrefix"
+	walReassign     = "reassign"
+	walRanId        = "ranId"
+)
+
+var _ SessionStore = &persistentStore{}
+
+// persistence is nil unless sticky sessions are persisted
+var persistence *persistentStore
+
+type walRecord struct {
+	Op      string `json:"op"`
+	Key     string `json:"key,omitempty"`
+	Backend string `json:"backend,omitempty"`
+	From    string `json:"from,omitempty"`
+	GnbIp   string `json:"gnbIp,omitempty"`
+	RanId   string `json:"ranId,omitempty"`
+}
+
+type persistedState struct {
+	Sessions map[string]string `json:"sessions"`
+	RanIds   map[string]string `json:"ranIds"`
+}
+
+// persistentStore wraps a SessionStore and keeps its sessions, together with
+// the gNB IDs learned per gNB address, on disk as a snapshot plus a
+// write-ahead log of the changes made since. The log is compacted into a new
+// snapshot once it holds compactThreshold records, and whenever idle sessions
+// are swept. Records are written without fsync, so they survive a restart of
+// sctplb but not necessarily a crash of the host.
+type persistentStore struct {
+	SessionStore
+	mu               sync.Mutex
+	dir              string
+	wal              *os.File
+	walRecords       int
+	compactThreshold int
+	ranIds           map[string]string
+}
+
+// openPersistentStore loads the snapshot and write-ahead log found in dir into
+// inner, then compacts them into a fresh snapshot
+func openPersistentStore(dir string, compactThreshold int, inner SessionStore) (*persistentStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	if compactThreshold <= 0 {
+		compactThreshold = defaultCompactThreshold
+	}
+	p := &persistentStore{
+		SessionStore:     inner,
+		dir:              dir,
+		compactThreshold: compactThreshold,
+		ranIds:           make(map[string]string),
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.compact(); err != nil {
+		return nil, err
+	}
+	logger.AppLog.Infof("restored %d sticky sessions and %d gNB IDs from %v", inner.Len(), len(p.ranIds), dir)
+	return p, nil
+}
+
+func (p *persistentStore) load() error {
+	content, err := os.ReadFile(filepath.Join(p.dir, snapshotFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		state := persistedState{}
+		if err := json.Unmarshal(content, &state); err != nil {
+			return fmt.Errorf("snapshot parsing failed: %w", err)
+		}
+		for key, backend := range state.Sessions {
+			p.SessionStore.Put(key, backend)
+		}
+		for gnbIp, ranId := range state.RanIds {
+			p.ranIds[gnbIp] = ranId
+		}
+	}
+
+	wal, err := os.Open(filepath.Join(p.dir, walFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer wal.Close()
+	scanner := bufio.NewScanner(wal)
+	for scanner.Scan() {
+		record := walRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// a record torn by a restart in the middle of a write ends the log
+			logger.AppLog.Warnf("stopping write-ahead log replay at invalid record: %v", err)
+			break
+		}
+		p.replay(&record)
+	}
+	return scanner.Err()
+}
+
+func (p *persistentStore) replay(record *walRecord) {
+	switch record.Op {
+	case walPut:
+		p.SessionStore.Put(record.Key, record.Backend)
+	case walDelete:
+		p.SessionStore.Delete(record.Key)
+	case walDeletePrefix:
+		p.SessionStore.DeletePrefix(record.Key)
+	case walReassign:
+		p.SessionStore.Reassign(record.From, record.Backend)
+	case walRanId:
+		p.setRanId(record.GnbIp, record.RanId)
+	default:
+		logger.AppLog.Warnf("unknown write-ahead log record %v", record.Op)
+	}
+}
+
+// compact writes the current state into a new snapshot and starts an empty
+// write-ahead log. Caller must hold p.mu.
+func (p *persistentStore) compact() error {
+	content, err := json.Marshal(persistedState{
+		Sessions: p.SessionStore.Snapshot(),
+		RanIds:   p.ranIds,
+	})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(p.dir, snapshotFile+".tmp")
+	if err := os.WriteFile(tmp, content, 0o640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(p.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if p.wal != nil {
+		if err := p.wal.Close(); err != nil {
+			logger.AppLog.Warnf("close write-ahead log error: %v", err)
+		}
+	}
+	p.wal, err = os.OpenFile(filepath.Join(p.dir, walFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	p.walRecords = 0
+	return nil
+}
+
+// append writes a record to the write-ahead log. Caller must hold p.mu.
+func (p *persistentStore) append(record *walRecord) {
+	content, err := json.Marshal(record)
+	if err != nil {
+		logger.AppLog.Errorf("write-ahead log record encoding error: %v", err)
+		return
+	}
+	if _, err := p.wal.Write(append(content, '\n')); err != nil {
+		logger.AppLog.Errorf("write-ahead log write error: %v", err)
+		return
+	}
+	p.walRecords++
+	if p.walRecords >= p.compactThreshold {
+		if err := p.compact(); err != nil {
+			logger.AppLog.Errorf("sticky session snapshot error: %v", err)
+		}
+	}
+}
+
+func (p *persistentStore) Put(key, backend string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if current, found := p.SessionStore.Get(key); found && current == backend {
+		// only marked as used, nothing to log
+		return
+	}
+	p.SessionStore.Put(key, backend)
+	p.append(&walRecord{Op: walPut, Key: key, Backend: backend})
+}
+
+func (p *persistentStore) Delete(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deleted := p.SessionStore.Delete(key)
+	if deleted {
+		p.append(&walRecord{Op: walDelete, Key: key})
+	}
+	return deleted
+}
+
+func (p *persistentStore) DeletePrefix(prefix string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := p.SessionStore.DeletePrefix(prefix)
+	if count > 0 {
+		p.append(&walRecord{Op: walDeletePrefix, Key: prefix})
+	}
+	return count
+}
+
+func (p *persistentStore) Reassign(from, to string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := p.SessionStore.Reassign(from, to)
+	if len(keys) > 0 {
+		p.append(&walRecord{Op: walReassign, From: from, Backend: to})
+	}
+	return keys
+}
+
+func (p *persistentStore) Sweep() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := p.SessionStore.Sweep()
+	if count > 0 {
+		if err := p.compact(); err != nil {
+			logger.AppLog.Errorf("sticky session snapshot error: %v", err)
+		}
+	}
+	return count
+}
+
+// SetRanId remembers the gNB ID learned for a gNB address
+func (p *persistentStore) SetRanId(gnbIp, ranId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ranIds[gnbIp] == ranId {
+		return
+	}
+	p.setRanId(gnbIp, ranId)
+	p.append(&walRecord{Op: walRanId, GnbIp: gnbIp, RanId: ranId})
+}
+
+// setRanId remembers the gNB ID of a gNB address, forgetting the address the
+// gNB had before. Caller must hold p.mu.
+func (p *persistentStore) setRanId(gnbIp, ranId string) {
+	for address, id := range p.ranIds {
+		if id == ranId && address != gnbIp {
+			delete(p.ranIds, address)
+		}
+	}
+	p.ranIds[gnbIp] = ranId
+}
+
+// RanId returns the gNB ID learned for a gNB address before the restart. A
+// gNB reconnecting from another port gets the gNB ID of its host, unless
+// several gNBs, behind a NAT or DUs of one CU, share the host.
+func (p *persistentStore) RanId(gnbIp string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ranId, found := p.ranIds[gnbIp]; found {
+		return ranId, true
+	}
+	host := addressHost(gnbIp)
+	var ranId string
+	for address, id := range p.ranIds {
+		if addressHost(address) != host {
+			continue
+		}
+		if ranId != "" {
+			// which of the gNBs of the host this one is is unknown
+			return "", false
+		}
+		ranId = id
+	}
+	return ranId, ranId != ""
+}
+
+// addressHost returns a gNB address without its port, which changes when the
+// gNB reconnects
+func addressHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// persistRanId records the gNB ID of a RAN, if persistence is enabled
+func persistRanId(ran *context.Ran) {
+	if persistence != nil && ran.RanId != nil {
+		persistence.SetRanId(ran.GnbIp, *ran.RanId)
+	}
+}
+
+// restoreRanId gives a new RAN the gNB ID it had before the restart, so that
+// its UEs find their sticky sessions again
+func restoreRanId(ran *context.Ran) {
+	if persistence == nil {
+		return
+	}
+	if ranId, found := persistence.RanId(ran.GnbIp); found {
+		ran.Log.Infof("restored GnbId: %v", ranId)
+		ran.SetRanId(ranId)
+	}
+}
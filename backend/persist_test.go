@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+func Test_PersistentStoreRestore(t *testing.T) {
+	tests := []struct {
+		name             string
+		compactThreshold int
+	}{
+		{
+			name:             "Restore from write-ahead log",
+			compactThreshold: 100,
+		},
+		{
+			name:             "Restore from snapshot",
+			compactThreshold: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				dir := t.TempDir()
+				store, err := openPersistentStore(dir, tt.compactThreshold, newMemoryStore(time.Minute, 0))
+				if err != nil {
+					t.Fatalf("openPersistentStore() error: %v", err)
+				}
+				store.Put("gnb1_1", "127.0.0.1")
+				store.Put("gnb1_2", "127.0.0.1")
+				store.Put("gnb1_amf_7", "127.0.0.2")
+				store.Put("gnb2_1", "127.0.0.2")
+				store.Delete("gnb1_2")
+				store.DeletePrefix("gnb2_")
+				store.Reassign("127.0.0.2", "127.0.0.3")
+				store.SetRanId("10.0.0.1:38412", "208:93:000102")
+
+				restarted, err := openPersistentStore(dir, tt.compactThreshold, newMemoryStore(time.Minute, 0))
+				if err != nil {
+					t.Fatalf("openPersistentStore() error on restart: %v", err)
+				}
+				want := map[string]string{
+					"gnb1_1":     "127.0.0.1",
+					"gnb1_amf_7": "127.0.0.3",
+				}
+				if got := restarted.Snapshot(); !reflect.DeepEqual(got, want) {
+					t.Errorf("restored sessions mismatch. got = %v, want = %v", got, want)
+				}
+				if ranId, found := restarted.RanId("10.0.0.1:38412"); !found || ranId != "208:93:000102" {
+					t.Errorf("restored RanId mismatch. got = %q (found = %v)", ranId, found)
+				}
+			},
+		)
+	}
+}
+
+func Test_PersistentStoreTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openPersistentStore(dir, 100, newMemoryStore(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("openPersistentStore() error: %v", err)
+	}
+	store.Put("gnb1_1", "127.0.0.1")
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		t.Fatalf("open write-ahead log error: %v", err)
+	}
+	if _, err := wal.WriteString(`{"op":"put","key":"gnb1_`); err != nil {
+		t.Fatalf("write-ahead log write error: %v", err)
+	}
+	wal.Close()
+
+	restarted, err := openPersistentStore(dir, 100, newMemoryStore(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("openPersistentStore() error on restart: %v", err)
+	}
+	if restarted.Len() != 1 {
+		t.Errorf("restored sessions mismatch. got = %v", restarted.Snapshot())
+	}
+}
+
+func Test_RestoreRanIdReconnect(t *testing.T) {
+	saved := persistence
+	defer func() { persistence = saved }()
+	store, err := openPersistentStore(t.TempDir(), 100, newMemoryStore(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("openPersistentStore() error: %v", err)
+	}
+	persistence = store
+
+	for address, ranId := range map[string]string{
+		"10.0.0.1:38412": "208:93:000102",
+		// two gNBs behind a NAT
+		"10.0.0.3:40001": "208:93:000301",
+		"10.0.0.3:40002": "208:93:000302",
+	} {
+		ran := &context.Ran{GnbIp: address, Log: logger.RanLog}
+		ran.SetRanId(ranId)
+		persistRanId(ran)
+	}
+	// the first gNB of the NAT reconnected from another port
+	moved := &context.Ran{GnbIp: "10.0.0.3:40003", Log: logger.RanLog}
+	moved.SetRanId("208:93:000301")
+	persistRanId(moved)
+
+	tests := []struct {
+		name  string
+		gnbIp string
+		want  string
+	}{
+		{
+			name:  "Reconnect from another port",
+			gnbIp: "10.0.0.1:40123",
+			want:  "208:93:000102",
+		},
+		{
+			name:  "Other gNB",
+			gnbIp: "10.0.0.2:38412",
+		},
+		{
+			name:  "Reconnect behind a NAT from the same port",
+			gnbIp: "10.0.0.3:40002",
+			want:  "208:93:000302",
+		},
+		{
+			name:  "Reconnect behind a NAT from the new port",
+			gnbIp: "10.0.0.3:40003",
+			want:  "208:93:000301",
+		},
+		{
+			name:  "Reconnect behind a NAT from another port",
+			gnbIp: "10.0.0.3:40004",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				reconnected := &context.Ran{GnbIp: tt.gnbIp, Log: logger.RanLog}
+				restoreRanId(reconnected)
+				var got string
+				if reconnected.RanId != nil {
+					got = *reconnected.RanId
+				}
+				if got != tt.want {
+					t.Errorf("restored RanId mismatch. got = %q, want = %q", got, tt.want)
+				}
+			},
+		)
+	}
+}
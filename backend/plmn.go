@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"encoding/hex"
+
+	"github.com/omec-project/ngap/logger"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+)
+
+// plmnServer is implemented by the backends which serve a configured list of
+// PLMNs. A backend without PLMNs serves every PLMN.
+type plmnServer interface {
+	PlmnIds() []config.PlmnId
+}
+
+// plmnIdString returns a PLMN Identity as <Mcc>:<Mnc>
+func plmnIdString(plmn *ngapType.PLMNIdentity) string {
+	if len(plmn.Value) != 3 {
+		return ""
+	}
+	digits := hex.EncodeToString(plmn.Value)
+	mcc := string([]byte{digits[1], digits[0], digits[3]})
+	mnc := string([]byte{digits[5], digits[4]})
+	if digits[2] != 'f' {
+		mnc = string([]byte{digits[2], digits[5], digits[4]})
+	}
+	return mcc + ":" + mnc
+}
+
+// extractRanPlmnId returns the PLMN of the Global RAN Node ID of an
+// NGSetupRequest, empty for any other PDU
+func extractRanPlmnId(ranMsg *ngapType.NGAPPDU) string {
+	if ranMsg.Present != ngapType.NGAPPDUPresentInitiatingMessage {
+		return ""
+	}
+	initiatingMessage := ranMsg.InitiatingMessage
+	if initiatingMessage == nil || initiatingMessage.ProcedureCode.Value != ngapType.ProcedureCodeNGSetup {
+		return ""
+	}
+	ngapMsg := initiatingMessage.Value.NGSetupRequest
+	if ngapMsg == nil {
+		logger.NgapLog.Errorln("NGSetupRequest is nil")
+		return ""
+	}
+	for _, ie := range ngapMsg.ProtocolIEs.List {
+		if ie.Id.Value != ngapType.ProtocolIEIDGlobalRANNodeID || ie.Value.GlobalRANNodeID == nil {
+			continue
+		}
+		nodeID := ie.Value.GlobalRANNodeID
+		switch nodeID.Present {
+		case ngapType.GlobalRANNodeIDPresentGlobalGNBID:
+			if nodeID.GlobalGNBID != nil {
+				return plmnIdString(&nodeID.GlobalGNBID.PLMNIdentity)
+			}
+		case ngapType.GlobalRANNodeIDPresentGlobalNgENBID:
+			if nodeID.GlobalNgENBID != nil {
+				return plmnIdString(&nodeID.GlobalNgENBID.PLMNIdentity)
+			}
+		case ngapType.GlobalRANNodeIDPresentGlobalN3IWFID:
+			if nodeID.GlobalN3IWFID != nil {
+				return plmnIdString(&nodeID.GlobalN3IWFID.PLMNIdentity)
+			}
+		}
+	}
+	return ""
+}
+
+// learnRanPlmn pins a RAN to the pool of its PLMN when it sends NGSetupRequest
+func learnRanPlmn(ran *context.Ran, ranMsg *ngapType.NGAPPDU) {
+	plmnId := extractRanPlmnId(ranMsg)
+	if plmnId == "" || plmnId == ran.PlmnId {
+		return
+	}
+	ran.Log.Infof("PLMN: %v", plmnId)
+	ran.PlmnId = plmnId
+}
+
+func servesPlmn(instance context.NF, plmnId string) bool {
+	server, ok := instance.(plmnServer)
+	if !ok || len(server.PlmnIds()) == 0 {
+		return true
+	}
+	for _, served := range server.PlmnIds() {
+		if served.Mcc+":"+served.Mnc == plmnId {
+			return true
+		}
+	}
+	return false
+}
+
+// plmnPool returns the backends serving the PLMN of a RAN, every backend
+// until the PLMN of the RAN is known
+func plmnPool(ran *context.Ran, backends []context.NF) []context.NF {
+	if ran == nil || ran.PlmnId == "" {
+		return backends
+	}
+	pool := make([]context.NF, 0, len(backends))
+	for _, instance := range backends {
+		if servesPlmn(instance, ran.PlmnId) {
+			pool = append(pool, instance)
+		}
+	}
+	if len(pool) == 0 {
+		ran.Log.Warnf("no backend serves PLMN %v", ran.PlmnId)
+	}
+	return pool
+}
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+func ngSetupRequest(plmn []byte) *ngapType.NGAPPDU {
+	request := &ngapType.NGSetupRequest{}
+	request.ProtocolIEs.List = append(request.ProtocolIEs.List, ngapType.NGSetupRequestIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDGlobalRANNodeID},
+		Value: ngapType.NGSetupRequestIEsValue{
+			Present: ngapType.NGSetupRequestIEsPresentGlobalRANNodeID,
+			GlobalRANNodeID: &ngapType.GlobalRANNodeID{
+				Present: ngapType.GlobalRANNodeIDPresentGlobalGNBID,
+				GlobalGNBID: &ngapType.GlobalGNBID{
+					PLMNIdentity: ngapType.PLMNIdentity{Value: plmn},
+				},
+			},
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeNGSetup},
+			Value: ngapType.InitiatingMessageValue{
+				Present:        ngapType.InitiatingMessagePresentNGSetupRequest,
+				NGSetupRequest: request,
+			},
+		},
+	}
+}
+
+func Test_PlmnPool(t *testing.T) {
+	operatorA := &GrpcServer{address: "127.0.0.1", plmnIds: []config.PlmnId{{Mcc: "208", Mnc: "93"}}}
+	operatorB := &GrpcServer{address: "127.0.0.2", plmnIds: []config.PlmnId{{Mcc: "310", Mnc: "410"}}}
+	shared := &GrpcServer{address: "127.0.0.3"}
+	backends := []context.NF{operatorA, operatorB, shared}
+
+	tests := []struct {
+		name       string
+		msg        *ngapType.NGAPPDU
+		wantPlmnId string
+		want       []string
+	}{
+		{
+			name:       "PLMN not known yet",
+			msg:        initialUEMessage(nil),
+			wantPlmnId: "",
+			want:       []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"},
+		},
+		{
+			name:       "Two digit MNC",
+			msg:        ngSetupRequest([]byte{0x02, 0xf8, 0x39}),
+			wantPlmnId: "208:93",
+			want:       []string{"127.0.0.1", "127.0.0.3"},
+		},
+		{
+			name:       "Three digit MNC",
+			msg:        ngSetupRequest([]byte{0x13, 0x40, 0x01}),
+			wantPlmnId: "310:410",
+			want:       []string{"127.0.0.2", "127.0.0.3"},
+		},
+		{
+			name:       "PLMN of no operator",
+			msg:        ngSetupRequest([]byte{0x00, 0xf1, 0x10}),
+			wantPlmnId: "001:01",
+			want:       []string{"127.0.0.3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				ran := &context.Ran{GnbIp: "10.0.0.1:38412", Log: logger.RanLog}
+				learnRanPlmn(ran, tt.msg)
+				if ran.PlmnId != tt.wantPlmnId {
+					t.Errorf("PlmnId mismatch. got = %q, want = %q", ran.PlmnId, tt.wantPlmnId)
+				}
+				if got := addresses(plmnPool(ran, backends)); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("plmnPool() mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
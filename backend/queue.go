@@ -0,0 +1,167 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/logger"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+)
+
+const (
+	defaultSendQueueDepth = 1024
+	defaultSendTimeout    = 5 * time.Second
+)
+
+// overflow policies of a full send queue
+const (
+	// wait for room in the queue, without holding up the other gNBs
+	overflowBlock = "block"
+	// drop the oldest queued message to make room
+	overflowDropOldest = "drop-oldest"
+	// refuse the message so that it is scheduled on another backend
+	overflowReroute = "reroute"
+)
+
+var (
+	sendQueueDepth    = defaultSendQueueDepth
+	sendQueueOverflow = overflowBlock
+	sendTimeout       = defaultSendTimeout
+)
+
+var (
+	errQueueFull      = errors.New("send queue full")
+	errBackendStopped = errors.New("backend stopped")
+)
+
+// SetSendQueue sets the depth and overflow policy of the send queues of the
+// backends created from now on, and the deadline of every message written to
+// a stream
+func SetSendQueue(cfg *config.SendQueue) {
+	sendQueueDepth = defaultSendQueueDepth
+	sendQueueOverflow = overflowBlock
+	sendTimeout = defaultSendTimeout
+	if cfg != nil {
+		if cfg.Depth > 0 {
+			sendQueueDepth = cfg.Depth
+		}
+		if cfg.Timeout > 0 {
+			sendTimeout = cfg.Timeout
+		}
+		switch cfg.Overflow {
+		case "", overflowBlock:
+		case overflowDropOldest, overflowReroute:
+			sendQueueOverflow = cfg.Overflow
+		default:
+			logger.DispatchLog.Warnf("unsupported send queue overflow policy %v, using %v", cfg.Overflow, overflowBlock)
+		}
+	}
+	logger.DispatchLog.Infof("send queue depth: %d overflow policy: %v send timeout: %v",
+		sendQueueDepth, sendQueueOverflow, sendTimeout)
+}
+
+// sendQueue is the bounded outbound queue of a backend, drained by the
+// writer goroutine of the backend so that the dispatcher never waits for the
+// network
+type sendQueue struct {
+	messages chan *gClient.SctplbMessage
+	overflow string
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu sync.Mutex
+	// closed once the writer draining the queue stops, nil while there is
+	// no writer
+	writer chan struct{}
+}
+
+func newSendQueue(depth int, overflow string) *sendQueue {
+	return &sendQueue{
+		messages: make(chan *gClient.SctplbMessage, depth),
+		overflow: overflow,
+		done:     make(chan struct{}),
+	}
+}
+
+// push queues a message, applying the overflow policy when the queue is full.
+// push never waits: with the block policy a full queue is refused, the
+// message is then queued with pushWait once the context lock is released.
+// Returns true if an older message was dropped to make room.
+func (q *sendQueue) push(message *gClient.SctplbMessage) (dropped bool, err error) {
+	select {
+	case <-q.done:
+		return false, errBackendStopped
+	case q.messages <- message:
+		return false, nil
+	default:
+	}
+
+	switch q.overflow {
+	case overflowDropOldest:
+		for {
+			select {
+			case q.messages <- message:
+				return dropped, nil
+			default:
+			}
+			select {
+			case <-q.messages:
+				dropped = true
+			default:
+			}
+		}
+	default:
+		return false, errQueueFull
+	}
+}
+
+// pushWait queues a message with the block policy, waiting for room in the
+// queue as long as a writer drains it. Must not be called with the context
+// lock held.
+func (q *sendQueue) pushWait(message *gClient.SctplbMessage) error {
+	q.mu.Lock()
+	writer := q.writer
+	q.mu.Unlock()
+	if q.overflow != overflowBlock || writer == nil {
+		// nothing would ever make room without a writer
+		return errQueueFull
+	}
+	select {
+	case <-q.done:
+		return errBackendStopped
+	case <-writer:
+		return errQueueFull
+	case q.messages <- message:
+		return nil
+	}
+}
+
+// attach registers the writer draining the queue, until the returned
+// function is called
+func (q *sendQueue) attach() (detach func()) {
+	writer := make(chan struct{})
+	q.mu.Lock()
+	q.writer = writer
+	q.mu.Unlock()
+	return func() {
+		q.mu.Lock()
+		if q.writer == writer {
+			q.writer = nil
+		}
+		q.mu.Unlock()
+		close(writer)
+	}
+}
+
+// stop ends the writer, messages still queued are dropped
+func (q *sendQueue) stop() {
+	q.stopOnce.Do(func() {
+		close(q.done)
+	})
+}
@@ -0,0 +1,220 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+)
+
+func Test_SendQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name        string
+		overflow    string
+		stopped     bool
+		wantErr     error
+		wantDropped bool
+		want        []string
+	}{
+		{
+			name:        "Drop oldest",
+			overflow:    overflowDropOldest,
+			wantDropped: true,
+			want:        []string{"2", "3"},
+		},
+		{
+			name:     "Reroute",
+			overflow: overflowReroute,
+			wantErr:  errQueueFull,
+			want:     []string{"1", "2"},
+		},
+		{
+			name:     "Block refused without waiting",
+			overflow: overflowBlock,
+			wantErr:  errQueueFull,
+			want:     []string{"1", "2"},
+		},
+		{
+			name:     "Stopped",
+			overflow: overflowBlock,
+			stopped:  true,
+			wantErr:  errBackendStopped,
+			want:     []string{"1", "2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				q := newSendQueue(2, tt.overflow)
+				for _, id := range []string{"1", "2"} {
+					if _, err := q.push(&gClient.SctplbMessage{GnbId: id}); err != nil {
+						t.Fatalf("push() error: %v", err)
+					}
+				}
+				if tt.stopped {
+					q.stop()
+				}
+				dropped, err := q.push(&gClient.SctplbMessage{GnbId: "3"})
+				if !errors.Is(err, tt.wantErr) || dropped != tt.wantDropped {
+					t.Errorf("push() = %v, %v, want %v, %v", dropped, err, tt.wantDropped, tt.wantErr)
+				}
+				var got []string
+				for len(q.messages) > 0 {
+					got = append(got, (<-q.messages).GnbId)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("queued messages mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_SendRerouting(t *testing.T) {
+	saved := scheduler
+	defer func() { scheduler = saved }()
+	scheduler = &roundRobinScheduler{}
+
+	gnbId := "208:93:000001"
+	ran := &context.Ran{RanId: &gnbId}
+	ngapID := &ngapType.RANUENGAPID{Value: 1}
+
+	tests := []struct {
+		name     string
+		overflow string
+		want     string
+		// wantInFlight of the full and the other backend
+		wantInFlight []int
+	}{
+		{
+			name:         "Rerouted to another backend",
+			overflow:     overflowReroute,
+			want:         "127.0.0.2",
+			wantInFlight: []int{1, 1},
+		},
+		{
+			name:         "Oldest message dropped",
+			overflow:     overflowDropOldest,
+			want:         "127.0.0.1",
+			wantInFlight: []int{1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				full := &GrpcServer{address: "127.0.0.1", state: stateReady, queue: newSendQueue(1, tt.overflow)}
+				other := &GrpcServer{address: "127.0.0.2", state: stateReady, queue: newSendQueue(1, tt.overflow)}
+				if err := full.Send([]byte{0}, false, ran); err != nil {
+					t.Fatalf("Send() error: %v", err)
+				}
+
+				got := sendRerouting(full, ran, ngapID, []context.NF{full, other}, []byte{1})
+				if got == nil || got.Address() != tt.want {
+					t.Errorf("sendRerouting() mismatch. got = %v, want = %v", got, tt.want)
+				}
+				if inFlight := []int{full.InFlight(), other.InFlight()}; !reflect.DeepEqual(inFlight, tt.wantInFlight) {
+					t.Errorf("InFlight() mismatch. got = %v, want = %v", inFlight, tt.wantInFlight)
+				}
+			},
+		)
+	}
+}
+
+func Test_SendDispatchedStalledBackend(t *testing.T) {
+	gnbId := "208:93:000001"
+	ran := &context.Ran{RanId: &gnbId}
+	// the writer of the stalled backend never drains its queue
+	stalled := &GrpcServer{address: "127.0.0.1", state: stateReady, queue: newSendQueue(1, overflowBlock)}
+	defer stalled.queue.attach()()
+	other := &GrpcServer{address: "127.0.0.2", state: stateReady, queue: newSendQueue(1, overflowBlock)}
+	if err := stalled.Send([]byte{0}, false, ran); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+
+	ctx := context.Sctplb_Self()
+	dispatch := func(b Backend) <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			ctx.Lock()
+			defer ctx.Unlock()
+			result <- sendDispatched(b, ran, []byte{1})
+		}()
+		return result
+	}
+
+	waiting := dispatch(stalled)
+	select {
+	case err := <-dispatch(other):
+		if err != nil {
+			t.Errorf("sendDispatched() to the other backend error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message of another gNB not dispatched while a backend is stalled")
+	}
+	select {
+	case err := <-waiting:
+		t.Fatalf("sendDispatched() to the stalled backend returned %v, want it waiting", err)
+	default:
+	}
+
+	stalled.stop()
+	select {
+	case err := <-waiting:
+		if !errors.Is(err, errBackendStopped) {
+			t.Errorf("sendDispatched() error = %v, want %v", err, errBackendStopped)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("sendDispatched() still waiting once the backend stopped")
+	}
+}
+
+func Test_SendDispatchedConnectingBackend(t *testing.T) {
+	gnbId := "208:93:000001"
+	ran := &context.Ran{RanId: &gnbId}
+	// CONNECTING: reachable for its sticky UEs, but no writer drains its queue
+	connecting := &GrpcServer{address: "127.0.0.1", state: stateConnecting, queue: newSendQueue(1, overflowBlock)}
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	ctx.AddNF(connecting)
+	ctx.Unlock()
+
+	result := make(chan error, 2)
+	go func() {
+		ctx.Lock()
+		defer ctx.Unlock()
+		for range 2 {
+			result <- sendDispatched(connecting, ran, []byte{1})
+		}
+	}()
+	for i, want := range []error{nil, errQueueFull} {
+		select {
+		case err := <-result:
+			if !errors.Is(err, want) {
+				t.Errorf("sendDispatched() %d error = %v, want %v", i, err, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("sendDispatched() waits on a queue without writer")
+		}
+	}
+
+	deleted := make(chan struct{})
+	go func() {
+		deleteBackendNF(connecting)
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+	case <-time.After(time.Second):
+		t.Errorf("backend which could not be reached not deleted")
+	}
+}
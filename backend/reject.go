@@ -0,0 +1,217 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"time"
+
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+const (
+	defaultRejectCause = "unspecified"
+	defaultTimeToWait  = 10 * time.Second
+)
+
+// causes sctplb answers the gNBs with, by configured name
+var rejectCauses = map[string]ngapType.Cause{
+	"control-processing-overload": {
+		Present: ngapType.CausePresentMisc,
+		Misc:    &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentControlProcessingOverload},
+	},
+	"not-enough-user-plane-processing-resources": {
+		Present: ngapType.CausePresentMisc,
+		Misc:    &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentNotEnoughUserPlaneProcessingResources},
+	},
+	"hardware-failure": {
+		Present: ngapType.CausePresentMisc,
+		Misc:    &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentHardwareFailure},
+	},
+	"om-intervention": {
+		Present: ngapType.CausePresentMisc,
+		Misc:    &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentOmIntervention},
+	},
+	"unknown-plmn": {
+		Present: ngapType.CausePresentMisc,
+		Misc:    &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentUnknownPLMN},
+	},
+	"unspecified": {
+		Present: ngapType.CausePresentMisc,
+		Misc:    &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentUnspecified},
+	},
+	"transport-resource-unavailable": {
+		Present:   ngapType.CausePresentTransport,
+		Transport: &ngapType.CauseTransport{Value: ngapType.CauseTransportPresentTransportResourceUnavailable},
+	},
+	"message-not-compatible-with-receiver-state": {
+		Present:  ngapType.CausePresentProtocol,
+		Protocol: &ngapType.CauseProtocol{Value: ngapType.CauseProtocolPresentMessageNotCompatibleWithReceiverState},
+	},
+}
+
+// TimeToWait values of NG Setup Failure
+var timesToWait = []struct {
+	duration time.Duration
+	value    aper.Enumerated
+}{
+	{time.Second, ngapType.TimeToWaitPresentV1s},
+	{2 * time.Second, ngapType.TimeToWaitPresentV2s},
+	{5 * time.Second, ngapType.TimeToWaitPresentV5s},
+	{10 * time.Second, ngapType.TimeToWaitPresentV10s},
+	{20 * time.Second, ngapType.TimeToWaitPresentV20s},
+	{60 * time.Second, ngapType.TimeToWaitPresentV60s},
+}
+
+var (
+	setupFailureCause    = rejectCauses[defaultRejectCause]
+	setupTimeToWait      = ngapType.TimeToWaitPresentV10s
+	errorIndicationCause = rejectCauses[defaultRejectCause]
+)
+
+// SetNoBackend sets how sctplb answers the gNBs when no backend can take
+// their messages
+func SetNoBackend(cfg *config.NoBackend) {
+	var setupCause, indicationCause string
+	timeToWait := defaultTimeToWait
+	if cfg != nil {
+		setupCause, indicationCause = cfg.SetupFailureCause, cfg.ErrorIndicationCause
+		if cfg.TimeToWait > 0 {
+			timeToWait = cfg.TimeToWait
+		}
+	}
+	setupCause, setupFailureCause = rejectCause(setupCause)
+	indicationCause, errorIndicationCause = rejectCause(indicationCause)
+	setupTimeToWait, timeToWait = timeToWaitValue(timeToWait)
+	logger.DispatchLog.Infof("without backend, NG Setup Failure cause: %v time to wait: %v, Error Indication cause: %v",
+		setupCause, timeToWait, indicationCause)
+}
+
+func rejectCause(name string) (string, ngapType.Cause) {
+	if name == "" {
+		name = defaultRejectCause
+	}
+	cause, ok := rejectCauses[name]
+	if !ok {
+		logger.DispatchLog.Warnf("unsupported cause %v, using %v", name, defaultRejectCause)
+		return defaultRejectCause, rejectCauses[defaultRejectCause]
+	}
+	return name, cause
+}
+
+// timeToWaitValue returns the shortest TimeToWait at least as long as
+// duration, or the longest one
+func timeToWaitValue(duration time.Duration) (aper.Enumerated, time.Duration) {
+	for _, timeToWait := range timesToWait {
+		if timeToWait.duration >= duration {
+			return timeToWait.value, timeToWait.duration
+		}
+	}
+	longest := timesToWait[len(timesToWait)-1]
+	return longest.value, longest.duration
+}
+
+// rejectUnroutable answers a message of a gNB no backend can take: an NG
+// Setup Request with NG Setup Failure, a UE-associated message with Error
+// Indication. Other messages are dropped.
+func rejectUnroutable(ran *context.Ran, ranMsg *ngapType.NGAPPDU) {
+	if ranMsg == nil {
+		return
+	}
+	if isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGSetup) {
+		ran.Log.Infoln("send NG Setup Failure, no backend available")
+		writeNGAP(ran, ngSetupFailurePDU(setupFailureCause, setupTimeToWait))
+		return
+	}
+	if isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeErrorIndication) {
+		return
+	}
+	ranUeNgapID, amfUeNgapID := extractUEIdentifier(ranMsg), extractAMFUEIdentifier(ranMsg)
+	if ranUeNgapID == nil && amfUeNgapID == nil {
+		return
+	}
+	ran.Log.Infof("send Error Indication of RAN-UE-NGAP-ID %v AMF-UE-NGAP-ID %v, no backend available",
+		ranUeNgapID, amfUeNgapID)
+	writeNGAP(ran, errorIndicationPDU(ranUeNgapID, amfUeNgapID, errorIndicationCause))
+}
+
+func ngSetupFailurePDU(cause ngapType.Cause, timeToWait aper.Enumerated) *ngapType.NGAPPDU {
+	failure := &ngapType.NGSetupFailure{}
+	failure.ProtocolIEs.List = append(failure.ProtocolIEs.List, ngapType.NGSetupFailureIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDCause},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+		Value: ngapType.NGSetupFailureIEsValue{
+			Present: ngapType.NGSetupFailureIEsPresentCause,
+			Cause:   &cause,
+		},
+	}, ngapType.NGSetupFailureIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDTimeToWait},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+		Value: ngapType.NGSetupFailureIEsValue{
+			Present:    ngapType.NGSetupFailureIEsPresentTimeToWait,
+			TimeToWait: &ngapType.TimeToWait{Value: timeToWait},
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentUnsuccessfulOutcome,
+		UnsuccessfulOutcome: &ngapType.UnsuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeNGSetup},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentReject},
+			Value: ngapType.UnsuccessfulOutcomeValue{
+				Present:        ngapType.UnsuccessfulOutcomePresentNGSetupFailure,
+				NGSetupFailure: failure,
+			},
+		},
+	}
+}
+
+func errorIndicationPDU(ranUeNgapID *ngapType.RANUENGAPID, amfUeNgapID *ngapType.AMFUENGAPID,
+	cause ngapType.Cause,
+) *ngapType.NGAPPDU {
+	indication := &ngapType.ErrorIndication{}
+	ies := &indication.ProtocolIEs.List
+	if amfUeNgapID != nil {
+		*ies = append(*ies, ngapType.ErrorIndicationIEs{
+			Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDAMFUENGAPID},
+			Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+			Value: ngapType.ErrorIndicationIEsValue{
+				Present:     ngapType.ErrorIndicationIEsPresentAMFUENGAPID,
+				AMFUENGAPID: amfUeNgapID,
+			},
+		})
+	}
+	if ranUeNgapID != nil {
+		*ies = append(*ies, ngapType.ErrorIndicationIEs{
+			Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDRANUENGAPID},
+			Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+			Value: ngapType.ErrorIndicationIEsValue{
+				Present:     ngapType.ErrorIndicationIEsPresentRANUENGAPID,
+				RANUENGAPID: ranUeNgapID,
+			},
+		})
+	}
+	*ies = append(*ies, ngapType.ErrorIndicationIEs{
+		Id:          ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDCause},
+		Criticality: ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+		Value: ngapType.ErrorIndicationIEsValue{
+			Present: ngapType.ErrorIndicationIEsPresentCause,
+			Cause:   &cause,
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeErrorIndication},
+			Criticality:   ngapType.Criticality{Value: ngapType.CriticalityPresentIgnore},
+			Value: ngapType.InitiatingMessageValue{
+				Present:         ngapType.InitiatingMessagePresentErrorIndication,
+				ErrorIndication: indication,
+			},
+		},
+	}
+}
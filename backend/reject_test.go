@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+func Test_TimeToWaitValue(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		want     aper.Enumerated
+		wantDur  time.Duration
+	}{
+		{0, ngapType.TimeToWaitPresentV1s, time.Second},
+		{time.Second, ngapType.TimeToWaitPresentV1s, time.Second},
+		{3 * time.Second, ngapType.TimeToWaitPresentV5s, 5 * time.Second},
+		{time.Minute, ngapType.TimeToWaitPresentV60s, time.Minute},
+		{time.Hour, ngapType.TimeToWaitPresentV60s, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.duration.String(), func(t *testing.T) {
+				got, gotDur := timeToWaitValue(tt.duration)
+				if got != tt.want || gotDur != tt.wantDur {
+					t.Errorf("timeToWaitValue(%v) = %v, %v, want %v, %v", tt.duration, got, gotDur, tt.want, tt.wantDur)
+				}
+			},
+		)
+	}
+}
+
+func Test_SetNoBackend(t *testing.T) {
+	defer SetNoBackend(nil)
+
+	tests := []struct {
+		name           string
+		cfg            *config.NoBackend
+		wantSetup      ngapType.Cause
+		wantTimeToWait aper.Enumerated
+		wantIndication ngapType.Cause
+	}{
+		{
+			name:           "Defaults",
+			wantSetup:      rejectCauses["unspecified"],
+			wantTimeToWait: ngapType.TimeToWaitPresentV10s,
+			wantIndication: rejectCauses["unspecified"],
+		},
+		{
+			name: "Configured causes",
+			cfg: &config.NoBackend{
+				SetupFailureCause:    "control-processing-overload",
+				TimeToWait:           20 * time.Second,
+				ErrorIndicationCause: "transport-resource-unavailable",
+			},
+			wantSetup:      rejectCauses["control-processing-overload"],
+			wantTimeToWait: ngapType.TimeToWaitPresentV20s,
+			wantIndication: rejectCauses["transport-resource-unavailable"],
+		},
+		{
+			name:           "Unsupported cause ignored",
+			cfg:            &config.NoBackend{SetupFailureCause: "random"},
+			wantSetup:      rejectCauses["unspecified"],
+			wantTimeToWait: ngapType.TimeToWaitPresentV10s,
+			wantIndication: rejectCauses["unspecified"],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				SetNoBackend(tt.cfg)
+				if !reflect.DeepEqual(setupFailureCause, tt.wantSetup) {
+					t.Errorf("setupFailureCause = %+v, want %+v", setupFailureCause, tt.wantSetup)
+				}
+				if setupTimeToWait != tt.wantTimeToWait {
+					t.Errorf("setupTimeToWait = %v, want %v", setupTimeToWait, tt.wantTimeToWait)
+				}
+				if !reflect.DeepEqual(errorIndicationCause, tt.wantIndication) {
+					t.Errorf("errorIndicationCause = %+v, want %+v", errorIndicationCause, tt.wantIndication)
+				}
+			},
+		)
+	}
+}
+
+func Test_RejectUnroutable(t *testing.T) {
+	defer SetNoBackend(nil)
+	SetNoBackend(&config.NoBackend{SetupFailureCause: "control-processing-overload", TimeToWait: 5 * time.Second})
+
+	t.Run("NG Setup Failure", func(t *testing.T) {
+		conn := &recordingConn{}
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+		rejectUnroutable(ran, ngSetupRequest([]byte{0x02, 0xf8, 0x39}))
+		pdus := conn.messages(t)
+		if len(pdus) != 1 || !isProcedure(pdus[0], ngapType.NGAPPDUPresentUnsuccessfulOutcome, ngapType.ProcedureCodeNGSetup) {
+			t.Fatalf("gNB not answered with NG Setup Failure: %+v", pdus)
+		}
+		var cause *ngapType.Cause
+		var timeToWait *ngapType.TimeToWait
+		for _, ie := range pdus[0].UnsuccessfulOutcome.Value.NGSetupFailure.ProtocolIEs.List {
+			switch ie.Id.Value {
+			case ngapType.ProtocolIEIDCause:
+				cause = ie.Value.Cause
+			case ngapType.ProtocolIEIDTimeToWait:
+				timeToWait = ie.Value.TimeToWait
+			}
+		}
+		if cause == nil || cause.Misc == nil || cause.Misc.Value != ngapType.CauseMiscPresentControlProcessingOverload {
+			t.Errorf("NG Setup Failure cause mismatch. got = %+v", cause)
+		}
+		if timeToWait == nil || timeToWait.Value != ngapType.TimeToWaitPresentV5s {
+			t.Errorf("NG Setup Failure TimeToWait mismatch. got = %+v", timeToWait)
+		}
+	})
+
+	t.Run("Error Indication", func(t *testing.T) {
+		conn := &recordingConn{}
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+		rejectUnroutable(ran, initialUEMessage(nil))
+		pdus := conn.messages(t)
+		if len(pdus) != 1 || !isProcedure(pdus[0], ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeErrorIndication) {
+			t.Fatalf("gNB not answered with Error Indication: %+v", pdus)
+		}
+		if id := extractUEIdentifier(pdus[0]); id == nil || id.Value != 1 {
+			t.Errorf("Error Indication RAN-UE-NGAP-ID mismatch. got = %+v, want = 1", id)
+		}
+		// an Error Indication is never answered with another one
+		rejectUnroutable(ran, pdus[0])
+		if got := len(conn.messages(t)); got != 0 {
+			t.Errorf("Error Indication answered. gNB messages = %d, want = 0", got)
+		}
+	})
+
+	t.Run("Non-UE-associated message dropped", func(t *testing.T) {
+		conn := &recordingConn{}
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+		rejectUnroutable(ran, procedureMessage(ngapType.NGAPPDUPresentInitiatingMessage,
+			ngapType.ProcedureCodeRANConfigurationUpdate))
+		if got := len(conn.messages(t)); got != 0 {
+			t.Errorf("gNB messages mismatch. got = %d, want = 0", got)
+		}
+	})
+}
@@ -0,0 +1,415 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	ctxt "context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omec-project/sctplb/logger"
+	pb "github.com/omec-project/sctplb/sctplbSession"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	replicationQueueSize  = 4096
+	replicationRetryDelay = 2 * time.Second
+)
+
+var _ SessionStore = &replicatedStore{}
+
+// replicatedStore is a SessionStore shared by several sctplb replicas. Every
+// replica keeps a full copy in a local memoryStore and streams its changes to
+// all peers over gRPC, so that a gNB reconnecting to another replica finds its
+// UEs on the same AMFs. Reads and idle expiry are local to each replica. Every
+// change of a session is versioned, and a deleted session leaves a tombstone
+// for tombstoneTTL, so that a replica (re)connecting to a peer after a
+// partition takes the latest change of each session from the peer's snapshot,
+// deletes and reassignments included. The local copy is persisted when
+// persistence is enabled, the updates of the peers included.
+type replicatedStore struct {
+	pb.UnimplementedSessionServiceServer
+	id    string
+	local SessionStore
+	peers []*sessionPeer
+	ctx   ctxt.Context
+	// credentials of the replication streams to the peers
+	creds credentials.TransportCredentials
+	// number of peers with an established replication stream
+	connected atomic.Int32
+
+	mu sync.Mutex // guards the local copy changes, versions and clock
+	// version of the last change of the sessions, and tombstones
+	versions     map[string]sessionVersion
+	clock        int64
+	tombstoneTTL time.Duration
+	now          func() time.Time
+}
+
+// sessionVersion is the version of the last change of a session
+type sessionVersion struct {
+	// hybrid logical clock of the change: its wall clock time in nanoseconds,
+	// or later than every change seen before
+	stamp   int64
+	deleted bool
+	// when a tombstone was recorded
+	at time.Time
+}
+
+type sessionPeer struct {
+	address string
+	updates chan *pb.SessionUpdate
+}
+
+func newReplicatedStore(ctx ctxt.Context, id string, local SessionStore, peers []string) *replicatedStore {
+	r := &replicatedStore{
+		id:           id,
+		local:        local,
+		ctx:          ctx,
+		creds:        transportCredentials,
+		versions:     make(map[string]sessionVersion),
+		tombstoneTTL: defaultSessionIdleTimeout,
+		now:          time.Now,
+	}
+	for _, address := range peers {
+		r.peers = append(r.peers, &sessionPeer{
+			address: address,
+			updates: make(chan *pb.SessionUpdate, replicationQueueSize),
+		})
+	}
+	return r
+}
+
+// Serve accepts the updates of the peers on lis and starts replicating the
+// local changes to the peers, over TLS when it is enabled
+func (r *replicatedStore) Serve(lis net.Listener) (*grpc.Server, error) {
+	creds, err := serverCredentials()
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(grpc.Creds(creds))
+	pb.RegisterSessionServiceServer(server, r)
+	go func() {
+		logger.DispatchLog.Infof("sticky session replication listening on %v", lis.Addr())
+		if err := server.Serve(lis); err != nil {
+			logger.DispatchLog.Errorf("sticky session replication server error: %v", err)
+		}
+	}()
+	go func() {
+		<-r.ctx.Done()
+		server.Stop()
+	}()
+	for _, peer := range r.peers {
+		go peer.run(r)
+	}
+	return server, nil
+}
+
+func (r *replicatedStore) Get(key string) (string, bool) {
+	return r.local.Get(key)
+}
+
+func (r *replicatedStore) Put(key, backend string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, found := r.local.Get(key); found && current == backend {
+		// only marked as used, which is local to each replica
+		return
+	}
+	r.local.Put(key, backend)
+	version := r.tick()
+	r.versions[key] = sessionVersion{stamp: version}
+	r.broadcast(&pb.SessionUpdate{Type: pb.UpdateType_PUT, Key: key, Backend: backend, Version: version})
+}
+
+func (r *replicatedStore) Delete(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deleted := r.local.Delete(key)
+	if deleted {
+		version := r.tick()
+		r.bury(key, version)
+		r.broadcast(&pb.SessionUpdate{Type: pb.UpdateType_DELETE, Key: key, Version: version})
+	}
+	return deleted
+}
+
+func (r *replicatedStore) DeletePrefix(prefix string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	version := r.tick()
+	for key := range r.local.Snapshot() {
+		if strings.HasPrefix(key, prefix) {
+			r.bury(key, version)
+		}
+	}
+	count := r.local.DeletePrefix(prefix)
+	r.broadcast(&pb.SessionUpdate{Type: pb.UpdateType_DELETE_PREFIX, Key: prefix, Version: version})
+	return count
+}
+
+// DeleteLocalPrefix removes the sessions from the copy of this replica only:
+// an association closing on this replica does not evict the sessions a gNB
+// reconnecting to a peer relies on
+func (r *replicatedStore) DeleteLocalPrefix(prefix string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.local.DeletePrefix(prefix)
+}
+
+func (r *replicatedStore) Reassign(from, to string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := r.local.Reassign(from, to)
+	version := r.tick()
+	for _, key := range keys {
+		if to == "" {
+			r.bury(key, version)
+		} else {
+			r.versions[key] = sessionVersion{stamp: version}
+		}
+	}
+	r.broadcast(&pb.SessionUpdate{Type: pb.UpdateType_REASSIGN, FromBackend: from, Backend: to, Version: version})
+	return keys
+}
+
+// Sweep removes the idle sessions of the local copy, the versions of the
+// sessions no longer in it and the expired tombstones
+func (r *replicatedStore) Sweep() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.local.Sweep()
+	existing := r.local.Snapshot()
+	now := r.now()
+	for key, version := range r.versions {
+		if version.deleted {
+			if now.Sub(version.at) > r.tombstoneTTL {
+				delete(r.versions, key)
+			}
+		} else if _, found := existing[key]; !found {
+			delete(r.versions, key)
+		}
+	}
+	return count
+}
+
+func (r *replicatedStore) Snapshot() map[string]string {
+	return r.local.Snapshot()
+}
+
+func (r *replicatedStore) Counts() map[string]int {
+	return r.local.Counts()
+}
+
+func (r *replicatedStore) Len() int {
+	return r.local.Len()
+}
+
+// tick returns the version of a local change. Caller must hold r.mu.
+func (r *replicatedStore) tick() int64 {
+	r.clock = max(r.now().UnixNano(), r.clock+1)
+	return r.clock
+}
+
+// observe moves the clock past the version of a change of a peer, so that
+// the later local changes win over it. Caller must hold r.mu.
+func (r *replicatedStore) observe(version int64) {
+	r.clock = max(r.clock, version)
+}
+
+// bury records the tombstone of a deleted session. Caller must hold r.mu.
+func (r *replicatedStore) bury(key string, version int64) {
+	r.versions[key] = sessionVersion{stamp: version, deleted: true, at: r.now()}
+}
+
+// newer returns true if a change of a peer is later than the last change of
+// a session. Caller must hold r.mu.
+func (r *replicatedStore) newer(key string, version int64) bool {
+	current, found := r.versions[key]
+	return !found || version > current.stamp
+}
+
+func (r *replicatedStore) broadcast(update *pb.SessionUpdate) {
+	update.SctplbId = r.id
+	for _, peer := range r.peers {
+		select {
+		case peer.updates <- update:
+		default:
+			logger.DispatchLog.Warnf("replication queue of peer %v is full, dropping session update", peer.address)
+		}
+	}
+}
+
+// apply changes the local copy only, updates received from a peer are not
+// forwarded any further. A session changed later than the update is kept.
+func (r *replicatedStore) apply(update *pb.SessionUpdate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observe(update.Version)
+	switch update.Type {
+	case pb.UpdateType_PUT:
+		if r.newer(update.Key, update.Version) {
+			r.local.Put(update.Key, update.Backend)
+			r.versions[update.Key] = sessionVersion{stamp: update.Version}
+		}
+	case pb.UpdateType_DELETE:
+		if r.newer(update.Key, update.Version) {
+			r.local.Delete(update.Key)
+			r.bury(update.Key, update.Version)
+		}
+	case pb.UpdateType_DELETE_PREFIX:
+		for key := range r.local.Snapshot() {
+			if strings.HasPrefix(key, update.Key) && r.newer(key, update.Version) {
+				r.local.Delete(key)
+				r.bury(key, update.Version)
+			}
+		}
+	case pb.UpdateType_REASSIGN:
+		for key, backend := range r.local.Snapshot() {
+			if backend != update.FromBackend || !r.newer(key, update.Version) {
+				continue
+			}
+			if update.Backend == "" {
+				r.local.Delete(key)
+				r.bury(key, update.Version)
+			} else {
+				r.local.Put(key, update.Backend)
+				r.versions[key] = sessionVersion{stamp: update.Version}
+			}
+		}
+	default:
+		logger.DispatchLog.Warnf("unknown session update type %v from %v", update.Type, update.SctplbId)
+	}
+}
+
+// snapshot returns the sessions of the local copy and the tombstones, with
+// their versions
+func (r *replicatedStore) snapshot() *pb.Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot := &pb.Snapshot{}
+	for key, backend := range r.local.Snapshot() {
+		snapshot.Entries = append(snapshot.Entries, &pb.SessionEntry{
+			Key: key, Backend: backend, Version: r.versions[key].stamp,
+		})
+	}
+	for key, version := range r.versions {
+		if version.deleted {
+			snapshot.Entries = append(snapshot.Entries, &pb.SessionEntry{
+				Key: key, Version: version.stamp, Deleted: true,
+			})
+		}
+	}
+	return snapshot
+}
+
+// merge takes the sessions and tombstones of a peer's snapshot which are
+// later than the local ones. Returns the number of sessions changed.
+func (r *replicatedStore) merge(snapshot *pb.Snapshot) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var merged int
+	existing := r.local.Snapshot()
+	for _, entry := range snapshot.Entries {
+		r.observe(entry.Version)
+		_, present := existing[entry.Key]
+		_, versioned := r.versions[entry.Key]
+		// a session of unknown version is only added when missing, the
+		// replicas would otherwise swap their unversioned sessions
+		if !r.newer(entry.Key, entry.Version) || (!versioned && present && entry.Version == 0) {
+			continue
+		}
+		if entry.Deleted {
+			if present {
+				r.local.Delete(entry.Key)
+				merged++
+			}
+			r.bury(entry.Key, entry.Version)
+			continue
+		}
+		if backend := existing[entry.Key]; !present || backend != entry.Backend {
+			r.local.Put(entry.Key, entry.Backend)
+			merged++
+		}
+		r.versions[entry.Key] = sessionVersion{stamp: entry.Version}
+	}
+	return merged
+}
+
+func (r *replicatedStore) Replicate(stream pb.SessionService_ReplicateServer) error {
+	var applied uint64
+	for {
+		update, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.ReplicateResponse{Applied: applied})
+		}
+		if err != nil {
+			return err
+		}
+		r.apply(update)
+		applied++
+	}
+}
+
+func (r *replicatedStore) GetSnapshot(_ ctxt.Context, req *pb.SnapshotRequest) (*pb.Snapshot, error) {
+	logger.DispatchLog.Infof("sending sticky session snapshot to %v", req.SctplbId)
+	return r.snapshot(), nil
+}
+
+// run keeps a replication stream open towards the peer, merging the peer's
+// snapshot every time the stream is (re)established
+func (p *sessionPeer) run(r *replicatedStore) {
+	conn, err := grpc.NewClient(p.address, grpc.WithTransportCredentials(r.creds))
+	if err != nil {
+		logger.DispatchLog.Errorf("can not create replication client of peer %v: %v", p.address, err)
+		return
+	}
+	defer conn.Close()
+	client := pb.NewSessionServiceClient(conn)
+
+	for {
+		if err := p.replicate(r, client); err != nil {
+			logger.DispatchLog.Warnf("replication to peer %v failed: %v", p.address, err)
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+}
+
+func (p *sessionPeer) replicate(r *replicatedStore, client pb.SessionServiceClient) error {
+	snapshot, err := client.GetSnapshot(r.ctx, &pb.SnapshotRequest{SctplbId: r.id})
+	if err != nil {
+		return err
+	}
+	merged := r.merge(snapshot)
+	logger.DispatchLog.Infof("merged %d sticky sessions from peer %v", merged, p.address)
+
+	stream, err := client.Replicate(r.ctx)
+	if err != nil {
+		return err
+	}
+	r.connected.Add(1)
+	defer r.connected.Add(-1)
+	for {
+		select {
+		case <-r.ctx.Done():
+			_, err := stream.CloseAndRecv()
+			return err
+		case update := <-p.updates:
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		}
+	}
+}
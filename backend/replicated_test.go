@@ -0,0 +1,334 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	ctxt "context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func startReplicatedStores(t *testing.T, ctx ctxt.Context, n int) []*replicatedStore {
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		listeners = append(listeners, lis)
+	}
+
+	var stores []*replicatedStore
+	for i, lis := range listeners {
+		var peers []string
+		for j, peer := range listeners {
+			if j != i {
+				peers = append(peers, peer.Addr().String())
+			}
+		}
+		store := newReplicatedStore(ctx, fmt.Sprintf("sctplb-%d", i), newMemoryStore(time.Minute, 0), peers)
+		store.Serve(lis)
+		stores = append(stores, store)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, store := range stores {
+		for int(store.connected.Load()) != n-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("replication streams of %v not established", store.id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return stores
+}
+
+func waitForSession(t *testing.T, store SessionStore, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got, found := store.Get(key)
+		if (want == "" && !found) || (found && got == want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got, found := store.Get(key)
+	t.Fatalf("session %v mismatch. got = %q (found = %v), want = %q", key, got, found, want)
+}
+
+func Test_ReplicatedStore(t *testing.T) {
+	ctx, cancel := ctxt.WithCancel(ctxt.Background())
+	defer cancel()
+	stores := startReplicatedStores(t, ctx, 3)
+
+	tests := []struct {
+		name   string
+		update func()
+		key    string
+		want   string
+	}{
+		{
+			name:   "Put is replicated",
+			update: func() { stores[0].Put("ran_1", "127.0.0.1") },
+			key:    "ran_1",
+			want:   "127.0.0.1",
+		},
+		{
+			name:   "Update is replicated",
+			update: func() { stores[1].Put("ran_1", "127.0.0.2") },
+			key:    "ran_1",
+			want:   "127.0.0.2",
+		},
+		{
+			name:   "Reassign is replicated",
+			update: func() { stores[2].Reassign("127.0.0.2", "127.0.0.3") },
+			key:    "ran_1",
+			want:   "127.0.0.3",
+		},
+		{
+			name:   "Delete is replicated",
+			update: func() { stores[1].Delete("ran_1") },
+			key:    "ran_1",
+			want:   "",
+		},
+		{
+			name: "DeletePrefix is replicated",
+			update: func() {
+				stores[2].Put("ran_2", "127.0.0.1")
+				stores[2].DeletePrefix("ran_")
+			},
+			key:  "ran_2",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				tt.update()
+				for _, store := range stores {
+					waitForSession(t, store, tt.key, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_ReplicatedStoreUnchangedPut(t *testing.T) {
+	// the peer is never connected, its queue keeps the broadcast updates
+	store := newReplicatedStore(ctxt.Background(), "sctplb-0", newMemoryStore(time.Minute, 0), []string{"127.0.0.1:1"})
+	updates := store.peers[0].updates
+
+	for i := 0; i < 3; i++ {
+		store.Put("ran_1", "127.0.0.1")
+	}
+	if len(updates) != 1 {
+		t.Errorf("%d updates broadcast for an unchanged session, want 1", len(updates))
+	}
+	store.Put("ran_1", "127.0.0.2")
+	if len(updates) != 2 {
+		t.Errorf("%d updates broadcast, want 2 once the session changed", len(updates))
+	}
+}
+
+func Test_ReplicatedStoreReconnect(t *testing.T) {
+	// replicas never connected, their snapshots are exchanged as on a
+	// reconnection
+	first := newReplicatedStore(ctxt.Background(), "sctplb-0", newMemoryStore(time.Minute, 0), nil)
+	second := newReplicatedStore(ctxt.Background(), "sctplb-1", newMemoryStore(time.Minute, 0), nil)
+	first.Put("ran_1", "127.0.0.1")
+	first.Put("ran_2", "127.0.0.1")
+	first.Put("ran_3", "127.0.0.1")
+	first.Put("ran_4", "127.0.0.1")
+	second.merge(first.snapshot())
+
+	// partitioned, each replica changes the sessions on its own
+	first.Delete("ran_1")
+	first.Reassign("127.0.0.1", "127.0.0.2")
+	second.Put("ran_3", "127.0.0.3")
+	second.DeletePrefix("ran_4")
+	second.Put("ran_5", "127.0.0.3")
+
+	first.merge(second.snapshot())
+	second.merge(first.snapshot())
+
+	want := map[string]string{
+		"ran_2": "127.0.0.2",
+		"ran_3": "127.0.0.3",
+		"ran_5": "127.0.0.3",
+	}
+	for _, store := range []*replicatedStore{first, second} {
+		if got := store.Snapshot(); !reflect.DeepEqual(got, want) {
+			t.Errorf("sessions of %v mismatch. got = %v, want = %v", store.id, got, want)
+		}
+	}
+
+	// the tombstones expire
+	for _, store := range []*replicatedStore{first, second} {
+		store.now = func() time.Time { return time.Now().Add(2 * store.tombstoneTTL) }
+		store.Sweep()
+		for key, version := range store.versions {
+			if version.deleted {
+				t.Errorf("tombstone of %v kept by %v", key, store.id)
+			}
+		}
+	}
+}
+
+func Test_ReplicatedStoreLocalEviction(t *testing.T) {
+	ctx, cancel := ctxt.WithCancel(ctxt.Background())
+	defer cancel()
+	stores := startReplicatedStores(t, ctx, 2)
+
+	stores[0].Put("ran_1", "127.0.0.1")
+	waitForSession(t, stores[1], "ran_1", "127.0.0.1")
+
+	// the association of the gNB closes on the first replica
+	if count := deleteLocalPrefix(stores[0], "ran_"); count != 1 {
+		t.Errorf("deleteLocalPrefix() = %d, want 1", count)
+	}
+	if _, found := stores[0].Get("ran_1"); found {
+		t.Errorf("session not evicted from the local copy")
+	}
+	// updates are streamed in order, once a later one arrived the eviction
+	// would have too
+	stores[0].Put("other_1", "127.0.0.1")
+	waitForSession(t, stores[1], "other_1", "127.0.0.1")
+	if got, found := stores[1].Get("ran_1"); !found || got != "127.0.0.1" {
+		t.Errorf("session evicted from the peer. got = %q (found = %v)", got, found)
+	}
+}
+
+func Test_ReplicatedStorePersistence(t *testing.T) {
+	ctx, cancel := ctxt.WithCancel(ctxt.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	persisted, err := openPersistentStore(dir, 100, newMemoryStore(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("openPersistentStore() error: %v", err)
+	}
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		listeners = append(listeners, lis)
+	}
+	peer := newReplicatedStore(ctx, "sctplb-0", newMemoryStore(time.Minute, 0), []string{listeners[1].Addr().String()})
+	peer.Serve(listeners[0])
+	store := newReplicatedStore(ctx, "sctplb-1", persisted, []string{listeners[0].Addr().String()})
+	store.Serve(listeners[1])
+
+	// the updates of the peer reach the write-ahead log
+	peer.Put("ran_1", "127.0.0.1")
+	peer.Put("ran_2", "127.0.0.2")
+	waitForSession(t, store, "ran_1", "127.0.0.1")
+	waitForSession(t, store, "ran_2", "127.0.0.2")
+	peer.Delete("ran_2")
+	waitForSession(t, store, "ran_2", "")
+
+	restarted, err := openPersistentStore(dir, 100, newMemoryStore(time.Minute, 0))
+	if err != nil {
+		t.Fatalf("openPersistentStore() error on restart: %v", err)
+	}
+	want := map[string]string{"ran_1": "127.0.0.1"}
+	if got := restarted.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored sessions mismatch. got = %v, want = %v", got, want)
+	}
+}
+
+func Test_ReplicatedStoreTLS(t *testing.T) {
+	saved := transportCredentials
+	defer func() { transportCredentials = saved }()
+	ctx, cancel := ctxt.WithCancel(ctxt.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "sctplb.test", 2)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestFile(t, caFile, ca.pem, time.Now())
+	writeTestFile(t, certFile, cert, time.Now())
+	writeTestFile(t, keyFile, key, time.Now())
+
+	// TLS without a certificate can not serve the peers
+	if err := SetTLS(&config.TLS{Enabled: true, CaFile: caFile}); err != nil {
+		t.Fatalf("SetTLS() error: %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	if _, err := newReplicatedStore(ctx, "sctplb-0", newMemoryStore(time.Minute, 0), nil).Serve(lis); err == nil {
+		t.Errorf("Serve() without a certificate succeeded")
+	}
+	lis.Close()
+
+	err = SetTLS(&config.TLS{
+		Enabled: true, CaFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "sctplb.test",
+	})
+	if err != nil {
+		t.Fatalf("SetTLS() error: %v", err)
+	}
+	stores := startReplicatedStores(t, ctx, 2)
+	stores[0].Put("ran_1", "127.0.0.1")
+	waitForSession(t, stores[1], "ran_1", "127.0.0.1")
+
+	// a replica without TLS is refused by its peers
+	transportCredentials = insecure.NewCredentials()
+	lis, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer lis.Close()
+	plaintext := newReplicatedStore(ctx, "sctplb-2", newMemoryStore(time.Minute, 0), []string{stores[0].peers[0].address})
+	if _, err := plaintext.Serve(lis); err != nil {
+		t.Fatalf("Serve() error: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if plaintext.connected.Load() != 0 {
+		t.Errorf("plaintext replication stream established with a TLS peer")
+	}
+	if _, found := plaintext.Get("ran_1"); found {
+		t.Errorf("plaintext replica received the sessions of a TLS peer")
+	}
+}
+
+func Test_ReplicatedStoreSnapshot(t *testing.T) {
+	ctx, cancel := ctxt.WithCancel(ctxt.Background())
+	defer cancel()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	existingAddr := lis.Addr().String()
+	existing := newReplicatedStore(ctx, "sctplb-0", newMemoryStore(time.Minute, 0), nil)
+	existing.Serve(lis)
+	existing.Put("ran_1", "127.0.0.1")
+	existing.Put("ran_amf_2", "127.0.0.2")
+
+	lis, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	restarted := newReplicatedStore(ctx, "sctplb-1", newMemoryStore(time.Minute, 0), []string{existingAddr})
+	restarted.Serve(lis)
+
+	waitForSession(t, restarted, "ran_1", "127.0.0.1")
+	waitForSession(t, restarted, "ran_amf_2", "127.0.0.2")
+}
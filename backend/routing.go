@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"time"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// routes of the non-UE-associated procedures of the gNBs
+const (
+	// every backend, their responses merged into one
+	routeBroadcast = "broadcast"
+	// the first READY backend
+	routeFirstReady = "first-ready"
+	// the backend the gNB is assigned to, as in per-gNB dispatch mode
+	routeOwner = "owner"
+)
+
+// time the backends have to answer a broadcast procedure before sctplb
+// answers the gNB with the responses received
+var broadcastTimeout = 5 * time.Second
+
+// procedureRoutes routes the non-UE-associated procedures by procedure code
+var procedureRoutes = defaultProcedureRoutes()
+
+func defaultProcedureRoutes() map[int64]string {
+	return map[int64]string{
+		ngapType.ProcedureCodeRANConfigurationUpdate:         routeBroadcast,
+		ngapType.ProcedureCodeErrorIndication:                routeBroadcast,
+		ngapType.ProcedureCodeUplinkRANConfigurationTransfer: routeFirstReady,
+	}
+}
+
+// pendingBroadcast is a procedure of a gNB broadcast to the backends, answered
+// to the gNB once every backend answered it
+type pendingBroadcast struct {
+	ran           *context.Ran
+	procedureCode int64
+	// backends yet to answer, by address
+	waiting map[string]bool
+	// response passed on to the gNB: the first failure, or else the first
+	// successful outcome
+	outcome []byte
+	failed  bool
+	timer   *time.Timer
+}
+
+// broadcast procedures of the gNBs waiting for responses, by procedure code,
+// guarded by the context lock
+var broadcasts = make(map[*context.Ran]map[int64]*pendingBroadcast)
+
+// SetProcedureRouting sets how the non-UE-associated procedures of the gNBs
+// are routed to the backends
+func SetProcedureRouting(cfg *config.ProcedureRouting) {
+	procedureRoutes = defaultProcedureRoutes()
+	if cfg != nil {
+		setProcedureRoute(ngapType.ProcedureCodeRANConfigurationUpdate, cfg.RanConfigurationUpdate)
+		setProcedureRoute(ngapType.ProcedureCodeErrorIndication, cfg.ErrorIndication)
+		setProcedureRoute(ngapType.ProcedureCodeUplinkRANConfigurationTransfer, cfg.UplinkRanConfigurationTransfer)
+	}
+	logger.DispatchLog.Infof("RAN Configuration Update: %v, Error Indication: %v, Uplink RAN Configuration Transfer: %v",
+		procedureRoutes[ngapType.ProcedureCodeRANConfigurationUpdate],
+		procedureRoutes[ngapType.ProcedureCodeErrorIndication],
+		procedureRoutes[ngapType.ProcedureCodeUplinkRANConfigurationTransfer])
+}
+
+func setProcedureRoute(procedureCode int64, route string) {
+	switch route {
+	case "":
+	case routeBroadcast, routeFirstReady, routeOwner:
+		procedureRoutes[procedureCode] = route
+	default:
+		logger.DispatchLog.Warnf("unsupported route %v of procedure %v, using %v", route, procedureCode,
+			procedureRoutes[procedureCode])
+	}
+}
+
+// routeProcedure sends a non-UE-associated procedure of a gNB to the backends
+// of its route. Returns true if the message was sent. Caller must hold the
+// context lock.
+func routeProcedure(ran *context.Ran, ranMsg *ngapType.NGAPPDU, msg []byte) bool {
+	if ranMsg.Present != ngapType.NGAPPDUPresentInitiatingMessage || ranMsg.InitiatingMessage == nil {
+		return false
+	}
+	procedureCode := ranMsg.InitiatingMessage.ProcedureCode.Value
+	route, ok := procedureRoutes[procedureCode]
+	if !ok {
+		return false
+	}
+	pool := plmnPool(ran, context.Sctplb_Self().Backends)
+	switch route {
+	case routeBroadcast:
+		return broadcastProcedure(ran, procedureCode, pool, msg)
+	case routeFirstReady:
+		for _, instance := range pool {
+			if instance.State() {
+				ran.Log.Infof("procedure %v sent to backend %v", procedureCode, instance.Address())
+				if err := sendDispatched(instance, ran, msg); err != nil {
+					logger.SctpLog.Errorln("can not send:", err)
+				}
+				return true
+			}
+		}
+	case routeOwner:
+		if backend := ranBackend(ran); backend != nil {
+			ran.Log.Infof("procedure %v sent to backend %v", procedureCode, backend.Address())
+			if err := sendDispatched(backend, ran, msg); err != nil {
+				logger.SctpLog.Errorln("can not send:", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// broadcastProcedure sends a procedure of a gNB to every backend of the pool
+// which is READY or DRAINING, and waits for their responses if the procedure
+// is answered. The backends whose send queue is full wait for room once the
+// broadcast is recorded. Caller must hold the context lock.
+func broadcastProcedure(ran *context.Ran, procedureCode int64, pool []context.NF, msg []byte) bool {
+	pending := &pendingBroadcast{
+		ran:           ran,
+		procedureCode: procedureCode,
+		waiting:       make(map[string]bool),
+	}
+	var blocked []context.NF
+	for _, instance := range pool {
+		if !instance.State() && !draining(instance) {
+			continue
+		}
+		if err := instance.Send(msg, false, ran); waitsForRoom(instance, err) {
+			blocked = append(blocked, instance)
+		} else if err != nil {
+			logger.SctpLog.Errorln("can not send:", err)
+			continue
+		}
+		pending.waiting[instance.Address()] = true
+	}
+	if len(pending.waiting) == 0 {
+		return false
+	}
+	ran.Log.Infof("procedure %v sent to %d backends", procedureCode, len(pending.waiting))
+	if procedureCode == ngapType.ProcedureCodeRANConfigurationUpdate {
+		awaitBroadcast(pending)
+	}
+	for _, instance := range blocked {
+		if err := sendWaiting(instance, ran, msg); err != nil {
+			logger.SctpLog.Errorln("can not send:", err)
+			failBroadcast(pending, instance.Address())
+		}
+	}
+	return true
+}
+
+// awaitBroadcast records a procedure of a gNB broadcast to the backends until
+// they all answer it or the broadcast times out. Caller must hold the context
+// lock.
+func awaitBroadcast(pending *pendingBroadcast) {
+	ran, procedureCode := pending.ran, pending.procedureCode
+	if broadcasts[ran] == nil {
+		broadcasts[ran] = make(map[int64]*pendingBroadcast)
+	}
+	if previous, ok := broadcasts[ran][procedureCode]; ok {
+		ran.Log.Warnf("procedure %v while the previous one is not answered", procedureCode)
+		completeBroadcast(previous)
+	}
+	broadcasts[ran][procedureCode] = pending
+	pending.timer = time.AfterFunc(broadcastTimeout, func() {
+		ctx := context.Sctplb_Self()
+		ctx.Lock()
+		defer ctx.Unlock()
+		if broadcasts[ran][procedureCode] != pending {
+			return
+		}
+		for address := range pending.waiting {
+			ran.Log.Warnf("procedure %v not answered by backend %v within %v", procedureCode, address, broadcastTimeout)
+		}
+		completeBroadcast(pending)
+	})
+}
+
+// failBroadcast stops waiting for the response of a backend the procedure
+// could not be sent to. Caller must hold the context lock.
+func failBroadcast(pending *pendingBroadcast, address string) {
+	if !pending.waiting[address] {
+		return
+	}
+	delete(pending.waiting, address)
+	if len(pending.waiting) == 0 && broadcasts[pending.ran][pending.procedureCode] == pending {
+		completeBroadcast(pending)
+	}
+}
+
+// handleBroadcastOutcome collects the response of a backend to a procedure
+// of a gNB broadcast to the backends. Returns true if the message was
+// consumed by sctplb.
+func handleBroadcastOutcome(backend Backend, ran *context.Ran, amfMsg *ngapType.NGAPPDU, msg []byte) bool {
+	var procedureCode int64
+	var failed bool
+	switch {
+	case amfMsg.Present == ngapType.NGAPPDUPresentSuccessfulOutcome && amfMsg.SuccessfulOutcome != nil:
+		procedureCode = amfMsg.SuccessfulOutcome.ProcedureCode.Value
+	case amfMsg.Present == ngapType.NGAPPDUPresentUnsuccessfulOutcome && amfMsg.UnsuccessfulOutcome != nil:
+		procedureCode = amfMsg.UnsuccessfulOutcome.ProcedureCode.Value
+		failed = true
+	default:
+		return false
+	}
+	ctx := context.Sctplb_Self()
+	ctx.Lock()
+	defer ctx.Unlock()
+	pending, ok := broadcasts[ran][procedureCode]
+	if !ok {
+		return false
+	}
+	if !pending.waiting[backend.Address()] {
+		ran.Log.Infof("dropped response of backend %v to procedure %v", backend.Address(), procedureCode)
+		return true
+	}
+	delete(pending.waiting, backend.Address())
+	if pending.outcome == nil || (failed && !pending.failed) {
+		pending.outcome = msg
+		pending.failed = failed
+	}
+	if len(pending.waiting) == 0 {
+		completeBroadcast(pending)
+	}
+	return true
+}
+
+// completeBroadcast passes the merged response of the backends on to the
+// gNB. Caller must hold the context lock.
+func completeBroadcast(pending *pendingBroadcast) {
+	pending.timer.Stop()
+	if broadcasts[pending.ran][pending.procedureCode] == pending {
+		delete(broadcasts[pending.ran], pending.procedureCode)
+		if len(broadcasts[pending.ran]) == 0 {
+			delete(broadcasts, pending.ran)
+		}
+	}
+	if pending.outcome == nil {
+		pending.ran.Log.Warnf("procedure %v answered by no backend", pending.procedureCode)
+		return
+	}
+	if _, err := pending.ran.Conn.Write(pending.outcome); err != nil {
+		pending.ran.Log.Infof("err %+v", err)
+	}
+}
+
+// forgetBroadcasts drops the broadcast procedures of a closed gNB. Caller
+// must hold the context lock.
+func forgetBroadcasts(ran *context.Ran) {
+	for _, pending := range broadcasts[ran] {
+		pending.timer.Stop()
+	}
+	delete(broadcasts, ran)
+}
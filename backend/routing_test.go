@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+func procedureMessage(present int, procedureCode int64) *ngapType.NGAPPDU {
+	pdu := &ngapType.NGAPPDU{Present: present}
+	switch present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		pdu.InitiatingMessage = &ngapType.InitiatingMessage{ProcedureCode: ngapType.ProcedureCode{Value: procedureCode}}
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		pdu.SuccessfulOutcome = &ngapType.SuccessfulOutcome{ProcedureCode: ngapType.ProcedureCode{Value: procedureCode}}
+	case ngapType.NGAPPDUPresentUnsuccessfulOutcome:
+		pdu.UnsuccessfulOutcome = &ngapType.UnsuccessfulOutcome{ProcedureCode: ngapType.ProcedureCode{Value: procedureCode}}
+	}
+	return pdu
+}
+
+func Test_SetProcedureRouting(t *testing.T) {
+	defer SetProcedureRouting(nil)
+
+	tests := []struct {
+		name string
+		cfg  *config.ProcedureRouting
+		want map[int64]string
+	}{
+		{
+			name: "Default routes",
+			want: defaultProcedureRoutes(),
+		},
+		{
+			name: "Configured routes",
+			cfg: &config.ProcedureRouting{
+				RanConfigurationUpdate:         routeOwner,
+				UplinkRanConfigurationTransfer: routeBroadcast,
+			},
+			want: map[int64]string{
+				ngapType.ProcedureCodeRANConfigurationUpdate:         routeOwner,
+				ngapType.ProcedureCodeErrorIndication:                routeBroadcast,
+				ngapType.ProcedureCodeUplinkRANConfigurationTransfer: routeBroadcast,
+			},
+		},
+		{
+			name: "Unsupported route ignored",
+			cfg:  &config.ProcedureRouting{ErrorIndication: "random"},
+			want: defaultProcedureRoutes(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				SetProcedureRouting(tt.cfg)
+				if !reflect.DeepEqual(procedureRoutes, tt.want) {
+					t.Errorf("procedureRoutes = %v, want %v", procedureRoutes, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_RouteProcedure(t *testing.T) {
+	savedTimeout := broadcastTimeout
+	defer func() {
+		broadcastTimeout = savedTimeout
+		SetProcedureRouting(nil)
+	}()
+	SetProcedureRouting(&config.ProcedureRouting{ErrorIndication: routeOwner})
+
+	ctx := context.Sctplb_Self()
+	connecting := setupBackend(stateConnecting, nil)
+	connecting.address = "127.0.0.1"
+	ready := setupBackend(stateReady, nil)
+	ready.address = "127.0.0.2"
+	drained := setupBackend(stateDraining, nil)
+	drained.address = "127.0.0.3"
+	backends := []*GrpcServer{connecting, ready, drained}
+	ctx.Lock()
+	for _, b := range backends {
+		ctx.AddNF(b)
+	}
+	ctx.Unlock()
+	defer func() {
+		for _, b := range backends {
+			deleteBackendNF(b)
+		}
+	}()
+
+	sent := func() []*GrpcServer {
+		var got []*GrpcServer
+		for _, b := range backends {
+			for len(b.queue.messages) > 0 {
+				<-b.queue.messages
+				got = append(got, b)
+			}
+		}
+		return got
+	}
+	route := func(ran *context.Ran, procedureCode int64) {
+		t.Helper()
+		ctx.Lock()
+		defer ctx.Unlock()
+		if !routeProcedure(ran, procedureMessage(ngapType.NGAPPDUPresentInitiatingMessage, procedureCode), []byte{1}) {
+			t.Fatalf("procedure %v not routed", procedureCode)
+		}
+	}
+
+	t.Run("First READY backend", func(t *testing.T) {
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: &recordingConn{}, Log: logger.RanLog}
+		route(ran, ngapType.ProcedureCodeUplinkRANConfigurationTransfer)
+		if got := sent(); !reflect.DeepEqual(got, []*GrpcServer{ready}) {
+			t.Errorf("procedure sent to %v, want %v", got, ready.address)
+		}
+	})
+
+	t.Run("Backend of the gNB", func(t *testing.T) {
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: &recordingConn{}, Log: logger.RanLog}
+		ran.Backend = drained
+		route(ran, ngapType.ProcedureCodeErrorIndication)
+		if got := sent(); !reflect.DeepEqual(got, []*GrpcServer{drained}) {
+			t.Errorf("procedure sent to %v, want %v", got, drained.address)
+		}
+	})
+
+	t.Run("Broadcast with merged responses", func(t *testing.T) {
+		broadcastTimeout = time.Minute
+		conn := &recordingConn{}
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+		route(ran, ngapType.ProcedureCodeRANConfigurationUpdate)
+		if got := sent(); !reflect.DeepEqual(got, []*GrpcServer{ready, drained}) {
+			t.Errorf("procedure sent to %v, want %v and %v", got, ready.address, drained.address)
+		}
+
+		failure := []byte("failure")
+		if !handleBroadcastOutcome(drained, ran, procedureMessage(ngapType.NGAPPDUPresentUnsuccessfulOutcome,
+			ngapType.ProcedureCodeRANConfigurationUpdate), failure) {
+			t.Errorf("response of backend %v passed on to the gNB", drained.address)
+		}
+		if len(conn.written) != 0 {
+			t.Fatalf("gNB answered before every backend did")
+		}
+		if !handleBroadcastOutcome(ready, ran, procedureMessage(ngapType.NGAPPDUPresentSuccessfulOutcome,
+			ngapType.ProcedureCodeRANConfigurationUpdate), []byte("acknowledge")) {
+			t.Errorf("response of backend %v passed on to the gNB", ready.address)
+		}
+		if len(conn.written) != 1 || !bytes.Equal(conn.written[0], failure) {
+			t.Errorf("gNB response mismatch. got = %q, want = %q", conn.written, failure)
+		}
+		if len(broadcasts) != 0 {
+			t.Errorf("broadcast still pending once answered")
+		}
+	})
+
+	t.Run("Broadcast waiting for room in a full queue", func(t *testing.T) {
+		broadcastTimeout = time.Minute
+		savedQueue := ready.queue
+		defer func() { ready.queue = savedQueue }()
+		ready.queue = newSendQueue(1, overflowBlock)
+		defer ready.queue.attach()()
+		conn := &recordingConn{}
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+		if err := ready.Send([]byte{0}, false, ran); err != nil {
+			t.Fatalf("Send() error: %v", err)
+		}
+		routed := make(chan bool, 1)
+		go func() {
+			ctx.Lock()
+			defer ctx.Unlock()
+			routed <- routeProcedure(ran, procedureMessage(ngapType.NGAPPDUPresentInitiatingMessage,
+				ngapType.ProcedureCodeRANConfigurationUpdate), []byte{1})
+		}()
+		select {
+		case <-routed:
+			t.Fatalf("procedure routed while the queue of backend %v is full", ready.address)
+		case <-time.After(50 * time.Millisecond):
+		}
+		acknowledge := []byte("acknowledge")
+		if !handleBroadcastOutcome(drained, ran, procedureMessage(ngapType.NGAPPDUPresentSuccessfulOutcome,
+			ngapType.ProcedureCodeRANConfigurationUpdate), acknowledge) {
+			t.Errorf("response of backend %v passed on to the gNB", drained.address)
+		}
+		if len(conn.written) != 0 {
+			t.Fatalf("gNB answered before the waiting backend did")
+		}
+
+		<-ready.queue.messages
+		select {
+		case ok := <-routed:
+			if !ok {
+				t.Fatalf("procedure not routed")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("procedure still waiting once the queue has room")
+		}
+		if len(ready.queue.messages) != 1 {
+			t.Errorf("procedure not queued to backend %v", ready.address)
+		}
+		sent()
+		if !handleBroadcastOutcome(ready, ran, procedureMessage(ngapType.NGAPPDUPresentSuccessfulOutcome,
+			ngapType.ProcedureCodeRANConfigurationUpdate), acknowledge) {
+			t.Errorf("response of backend %v passed on to the gNB", ready.address)
+		}
+		if len(conn.written) != 1 || !bytes.Equal(conn.written[0], acknowledge) {
+			t.Errorf("gNB response mismatch. got = %q, want = %q", conn.written, acknowledge)
+		}
+	})
+
+	t.Run("Broadcast answered once timed out", func(t *testing.T) {
+		broadcastTimeout = 50 * time.Millisecond
+		conn := &recordingConn{}
+		ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: conn, Log: logger.RanLog}
+		route(ran, ngapType.ProcedureCodeRANConfigurationUpdate)
+		sent()
+		acknowledge := []byte("acknowledge")
+		handleBroadcastOutcome(ready, ran, procedureMessage(ngapType.NGAPPDUPresentSuccessfulOutcome,
+			ngapType.ProcedureCodeRANConfigurationUpdate), acknowledge)
+		time.Sleep(10 * broadcastTimeout)
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		if len(conn.written) != 1 || !bytes.Equal(conn.written[0], acknowledge) {
+			t.Errorf("gNB response mismatch. got = %q, want = %q", conn.written, acknowledge)
+		}
+	})
+}
@@ -7,9 +7,10 @@ package backend
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"github.com/omec-project/ngap/ngapType"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/ishidawataru/sctp"
@@ -18,31 +19,76 @@ import (
 	"github.com/omec-project/sctplb/logger"
 )
 
-var next int
-
-type Backend interface {
-	State() bool
-	Send(msg []byte, b bool, ran *context.Ran) error
-}
+// dispatch modes
+const (
+	// every UE is scheduled on its own, its messages follow its sticky session
+	dispatchPerUE = "per-ue"
+	// every message of a gNB goes to the backend the gNB is assigned to
+	dispatchPerGnb = "per-gnb"
+)
 
-// returns the backendNF using RoundRobin algorithm
-func RoundRobin() Backend {
-	ctx := context.Sctplb_Self()
-	length := ctx.NFLength()
+var dispatchMode = dispatchPerUE
 
-	if length <= 0 {
-		logger.DispatchLog.Errorln("there are no backend NFs running")
-		return nil
+// SetDispatchMode selects whether UEs or whole gNBs are scheduled on backends
+func SetDispatchMode(name string) {
+	switch name {
+	case "", dispatchPerUE:
+		dispatchMode = dispatchPerUE
+	case dispatchPerGnb:
+		dispatchMode = dispatchPerGnb
+	default:
+		logger.DispatchLog.Warnf("unsupported dispatch mode %v, using %v", name, dispatchPerUE)
+		dispatchMode = dispatchPerUE
 	}
-	if next >= length {
-		next = 0
+	logger.DispatchLog.Infoln("dispatch mode:", dispatchMode)
+}
+
+// reachable returns true if the messages of the sticky UEs of a backend can
+// be sent to it: it is READY, DRAINING, or reconnecting after a short outage
+// and queueing them meanwhile
+func reachable(b Backend) bool {
+	if r, ok := b.(interface{ Reachable() bool }); ok {
+		return r.Reachable()
 	}
+	return b.State()
+}
+
+// drainer is implemented by the backends which can be drained: they take no
+// new UEs while their sticky UEs keep flowing
+type drainer interface {
+	Drain()
+	Undrain()
+	Draining() bool
+}
+
+// draining returns true if a backend takes no new UEs but still serves its
+// sticky ones
+func draining(b Backend) bool {
+	d, ok := b.(drainer)
+	return ok && d.Draining()
+}
+
+// stopper is implemented by the backends running goroutines which must end
+// once the backend is deleted
+type stopper interface {
+	stop()
+}
 
-	instance := ctx.Backends[next]
-	next++
-	return instance
+// inheritNotifier is implemented by the backends which can be told about the
+// UEs they inherited from a deleted backend
+type inheritNotifier interface {
+	NotifyInherited(ran *context.Ran, from string, ueIDs []string) error
 }
 
+type Backend interface {
+	State() bool
+	Send(msg []byte, b bool, ran *context.Ran) error
+	Address() string
+}
+
+// lookupIP resolves the URI of a backend service
+var lookupIP = net.LookupIP
+
 func (b BackendSvc) DispatchAddServer() {
 	// add server in pool
 	// create server
@@ -50,51 +96,72 @@ func (b BackendSvc) DispatchAddServer() {
 	// connect to server
 	// there can be more than 1 message outstanding toards same server
 	for {
-		ctx := context.Sctplb_Self()
-		svcList := b.Cfg.Configuration.Services
-		for _, svc := range svcList {
-			for {
-				logger.DiscoveryLog.Debugln("discover Service", svc.Uri)
-				ips, err := net.LookupIP(svc.Uri)
-				if err != nil {
-					logger.DiscoveryLog.Warnf("discover Service %s error %+v", svc.Uri, err)
-					time.Sleep(2 * time.Second)
+		for _, backend := range b.discoverServices() {
+			go backend.ConnectToServer(b.BackendPort())
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// BackendPort returns the port the backends are connected to: the gRPC port
+// of the grpc backends, the N2 port of the AMFs of the sctp backends
+func (b BackendSvc) BackendPort() int {
+	if b.Cfg.Configuration.Type != "sctp" {
+		return b.Cfg.Configuration.SctpGrpcPort
+	}
+	if b.Cfg.Configuration.N2Port > 0 {
+		return b.Cfg.Configuration.N2Port
+	}
+	return defaultN2Port
+}
+
+// discoverServices resolves every configured service once, adds the backends
+// of the IPv4 addresses not known yet to the pool, and returns them. A
+// service which can not be resolved is retried on the next discovery.
+func (b BackendSvc) discoverServices() []context.NF {
+	ctx := context.Sctplb_Self()
+	var added []context.NF
+	for _, svc := range b.Cfg.Configuration.Services {
+		logger.DiscoveryLog.Debugln("discover Service", svc.Uri)
+		ips, err := lookupIP(svc.Uri)
+		if err != nil {
+			logger.DiscoveryLog.Warnf("discover Service %s error %+v", svc.Uri, err)
+			continue
+		}
+		for _, ip := range ips {
+			logger.DiscoveryLog.Debugln("discover Service %s, ip %s", svc.Uri, ", ip", ip.String())
+			found := false
+			if ipv4 := ip.To4(); ipv4 != nil {
+				ctx.Lock()
+				for _, instance := range ctx.Backends {
+					if instance.Address() == ipv4.String() {
+						found = true
+						break
+					}
+				}
+				ctx.Unlock()
+				if found {
 					continue
 				}
-				for _, ip := range ips {
-					logger.DiscoveryLog.Debugln("discover Service %s, ip %s", svc.Uri, ", ip", ip.String())
-					found := false
-					if ipv4 := ip.To4(); ipv4 != nil {
-						for _, instance := range ctx.Backends {
-							b := instance.(*GrpcServer)
-							if b.address == ipv4.String() {
-								found = true
-								break
-							}
-						}
-						if found {
-							continue
-						}
-						logger.DiscoveryLog.Infoln("new server found IPv4:", ipv4.String())
-						var backend context.NF
-						switch b.Cfg.Configuration.Type {
-						case "grpc":
-							backend = &GrpcServer{
-								address: ipv4.String(),
-							}
-						default:
-							logger.DiscoveryLog.Warnln("unsupported backend type:", b.Cfg.Configuration.Type)
-						}
-						ctx.Lock()
-						ctx.AddNF(backend)
-						ctx.Unlock()
-						go backend.ConnectToServer(b.Cfg.Configuration.SctpGrpcPort)
-					}
+				logger.DiscoveryLog.Infoln("new server found IPv4:", ipv4.String())
+				var backend context.NF
+				switch b.Cfg.Configuration.Type {
+				case "grpc":
+					backend = newGrpcServer(ipv4.String(), svc)
+				case "sctp":
+					backend = newSctpServer(ipv4.String(), svc)
+				default:
+					logger.DiscoveryLog.Warnln("unsupported backend type:", b.Cfg.Configuration.Type)
+					continue
 				}
+				ctx.Lock()
+				ctx.AddNF(backend)
+				ctx.Unlock()
+				added = append(added, backend)
 			}
 		}
-		time.Sleep(2 * time.Second)
 	}
+	return added
 }
 
 func deleteBackendNF(b context.NF) {
@@ -102,9 +169,73 @@ func deleteBackendNF(b context.NF) {
 	ctx.Lock()
 	defer ctx.Unlock()
 	ctx.DeleteNF(b)
+	if s, ok := b.(stopper); ok {
+		s.stop()
+	}
 	for _, b1 := range ctx.Backends {
 		logger.AppLog.Infof("available backend %v", b1)
 	}
+	ctx.RanPool.Range(func(key, value any) bool {
+		ran := value.(*context.Ran)
+		if ran.Backend == b {
+			ran.Backend = nil
+		}
+		return true
+	})
+	failoverStickySessions(b)
+	forgetOverload(b)
+	if localNGSetup {
+		announceNGSetup()
+	}
+}
+
+// failoverStickySessions applies the failover policy to the sticky sessions
+// of a deleted backend: they are either dropped, or all moved to one
+// replacement backend which is told which UEs it inherited. Caller must hold
+// the context lock.
+func failoverStickySessions(b Backend) {
+	var replacement Backend
+	if failoverPolicy == failoverRepin {
+		replacement = scheduler.Select(nil, nil, context.Sctplb_Self().Backends)
+		if replacement == nil {
+			logger.DispatchLog.Warnf("no backend available to inherit sticky sessions of %v", b.Address())
+		}
+	}
+
+	var to string
+	if replacement != nil {
+		to = replacement.Address()
+	}
+	keys := stickySessions.Reassign(b.Address(), to)
+	if len(keys) == 0 {
+		return
+	}
+	if replacement == nil {
+		logger.DispatchLog.Infof("dropped %d sticky sessions of backend %v", len(keys), b.Address())
+		return
+	}
+	logger.DispatchLog.Infof("moved %d sticky sessions of backend %v to %v", len(keys), b.Address(), replacement.Address())
+
+	notifier, ok := replacement.(inheritNotifier)
+	if !ok {
+		return
+	}
+	context.Sctplb_Self().RanPool.Range(func(key, value any) bool {
+		ran := value.(*context.Ran)
+		prefix := getRanID(ran) + "_"
+		var ueIDs []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				ueIDs = append(ueIDs, strings.TrimPrefix(k, prefix))
+			}
+		}
+		if len(ueIDs) > 0 {
+			if err := notifier.NotifyInherited(ran, b.Address(), ueIDs); err != nil {
+				logger.DispatchLog.Errorln("can not send inherited UEs:", err)
+			}
+		}
+		return true
+	})
 }
 
 func dispatchMessage(conn *sctp.SCTPConn, msg []byte) {
@@ -143,15 +274,16 @@ func dispatchMessage(conn *sctp.SCTPConn, msg []byte) {
 		} else {
 			logger.SctpLog.Errorln("no AMF Connections")
 		}
-		context.Sctplb_Self().DeleteRan(conn)
+		if ran != nil {
+			releaseRan(ran)
+		} else {
+			context.Sctplb_Self().DeleteRan(conn)
+		}
 		return
 	}
 	if ran == nil {
 		ran = context.Sctplb_Self().NewRan(conn)
-	}
-	if ctx.NFLength() == 0 {
-		logger.AppLog.Errorln("no backend available")
-		return
+		restoreRanId(ran)
 	}
 
 	ran.Log.Infoln("Trying to decode the message ...")
@@ -159,13 +291,11 @@ func dispatchMessage(conn *sctp.SCTPConn, msg []byte) {
 	if err != nil {
 		ran.Log.Errorf("NGAP decode error: %+v", err)
 		logger.SctpLog.Infoln("dispatchLb, decode message error")
-	}
-
-	if stickySessions == nil {
-		logger.SctpLog.Errorln(fmt.Errorf("stickySessions is nil"))
+		ueMsg = nil
 	}
 
 	var ngapID *ngapType.RANUENGAPID = nil
+	var amfUeNgapID *ngapType.AMFUENGAPID = nil
 	if err == nil {
 		ngapID = extractUEIdentifier(ueMsg)
 		if ngapID != nil {
@@ -173,18 +303,56 @@ func dispatchMessage(conn *sctp.SCTPConn, msg []byte) {
 		} else {
 			logger.SctpLog.Infof("NGAP ID NOT FOUND FROM PDU")
 		}
+		amfUeNgapID = extractAMFUEIdentifier(ueMsg)
+		learnRanPlmn(ran, ueMsg)
+		learnRanTAs(ran, ueMsg)
+		learnRanSetup(ran, ueMsg, msg)
+	}
+	if ctx.NFLength() == 0 {
+		logger.AppLog.Errorln("no backend available")
+		rejectUnroutable(ran, ueMsg)
+		return
+	}
+	if err == nil {
+		if localNGSetup && isLocalNGSetupRequest(ran, ueMsg) {
+			return
+		}
+	}
+
+	if dispatchMode == dispatchPerGnb {
+		backend := ranBackend(ran)
+		if backend == nil {
+			logger.AppLog.Errorln("no backend in READY state")
+			rejectUnroutable(ran, ueMsg)
+			return
+		}
+		if err := sendDispatched(backend, ran, msg); err != nil {
+			logger.SctpLog.Errorln("can not send:", err)
+		}
+		return
+	}
+
+	if err == nil && handleUplinkNGReset(ran, ueMsg, msg) {
+		return
+	}
+	if err == nil && ngapID == nil && amfUeNgapID == nil && routeProcedure(ran, ueMsg, msg) {
+		return
 	}
 
-	// protected by ctx.lock, so safe to access map
-	if ngapID != nil {
-		key := fmt.Sprintf("%v_%v", getRanID(ran), ngapID)
-		logger.SctpLog.Infof("NGAPID not nil, trying to find sticky session with key %v", key)
-		backend, found := stickySessions[key]
-		if found && backend.State() {
-			logger.SctpLog.Infof("Sending key: %v to the sticky backend", key)
-			if err := backend.Send(msg, false, ran); err != nil {
+	if ngapID != nil || amfUeNgapID != nil {
+		logger.SctpLog.Infof("UE identifier found, trying to find sticky session of RAN-UE-NGAP-ID %v AMF-UE-NGAP-ID %v",
+			ngapID, amfUeNgapID)
+		backend, found := lookupStickySession(ran, ngapID, amfUeNgapID)
+		if found && reachable(backend) {
+			logger.SctpLog.Infoln("Sending message to the sticky backend")
+			if err := sendDispatched(backend, ran, msg); err != nil {
 				logger.SctpLog.Errorln("can not send:", err)
 			}
+			if ngapID != nil {
+				// UE known only by its AMF-UE-NGAP-ID so far, e.g. handover target
+				pinStickySession(stickyKey(ran, ngapID), backend)
+			}
+			evictReleasedStickySessions(ran, ueMsg, ngapID)
 			return
 		}
 		if !found {
@@ -194,24 +362,160 @@ func dispatchMessage(conn *sctp.SCTPConn, msg []byte) {
 		}
 	}
 
-	var i int
-	for ; i < ctx.NFLength(); i++ {
-		// Select the backend NF based on RoundRobin Algorithm
-		backend := RoundRobin()
-		if !backend.State() {
-			continue
+	var hint *ngapType.NGAPPDU
+	if err == nil {
+		hint = ueMsg
+	}
+	backend, candidates := selectBackend(ran, hint, ngapID)
+	if backend == nil {
+		logger.AppLog.Errorln("no backend in READY state")
+		rejectUnroutable(ran, ueMsg)
+		return
+	}
+	backend = sendRerouting(backend, ran, ngapID, candidates, msg)
+	if backend != nil && ngapID != nil {
+		key := stickyKey(ran, ngapID)
+		logger.SctpLog.Infof("Saving key: %v for backend\n", key)
+		stickySessions.Put(key, backend.Address())
+	}
+	if err == nil {
+		evictReleasedStickySessions(ran, ueMsg, ngapID)
+	}
+}
+
+// selectBackend returns the backend a message of a UE without sticky session
+// is scheduled on, and the candidates it may be rerouted to. ranMsg is nil
+// for a message which could not be decoded. Without sticky sessions only the
+// PLMN pool and the scheduler decide, as they do for every message of the UE.
+// Caller must hold the context lock.
+func selectBackend(ran *context.Ran, ranMsg *ngapType.NGAPPDU, ngapID *ngapType.RANUENGAPID) (Backend, []context.NF) {
+	// only the backends serving the PLMN of the gNB
+	pool := plmnPool(ran, context.Sctplb_Self().Backends)
+	if stickyDisabled {
+		return scheduler.Select(ran, ngapID, pool), pool
+	}
+	// and among them the ones serving the UE's slice, and not shedding the
+	// load of the UE
+	var ue string
+	if ran != nil && ngapID != nil {
+		ue = stickyKey(ran, ngapID)
+	}
+	candidates := overloadPool(ranMsg, slicePool(ranMsg, pool), ue)
+	if ranMsg != nil {
+		// registered UE, go back to the AMF which allocated its 5G-S-TMSI
+		if backend := guamiBackend(ranMsg, pool); backend != nil {
+			logger.SctpLog.Infof("5G-S-TMSI served by backend %v", backend.Address())
+			return backend, candidates
 		}
+	}
+	// Select the backend NF based on the configured scheduler
+	return scheduler.Select(ran, ngapID, candidates), candidates
+}
 
-		if err := backend.Send(msg, false, ran); err != nil {
-			logger.SctpLog.Errorln("can not send:", err)
+// waitingSender is implemented by the backends whose full send queue can be
+// waited on
+type waitingSender interface {
+	// waitsForRoom returns true if the overflow policy of the queue is block
+	waitsForRoom() bool
+	sendWait(msg []byte, ran *context.Ran) error
+}
+
+// sendDispatched sends a message of a gNB to backend. When the send queue of
+// the backend is full and the overflow policy is block, the context lock is
+// released while the message waits for room, so that only the gNB of the
+// message waits and the other gNBs keep being dispatched. Caller must hold
+// the context lock.
+func sendDispatched(backend Backend, ran *context.Ran, msg []byte) error {
+	err := backend.Send(msg, false, ran)
+	if !waitsForRoom(backend, err) {
+		return err
+	}
+	return sendWaiting(backend, ran, msg)
+}
+
+// waitsForRoom returns true if a message failing to be sent to backend with
+// err can wait for room in the send queue of the backend
+func waitsForRoom(backend Backend, err error) bool {
+	waiter, ok := backend.(waitingSender)
+	return errors.Is(err, errQueueFull) && ok && waiter.waitsForRoom()
+}
+
+// sendWaiting sends a message of a gNB to a backend whose send queue is full
+// and whose overflow policy is block, releasing the context lock while the
+// message waits for room. Callers sending a message several backends answer
+// record the message as sent before, so that no answer arrives unexpected
+// while the lock is released. Caller must hold the context lock.
+func sendWaiting(backend Backend, ran *context.Ran, msg []byte) error {
+	ctx := context.Sctplb_Self()
+	ctx.Unlock()
+	defer ctx.Lock()
+	return backend.(waitingSender).sendWait(msg, ran)
+}
+
+// sendRerouting sends a message to backend, or when the send queue of the
+// backend is full and the overflow policy is reroute, or the backend has no
+// writer to make room, to the backend the scheduler selects among the other
+// candidates. Returns the backend which took the message, nil if every queue
+// was full. Caller must hold the context lock.
+func sendRerouting(backend Backend, ran *context.Ran, ngapID *ngapType.RANUENGAPID,
+	candidates []context.NF, msg []byte,
+) Backend {
+	for {
+		err := sendDispatched(backend, ran, msg)
+		if err == nil {
+			return backend
 		}
-		if ngapID != nil {
-			key := fmt.Sprintf("%v_%v", getRanID(ran), ngapID)
-			logger.SctpLog.Infof("Saving key: %v for backend\n", key)
-			stickySessions[key] = backend
+		logger.SctpLog.Errorln("can not send:", err)
+		if !errors.Is(err, errQueueFull) {
+			return backend
+		}
+		others := make([]context.NF, 0, len(candidates))
+		for _, candidate := range candidates {
+			if candidate != backend {
+				others = append(others, candidate)
+			}
+		}
+		candidates = others
+		full := backend
+		if backend = scheduler.Select(ran, ngapID, candidates); backend == nil {
+			logger.SctpLog.Errorln("send queues of every backend full, message dropped")
+			return nil
 		}
-		break
+		logger.SctpLog.Infof("rerouting message from backend %v to %v", full.Address(), backend.Address())
+	}
+}
+
+// ranBackend returns the backend a RAN is assigned to in per-gNB dispatch
+// mode, assigning it to a new one on its first message or once its backend is
+// neither READY nor DRAINING. Caller must hold the context lock.
+func ranBackend(ran *context.Ran) Backend {
+	if ran.Backend != nil && (ran.Backend.State() || draining(ran.Backend)) {
+		return ran.Backend
+	}
+	backend := scheduler.Select(ran, nil, plmnPool(ran, context.Sctplb_Self().Backends))
+	if backend == nil {
+		return nil
+	}
+	if ran.Backend != nil {
+		ran.Log.Infof("backend %v not ready, reassigned to backend %v", ran.Backend.Address(), backend.Address())
+	} else {
+		ran.Log.Infof("assigned to backend %v", backend.Address())
 	}
+	ran.Backend = backend.(context.NF)
+	return backend
+}
+
+// releaseRan drops the RAN context of a closed gNB association together with
+// the sticky sessions of its UEs. Caller must hold the context lock.
+func releaseRan(ran *context.Ran) {
+	if count := evictRanStickySessions(ran); count > 0 {
+		ran.Log.Infof("evicted %d sticky sessions", count)
+	}
+	forgetNGSetup(ran)
+	forgetNGReset(ran)
+	forgetBroadcasts(ran)
+	forgetRanOverload(ran)
+	ran.Remove()
 }
 
 func handleNotification(conn *sctp.SCTPConn, notificationData []byte) {
@@ -230,6 +534,9 @@ func handleNotification(conn *sctp.SCTPConn, notificationData []byte) {
 		return
 	}
 
+	sctplbSelf.Lock()
+	defer sctplbSelf.Unlock()
+
 	// Clean up stale connections in SctplbRanPool
 	sctplbSelf.RanPool.Range(func(key, value any) bool {
 		amfRan := value.(*context.Ran)
@@ -285,10 +592,10 @@ func handleNotification(conn *sctp.SCTPConn, notificationData []byte) {
 		switch state {
 		case sctp.SCTP_COMM_LOST:
 			ran.Log.Infoln("SCTP state is SCTP_COMM_LOST, close the connection")
-			ran.Remove()
+			releaseRan(ran)
 		case sctp.SCTP_SHUTDOWN_COMP:
 			ran.Log.Infoln("SCTP state is SCTP_SHUTDOWN_COMP, close the connection")
-			ran.Remove()
+			releaseRan(ran)
 		case sctp.SCTP_COMM_UP:
 			ran.Log.Infoln("SCTP association is up")
 		case sctp.SCTP_RESTART:
@@ -299,7 +606,7 @@ func handleNotification(conn *sctp.SCTPConn, notificationData []byte) {
 
 	case sctp.SCTP_SHUTDOWN_EVENT:
 		ran.Log.Infoln("SCTP_SHUTDOWN_EVENT notification, close the connection")
-		ran.Remove()
+		releaseRan(ran)
 
 	case sctp.SCTP_PEER_ADDR_CHANGE:
 		ran.Log.Infoln("SCTP_PEER_ADDR_CHANGE notification")
@@ -5,10 +5,19 @@
 package backend
 
 import (
+	"errors"
+	"net"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
 	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
 )
 
 func initBackendNF() {
@@ -36,8 +45,10 @@ func initBackendNF() {
 }
 
 func Test_RoundRobin(t *testing.T) {
-	ctx := context.Sctplb_Self()
-	initBackendNF()
+	var backends []context.NF
+	for _, address := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.0.5"} {
+		backends = append(backends, &GrpcServer{address: address, state: stateReady})
+	}
 
 	tests := []struct {
 		name string
@@ -45,54 +56,55 @@ func Test_RoundRobin(t *testing.T) {
 	}{
 		{
 			name: "Get BackendNF - 1",
-			want: ctx.Backends[0].(*GrpcServer),
+			want: backends[0].(*GrpcServer),
 		},
 		{
 			name: "Get BackendNF - 2",
-			want: ctx.Backends[1].(*GrpcServer),
+			want: backends[1].(*GrpcServer),
 		},
 		{
 			name: "Get BackendNF - 3",
-			want: ctx.Backends[2].(*GrpcServer),
+			want: backends[2].(*GrpcServer),
 		},
 		{
 			name: "Get BackendNF - 4",
-			want: ctx.Backends[3].(*GrpcServer),
+			want: backends[3].(*GrpcServer),
 		},
 		{
 			name: "Get BackendNF - 5",
-			want: ctx.Backends[4].(*GrpcServer),
+			want: backends[4].(*GrpcServer),
 		},
 		{
 			name: "Get BackendNF - 6",
-			want: ctx.Backends[0].(*GrpcServer),
+			want: backends[0].(*GrpcServer),
 		},
 	}
 
+	s := &roundRobinScheduler{}
 	for _, tt := range tests {
 		t.Run(
 			tt.name, func(t *testing.T) {
-				instance := RoundRobin()
+				instance := s.Select(nil, nil, backends)
 				got := instance.(*GrpcServer)
 				if got.address != tt.want.address {
-					t.Errorf("RoundRobin() address mismatch. got = %q, want = %q", got.address, tt.want.address)
+					t.Errorf("Select() address mismatch. got = %q, want = %q", got.address, tt.want.address)
 				}
 
 				if got.state != tt.want.state {
-					t.Errorf("RoundRobin() state mismatch. got = %v, want = %v", got.state, tt.want.state)
+					t.Errorf("Select() state mismatch. got = %v, want = %v", got.state, tt.want.state)
 				}
 
 				// For conn, gc, stream - check if they're both nil or both non-nil
 				if (got.conn == nil) != (tt.want.conn == nil) {
-					t.Errorf("RoundRobin() conn nil mismatch. got nil = %v, want nil = %v", got.conn == nil, tt.want.conn == nil)
+					t.Errorf("Select() conn nil mismatch. got nil = %v, want nil = %v", got.conn == nil, tt.want.conn == nil)
 				}
 
 				if (got.gc == nil) != (tt.want.gc == nil) {
-					t.Errorf("RoundRobin() gc nil mismatch. got nil = %v, want nil = %v", got.gc == nil, tt.want.gc == nil)
+					t.Errorf("Select() gc nil mismatch. got nil = %v, want nil = %v", got.gc == nil, tt.want.gc == nil)
 				}
 
 				if (got.stream == nil) != (tt.want.stream == nil) {
-					t.Errorf("RoundRobin() stream nil mismatch. got nil = %v, want nil = %v", got.stream == nil, tt.want.stream == nil)
+					t.Errorf("Select() stream nil mismatch. got nil = %v, want nil = %v", got.stream == nil, tt.want.stream == nil)
 				}
 			},
 		)
@@ -131,3 +143,389 @@ func Test_Iterate(t *testing.T) {
 		)
 	}
 }
+
+func Test_RanBackend(t *testing.T) {
+	ctx := context.Sctplb_Self()
+	saved := scheduler
+	defer func() { scheduler = saved }()
+	scheduler = &roundRobinScheduler{}
+
+	first := &GrpcServer{address: "127.0.0.201", state: stateReady}
+	second := &GrpcServer{address: "127.0.0.202", state: stateReady}
+	ctx.AddNF(first)
+	ctx.AddNF(second)
+	defer ctx.DeleteNF(first)
+	defer ctx.DeleteNF(second)
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412", Log: logger.RanLog}
+	ctx.RanPool.Store("ran-backend-test", ran)
+	defer ctx.RanPool.Delete("ran-backend-test")
+
+	var assigned Backend
+	tests := []struct {
+		name   string
+		update func()
+		want   func() Backend
+	}{
+		{
+			name:   "Assigned on first message",
+			update: func() {},
+			want:   func() Backend { return ran.Backend },
+		},
+		{
+			name:   "Same backend for later messages",
+			update: func() { assigned = ran.Backend },
+			want:   func() Backend { return assigned },
+		},
+		{
+			name: "Reassigned when the backend is not ready",
+			update: func() {
+				first.state = stateConnecting
+				second.state = stateConnecting
+				if assigned == first {
+					second.state = stateReady
+				} else {
+					first.state = stateReady
+				}
+			},
+			want: func() Backend {
+				if assigned == first {
+					return second
+				}
+				return first
+			},
+		},
+		{
+			name: "Kept while the backend is draining",
+			update: func() {
+				first.state = stateReady
+				second.state = stateReady
+				assigned = ran.Backend
+				assigned.(*GrpcServer).state = stateDraining
+			},
+			want: func() Backend { return assigned },
+		},
+		{
+			name: "Reassigned when the backend is deleted",
+			update: func() {
+				first.state = stateReady
+				second.state = stateReady
+				assigned = ran.Backend
+				deleteBackendNF(ran.Backend)
+			},
+			want: func() Backend {
+				if assigned == first {
+					return second
+				}
+				return first
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				tt.update()
+				got := ranBackend(ran)
+				if got == nil || got != tt.want() {
+					t.Errorf("ranBackend() mismatch. got = %v, want = %v", got, tt.want())
+				}
+				if ran.Backend != got {
+					t.Errorf("Ran.Backend not updated. got = %v, want = %v", ran.Backend, got)
+				}
+			},
+		)
+	}
+}
+
+func Test_FailoverStickySessions(t *testing.T) {
+	savedPolicy, savedSessions := failoverPolicy, stickySessions
+	defer func() { failoverPolicy, stickySessions = savedPolicy, savedSessions }()
+
+	tests := []struct {
+		name   string
+		policy string
+		// the sessions of the deleted backend are moved to the survivor
+		wantInherited bool
+	}{
+		{
+			name:   "Dropped",
+			policy: failoverDrop,
+		},
+		{
+			name:          "Moved to the survivor",
+			policy:        failoverRepin,
+			wantInherited: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				failoverPolicy = tt.policy
+				stickySessions = newMemoryStore(time.Minute, 0)
+				ctx := context.Sctplb_Self()
+				deleted := setupBackend(stateReady, nil)
+				survivor := setupBackend(stateReady, nil)
+				survivor.address = "127.0.0.2"
+				ctx.Lock()
+				ctx.AddNF(deleted)
+				ctx.AddNF(survivor)
+				ran := ctx.NewRan(&recordingConn{})
+				ran.SetRanId("gnb-1")
+				ctx.Unlock()
+				defer ran.Remove()
+				defer deleteBackendNF(survivor)
+
+				ranUE := stickyKey(ran, &ngapType.RANUENGAPID{Value: 1})
+				amfUE := amfStickyKey(ran, &ngapType.AMFUENGAPID{Value: 7})
+				ownUE := stickyKey(ran, &ngapType.RANUENGAPID{Value: 2})
+				stickySessions.Put(ranUE, deleted.address)
+				stickySessions.Put(amfUE, deleted.address)
+				stickySessions.Put(ownUE, survivor.address)
+
+				deleteBackendNF(deleted)
+
+				want := ""
+				if tt.wantInherited {
+					want = survivor.address
+				}
+				for _, key := range []string{ranUE, amfUE} {
+					if got, _ := stickySessions.Get(key); got != want {
+						t.Errorf("sticky session %v mismatch. got = %q, want = %q", key, got, want)
+					}
+				}
+				if got, _ := stickySessions.Get(ownUE); got != survivor.address {
+					t.Errorf("sticky session of the survivor mismatch. got = %q, want = %q", got, survivor.address)
+				}
+
+				if !tt.wantInherited {
+					if len(survivor.queue.messages) != 0 {
+						t.Errorf("survivor was sent %d messages, want none", len(survivor.queue.messages))
+					}
+					return
+				}
+				// the survivor is told which UEs of the gNB it inherited
+				if len(survivor.queue.messages) != 1 {
+					t.Fatalf("survivor was sent %d messages, want the inherited UEs", len(survivor.queue.messages))
+				}
+				hint := <-survivor.queue.messages
+				if hint.Msgtype != gClient.MsgType_GNB_MSG || len(hint.Msg) != 0 || hint.GnbId != "gnb-1" {
+					t.Errorf("inherited UEs hint mismatch: %+v", hint)
+				}
+				prefix := "Inherited UEs from " + deleted.address + ": "
+				ueIDs, found := strings.CutPrefix(hint.VerboseMsg, prefix)
+				if !found {
+					t.Fatalf("inherited UEs hint %q does not start with %q", hint.VerboseMsg, prefix)
+				}
+				got := strings.Split(ueIDs, ",")
+				sort.Strings(got)
+				if want := []string{"1", "amf_7"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("inherited UEs mismatch. got = %v, want = %v", got, want)
+				}
+			},
+		)
+	}
+}
+
+func Test_SelectBackendWithoutStickySessions(t *testing.T) {
+	savedScheduler, savedSessions := scheduler, stickySessions
+	defer func() {
+		scheduler, stickySessions, stickyDisabled = savedScheduler, savedSessions, false
+		overloads = make(map[Backend]*amfOverload)
+	}()
+	scheduler = &consistentHashScheduler{}
+	stickySessions, stickyDisabled = noStore{}, true
+
+	ctx := context.Sctplb_Self()
+	first := setupBackend(stateReady, nil)
+	second := setupBackend(stateReady, nil)
+	second.address = "127.0.0.2"
+	ctx.Lock()
+	defer ctx.Unlock()
+	ctx.AddNF(first)
+	ctx.AddNF(second)
+	defer ctx.DeleteNF(first)
+	defer ctx.DeleteNF(second)
+	// steering the InitialUEMessage around the overload would send the later
+	// messages of the UE elsewhere
+	overloads = map[Backend]*amfOverload{first: {reduction: 100}}
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412", Log: logger.RanLog}
+
+	placed := make(map[Backend]int)
+	for i := 0; i < 200; i++ {
+		ngapID := &ngapType.RANUENGAPID{Value: int64(i)}
+		owner, _ := selectBackend(ran, initialUEMessageFor(ngapType.RRCEstablishmentCausePresentMoData), ngapID)
+		placed[owner]++
+		// the later messages of the UE go to the backend of its first one
+		for j := 0; j < 4; j++ {
+			if got, _ := selectBackend(ran, nil, ngapID); got != owner {
+				t.Fatalf("message %d of UE %d sent to %v, want %v", j, i, got.Address(), owner.Address())
+			}
+		}
+	}
+	if placed[first] == 0 || placed[second] == 0 {
+		t.Errorf("%d UEs placed on the first backend and %d on the second, want both used", placed[first], placed[second])
+	}
+}
+
+// discoverTestServices discovers services whose URIs resolve through
+// resolved, and returns the backends added to sctplb
+func discoverTestServices(t *testing.T, resolved map[string]string, services ...config.Service) []context.NF {
+	saved := lookupIP
+	t.Cleanup(func() { lookupIP = saved })
+	lookupIP = func(host string) ([]net.IP, error) {
+		ip, ok := resolved[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP(ip)}, nil
+	}
+
+	b := BackendSvc{Cfg: config.Config{Configuration: &config.Configuration{Type: "grpc", Services: services}}}
+	added := b.discoverServices()
+	t.Cleanup(func() {
+		ctx := context.Sctplb_Self()
+		ctx.Lock()
+		defer ctx.Unlock()
+		for _, instance := range added {
+			ctx.DeleteNF(instance)
+		}
+	})
+	return added
+}
+
+func Test_DiscoverServicesSlices(t *testing.T) {
+	added := discoverTestServices(t,
+		map[string]string{"amf-embb": "127.0.0.21", "amf-urllc": "127.0.0.22"},
+		config.Service{Uri: "amf-unresolved"},
+		config.Service{Uri: "amf-embb", Snssais: []config.Snssai{{Sst: 1}}},
+		config.Service{Uri: "amf-urllc", Snssais: []config.Snssai{{Sst: 2}}},
+	)
+	if got, want := addresses(added), []string{"127.0.0.21", "127.0.0.22"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("discovered backends mismatch. got = %v, want = %v", got, want)
+	}
+
+	tests := []struct {
+		name string
+		msg  *ngapType.NGAPPDU
+		want []string
+	}{
+		{
+			name: "Slice of the first service",
+			msg:  withAllowedNSSAI(initialUEMessage(nil), snssai(1, nil)),
+			want: []string{"127.0.0.21"},
+		},
+		{
+			name: "Slice of the second service",
+			msg:  withAllowedNSSAI(initialUEMessage(nil), snssai(2, nil)),
+			want: []string{"127.0.0.22"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if got := addresses(slicePool(tt.msg, added)); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("slicePool() mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+
+	// already known backends are not added again
+	if again := discoverTestServices(t, map[string]string{"amf-embb": "127.0.0.21"},
+		config.Service{Uri: "amf-embb"}); len(again) != 0 {
+		t.Errorf("rediscovered backends %v, want none", addresses(again))
+	}
+}
+
+func Test_DiscoverServicesPlmns(t *testing.T) {
+	added := discoverTestServices(t,
+		map[string]string{"amf-operator-a": "127.0.0.23", "amf-operator-b": "127.0.0.24"},
+		config.Service{Uri: "amf-operator-a", PlmnIds: []config.PlmnId{{Mcc: "208", Mnc: "93"}}},
+		config.Service{Uri: "amf-operator-b", PlmnIds: []config.PlmnId{{Mcc: "310", Mnc: "410"}}},
+	)
+
+	tests := []struct {
+		name string
+		msg  *ngapType.NGAPPDU
+		want []string
+	}{
+		{
+			name: "PLMN of the first service",
+			msg:  ngSetupRequest([]byte{0x02, 0xf8, 0x39}),
+			want: []string{"127.0.0.23"},
+		},
+		{
+			name: "PLMN of the second service",
+			msg:  ngSetupRequest([]byte{0x13, 0x40, 0x01}),
+			want: []string{"127.0.0.24"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				ran := &context.Ran{GnbIp: "10.0.0.1:38412", Log: logger.RanLog}
+				learnRanPlmn(ran, tt.msg)
+				if got := addresses(plmnPool(ran, added)); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("plmnPool() mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_DiscoverServicesWeights(t *testing.T) {
+	added := discoverTestServices(t,
+		map[string]string{"amf-large": "127.0.0.25", "amf-small": "127.0.0.26"},
+		config.Service{Uri: "amf-large", Weight: 3},
+		config.Service{Uri: "amf-small", Weight: 1},
+	)
+	for _, instance := range added {
+		instance.(*GrpcServer).state = stateReady
+	}
+
+	counts := make(map[string]int)
+	for _, address := range selectN(&weightedRoundRobinScheduler{}, added, 400) {
+		counts[address]++
+	}
+	if want := map[string]int{"127.0.0.25": 300, "127.0.0.26": 100}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("selections mismatch. got = %v, want = %v", counts, want)
+	}
+}
+
+func Test_BackendPort(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Configuration
+		want int
+	}{
+		{
+			name: "gRPC backends",
+			cfg:  config.Configuration{Type: "grpc", SctpGrpcPort: 5000},
+			want: 5000,
+		},
+		{
+			name: "AMFs on the default N2 port",
+			cfg:  config.Configuration{Type: "sctp", SctpGrpcPort: 5000},
+			want: 38412,
+		},
+		{
+			name: "AMFs on a configured N2 port",
+			cfg:  config.Configuration{Type: "sctp", SctpGrpcPort: 5000, N2Port: 38413},
+			want: 38413,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				b := BackendSvc{Cfg: config.Config{Configuration: &tt.cfg}}
+				if got := b.BackendPort(); got != tt.want {
+					t.Errorf("BackendPort() = %d, want %d", got, tt.want)
+				}
+			},
+		)
+	}
+}
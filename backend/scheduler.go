@@ -0,0 +1,276 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"math/rand/v2"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// scheduling policies selecting the backend of a new UE
+const (
+	schedRoundRobin         = "round-robin"
+	schedWeightedRoundRobin = "weighted-round-robin"
+	schedLeastActiveUEs     = "least-active-ues"
+	schedLeastInFlight      = "least-in-flight"
+	schedPowerOfTwoChoices  = "power-of-two-choices"
+	schedConsistentHash     = "consistent-hash"
+)
+
+// Scheduler selects the backend of a message which has no sticky session.
+// Schedulers are called with the context lock held.
+type Scheduler interface {
+	// Select returns one of the backends in READY state, nil if there is none.
+	// ran and ngapID are nil when the selection is not for a gNB message.
+	Select(ran *context.Ran, ngapID *ngapType.RANUENGAPID, backends []context.NF) Backend
+}
+
+var scheduler Scheduler = &roundRobinScheduler{}
+
+// weighted is implemented by the backends which have a scheduling weight
+type weighted interface {
+	Weight() int
+}
+
+// inFlightReporter is implemented by the backends which count the messages
+// they have not finished sending
+type inFlightReporter interface {
+	InFlight() int
+}
+
+// SetScheduler selects the scheduling policy used for new UEs
+func SetScheduler(name string) {
+	switch name {
+	case "", schedRoundRobin:
+		name = schedRoundRobin
+		scheduler = &roundRobinScheduler{}
+	case schedWeightedRoundRobin:
+		scheduler = &weightedRoundRobinScheduler{}
+	case schedLeastActiveUEs:
+		scheduler = &leastActiveUEsScheduler{}
+	case schedLeastInFlight:
+		scheduler = &leastInFlightScheduler{}
+	case schedPowerOfTwoChoices:
+		scheduler = &powerOfTwoChoicesScheduler{intN: rand.IntN}
+	case schedConsistentHash:
+		scheduler = &consistentHashScheduler{}
+	default:
+		logger.DispatchLog.Warnf("unsupported scheduler %v, using %v", name, schedRoundRobin)
+		name = schedRoundRobin
+		scheduler = &roundRobinScheduler{}
+	}
+	logger.DispatchLog.Infoln("scheduler:", name)
+}
+
+// readyBackends returns the backends in READY state
+func readyBackends(backends []context.NF) []Backend {
+	ready := make([]Backend, 0, len(backends))
+	for _, instance := range backends {
+		if instance.State() {
+			ready = append(ready, instance)
+		}
+	}
+	return ready
+}
+
+// roundRobinScheduler takes the backends in turn, skipping the ones which
+// are not READY
+type roundRobinScheduler struct {
+	next int
+}
+
+func (s *roundRobinScheduler) Select(_ *context.Ran, _ *ngapType.RANUENGAPID, backends []context.NF) Backend {
+	for range backends {
+		if s.next >= len(backends) {
+			s.next = 0
+		}
+		instance := backends[s.next]
+		s.next++
+		if instance.State() {
+			return instance
+		}
+	}
+	return nil
+}
+
+// weightedRoundRobinScheduler spreads the UEs over the backends in
+// proportion to their weights, interleaving them instead of sending bursts to
+// the heaviest one. Backends with an unknown weight get the average of the
+// known weights. The PLMN, slice, overload and reroute pools of different
+// sizes interleave, so the current weights are kept per backend of each pool,
+// and dropped once one of its backends is deleted.
+type weightedRoundRobinScheduler struct {
+	pools map[string]*weightedPool // by the backends of the pool
+}
+
+type weightedPool struct {
+	backends       []context.NF
+	currentWeights map[Backend]int
+}
+
+// pool returns the current weights of a pool of backends, starting them the
+// first time the pool is seen
+func (s *weightedRoundRobinScheduler) pool(backends []context.NF) *weightedPool {
+	s.forgetDeleted()
+	members := poolKey(backends)
+	if pool, found := s.pools[members]; found {
+		return pool
+	}
+	if s.pools == nil || len(s.pools) >= maxHashRings {
+		s.pools = make(map[string]*weightedPool)
+	}
+	pool := &weightedPool{
+		backends:       append([]context.NF(nil), backends...),
+		currentWeights: make(map[Backend]int),
+	}
+	s.pools[members] = pool
+	return pool
+}
+
+// forgetDeleted drops the pools with a backend which is no longer in the
+// pool of sctplb
+func (s *weightedRoundRobinScheduler) forgetDeleted() {
+	if len(s.pools) == 0 {
+		return
+	}
+	known := make(map[Backend]bool, context.Sctplb_Self().NFLength())
+	for _, instance := range context.Sctplb_Self().Backends {
+		known[instance] = true
+	}
+	for members, pool := range s.pools {
+		for _, instance := range pool.backends {
+			if !known[instance] {
+				delete(s.pools, members)
+				break
+			}
+		}
+	}
+}
+
+func (s *weightedRoundRobinScheduler) Select(_ *context.Ran, _ *ngapType.RANUENGAPID, backends []context.NF) Backend {
+	currentWeights := s.pool(backends).currentWeights
+	weights := make([]int, len(backends))
+	var known, sum int
+	for i, instance := range backends {
+		if w, ok := instance.(weighted); ok && w.Weight() > 0 {
+			weights[i] = w.Weight()
+			known++
+			sum += weights[i]
+		}
+	}
+	defaultWeight := 1
+	if known > 0 {
+		defaultWeight = max(sum/known, 1)
+	}
+
+	var best Backend
+	var total int
+	for i, instance := range backends {
+		if !instance.State() {
+			continue
+		}
+		weight := weights[i]
+		if weight == 0 {
+			weight = defaultWeight
+		}
+		currentWeights[instance] += weight
+		total += weight
+		if best == nil || currentWeights[instance] > currentWeights[best] {
+			best = instance
+		}
+	}
+	if best != nil {
+		currentWeights[best] -= total
+	}
+	return best
+}
+
+// leastLoaded returns the READY backend with the lowest load. Ties are broken
+// in turn, starting after the backend selected last, so that equally loaded
+// backends share the UEs.
+func leastLoaded(backends []context.NF, start *int, load func(Backend) int) Backend {
+	var best Backend
+	var bestLoad, bestIndex int
+	for i := range backends {
+		index := (*start + i) % len(backends)
+		instance := backends[index]
+		if !instance.State() {
+			continue
+		}
+		if l := load(instance); best == nil || l < bestLoad {
+			best, bestLoad, bestIndex = instance, l, index
+		}
+	}
+	if best != nil {
+		*start = bestIndex + 1
+	}
+	return best
+}
+
+// leastActiveUEsScheduler selects the backend owning the fewest sticky
+// sessions
+type leastActiveUEsScheduler struct {
+	next int
+}
+
+func (s *leastActiveUEsScheduler) Select(_ *context.Ran, _ *ngapType.RANUENGAPID, backends []context.NF) Backend {
+	counts := stickySessions.Counts()
+	return leastLoaded(backends, &s.next, func(b Backend) int {
+		return counts[b.Address()]
+	})
+}
+
+// leastInFlightScheduler selects the backend with the fewest messages not yet
+// sent, i.e. the one whose stream is the least backed up
+type leastInFlightScheduler struct {
+	next int
+}
+
+func (s *leastInFlightScheduler) Select(_ *context.Ran, _ *ngapType.RANUENGAPID, backends []context.NF) Backend {
+	return leastLoaded(backends, &s.next, inFlight)
+}
+
+func inFlight(b Backend) int {
+	if r, ok := b.(inFlightReporter); ok {
+		return r.InFlight()
+	}
+	return 0
+}
+
+// powerOfTwoChoicesScheduler picks two READY backends at random and selects
+// the less loaded one, by messages in flight and then by sticky sessions
+type powerOfTwoChoicesScheduler struct {
+	intN func(n int) int
+}
+
+func (s *powerOfTwoChoicesScheduler) Select(_ *context.Ran, _ *ngapType.RANUENGAPID, backends []context.NF) Backend {
+	ready := readyBackends(backends)
+	switch len(ready) {
+	case 0:
+		return nil
+	case 1:
+		return ready[0]
+	}
+	first := s.intN(len(ready))
+	second := s.intN(len(ready) - 1)
+	if second >= first {
+		second++
+	}
+	a, b := ready[first], ready[second]
+	if inFlight(a) != inFlight(b) {
+		if inFlight(a) < inFlight(b) {
+			return a
+		}
+		return b
+	}
+	counts := stickySessions.Counts()
+	if counts[b.Address()] < counts[a.Address()] {
+		return b
+	}
+	return a
+}
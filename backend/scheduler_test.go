@@ -0,0 +1,296 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omec-project/sctplb/context"
+)
+
+// selectN returns the addresses of n backends selected in a row
+func selectN(s Scheduler, backends []context.NF, n int) []string {
+	var got []string
+	for i := 0; i < n; i++ {
+		if backend := s.Select(nil, nil, backends); backend != nil {
+			got = append(got, backend.Address())
+		} else {
+			got = append(got, "")
+		}
+	}
+	return got
+}
+
+func Test_RoundRobinScheduler(t *testing.T) {
+	up1 := &GrpcServer{address: "127.0.0.1", state: stateReady}
+	up2 := &GrpcServer{address: "127.0.0.2", state: stateReady}
+	down := &GrpcServer{address: "127.0.0.3"}
+	draining := &GrpcServer{address: "127.0.0.4", state: stateDraining}
+
+	tests := []struct {
+		name     string
+		backends []context.NF
+		want     []string
+	}{
+		{
+			name:     "Backends in turn",
+			backends: []context.NF{up1, up2},
+			want:     []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"},
+		},
+		{
+			name:     "Backends not ready are skipped",
+			backends: []context.NF{up1, down, up2},
+			want:     []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"},
+		},
+		{
+			name:     "Draining backends are skipped",
+			backends: []context.NF{draining, up1},
+			want:     []string{"127.0.0.1", "127.0.0.1"},
+		},
+		{
+			name:     "No backend ready",
+			backends: []context.NF{down},
+			want:     []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got := selectN(&roundRobinScheduler{}, tt.backends, len(tt.want))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Select() sequence mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_WeightedRoundRobinScheduler(t *testing.T) {
+	heavy := &GrpcServer{address: "127.0.0.1", state: stateReady, weight: 5}
+	light := &GrpcServer{address: "127.0.0.2", state: stateReady}
+	light.capacity.Store(1)
+	unknown := &GrpcServer{address: "127.0.0.3", state: stateReady}
+	down := &GrpcServer{address: "127.0.0.4", weight: 10}
+
+	tests := []struct {
+		name     string
+		backends []context.NF
+		want     []string
+	}{
+		{
+			name:     "Static and learned weights",
+			backends: []context.NF{heavy, light, &GrpcServer{address: "127.0.0.5", state: stateReady, weight: 1}},
+			want:     []string{"127.0.0.1", "127.0.0.1", "127.0.0.2", "127.0.0.1", "127.0.0.5", "127.0.0.1", "127.0.0.1"},
+		},
+		{
+			name:     "Unknown weight gets the average",
+			backends: []context.NF{light, unknown},
+			want:     []string{"127.0.0.2", "127.0.0.3", "127.0.0.2", "127.0.0.3"},
+		},
+		{
+			name:     "Backends not ready are skipped",
+			backends: []context.NF{down, light},
+			want:     []string{"127.0.0.2", "127.0.0.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				ctx := context.Sctplb_Self()
+				for _, instance := range tt.backends {
+					ctx.AddNF(instance)
+					defer ctx.DeleteNF(instance)
+				}
+				got := selectN(&weightedRoundRobinScheduler{}, tt.backends, len(tt.want))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Select() sequence mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_WeightedRoundRobinSchedulerPools(t *testing.T) {
+	heavy := &GrpcServer{address: "127.0.0.1", state: stateReady, weight: 3}
+	light := &GrpcServer{address: "127.0.0.2", state: stateReady, weight: 1}
+	other := &GrpcServer{address: "127.0.0.3", state: stateReady, weight: 1}
+	ctx := context.Sctplb_Self()
+	for _, instance := range []context.NF{heavy, light, other} {
+		ctx.AddNF(instance)
+		defer ctx.DeleteNF(instance)
+	}
+
+	// the pools of the PLMNs, slices and reroutes interleave
+	s := &weightedRoundRobinScheduler{}
+	all := []context.NF{heavy, light, other}
+	pair := []context.NF{heavy, light}
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		s.Select(nil, nil, all)
+		counts[s.Select(nil, nil, pair).Address()]++
+	}
+	if counts["127.0.0.1"] != 300 || counts["127.0.0.2"] != 100 {
+		t.Errorf("selections from the pair mismatch. got = %v, want 300 and 100", counts)
+	}
+
+	ctx.DeleteNF(other)
+	s.Select(nil, nil, pair)
+	if _, found := s.pools[poolKey(all)]; found {
+		t.Errorf("current weights of the pool with the deleted backend kept")
+	}
+	if _, found := s.pools[poolKey(pair)]; !found {
+		t.Errorf("current weights of the pool without the deleted backend dropped")
+	}
+}
+
+func Test_LeastActiveUEsScheduler(t *testing.T) {
+	saved := stickySessions
+	defer func() { stickySessions = saved }()
+
+	busy := &GrpcServer{address: "127.0.0.1", state: stateReady}
+	idle := &GrpcServer{address: "127.0.0.2", state: stateReady}
+	down := &GrpcServer{address: "127.0.0.3"}
+
+	tests := []struct {
+		name     string
+		sessions map[string]string
+		backends []context.NF
+		want     []string
+	}{
+		{
+			name:     "Backend with the fewest UEs",
+			sessions: map[string]string{"ran_1": "127.0.0.1", "ran_2": "127.0.0.1", "ran_3": "127.0.0.2"},
+			backends: []context.NF{busy, idle},
+			want:     []string{"127.0.0.2", "127.0.0.2"},
+		},
+		{
+			name:     "Equally loaded backends in turn",
+			sessions: map[string]string{"ran_1": "127.0.0.1", "ran_2": "127.0.0.2"},
+			backends: []context.NF{busy, idle},
+			want:     []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"},
+		},
+		{
+			name:     "Backends not ready are skipped",
+			sessions: map[string]string{"ran_1": "127.0.0.1"},
+			backends: []context.NF{down, busy},
+			want:     []string{"127.0.0.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				stickySessions = newMemoryStore(time.Minute, 0)
+				for key, backend := range tt.sessions {
+					stickySessions.Put(key, backend)
+				}
+				got := selectN(&leastActiveUEsScheduler{}, tt.backends, len(tt.want))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Select() sequence mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_LeastInFlightScheduler(t *testing.T) {
+	backedUp := &GrpcServer{address: "127.0.0.1", state: stateReady}
+	backedUp.inFlight.Store(3)
+	free := &GrpcServer{address: "127.0.0.2", state: stateReady}
+	alsoFree := &GrpcServer{address: "127.0.0.3", state: stateReady}
+	down := &GrpcServer{address: "127.0.0.4"}
+
+	tests := []struct {
+		name     string
+		backends []context.NF
+		want     []string
+	}{
+		{
+			name:     "Backend with the fewest messages in flight",
+			backends: []context.NF{backedUp, free},
+			want:     []string{"127.0.0.2", "127.0.0.2"},
+		},
+		{
+			name:     "Equally loaded backends in turn",
+			backends: []context.NF{backedUp, free, alsoFree},
+			want:     []string{"127.0.0.2", "127.0.0.3", "127.0.0.2"},
+		},
+		{
+			name:     "Backends not ready are skipped",
+			backends: []context.NF{down, backedUp},
+			want:     []string{"127.0.0.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got := selectN(&leastInFlightScheduler{}, tt.backends, len(tt.want))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Select() sequence mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_PowerOfTwoChoicesScheduler(t *testing.T) {
+	saved := stickySessions
+	defer func() { stickySessions = saved }()
+	stickySessions = newMemoryStore(time.Minute, 0)
+	stickySessions.Put("ran_1", "127.0.0.1")
+
+	busy := &GrpcServer{address: "127.0.0.1", state: stateReady}
+	backedUp := &GrpcServer{address: "127.0.0.2", state: stateReady}
+	backedUp.inFlight.Store(2)
+	idle := &GrpcServer{address: "127.0.0.3", state: stateReady}
+	down := &GrpcServer{address: "127.0.0.4"}
+
+	tests := []struct {
+		name     string
+		backends []context.NF
+		picks    []int
+		want     string
+	}{
+		{
+			name:     "Fewer messages in flight",
+			backends: []context.NF{busy, backedUp, idle},
+			picks:    []int{1, 0},
+			want:     "127.0.0.1",
+		},
+		{
+			name:     "Fewer UEs when in flight is equal",
+			backends: []context.NF{busy, backedUp, idle},
+			picks:    []int{0, 1},
+			want:     "127.0.0.3",
+		},
+		{
+			name:     "Single backend ready",
+			backends: []context.NF{down, backedUp},
+			want:     "127.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				picks := tt.picks
+				s := &powerOfTwoChoicesScheduler{intN: func(n int) int {
+					pick := picks[0]
+					picks = picks[1:]
+					return pick
+				}}
+				got := s.Select(nil, nil, tt.backends)
+				if got == nil || got.Address() != tt.want {
+					t.Errorf("Select() mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
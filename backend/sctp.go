@@ -0,0 +1,484 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+)
+
+const (
+	// largest NGAP message read from an AMF
+	n2ReadBufSize = 65535
+	// SCTP port of the N2 interface of the AMFs
+	defaultN2Port = 38412
+)
+
+var errAssociationBroken = errors.New("N2 association broken")
+
+// sctpTransport opens the N2 associations to the AMFs
+type sctpTransport interface {
+	Dial(address string, port int) (net.Conn, error)
+}
+
+// kernelSCTPTransport opens N2 associations with the SCTP stack of the kernel
+type kernelSCTPTransport struct{}
+
+func (kernelSCTPTransport) Dial(address string, port int) (net.Conn, error) {
+	ip, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sctp.DialSCTPExt("sctp", nil, &sctp.SCTPAddr{IPAddrs: []net.IPAddr{*ip}, Port: port},
+		sctpConfig.InitMsg)
+	if err != nil {
+		return nil, err
+	}
+	info, err := conn.GetDefaultSentParam()
+	if err == nil {
+		info.PPID = ngap.PPID
+		err = conn.SetDefaultSentParam(info)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+var n2Transport sctpTransport = kernelSCTPTransport{}
+
+// SctpServer is a standard AMF reached over N2. The AMF cannot tell the gNBs
+// behind sctplb apart on a single association, so every gNB gets its own
+// association to the AMF, opened with the first message of the gNB the AMF
+// is sent. The NG Setup Request of the gNB is replayed on the associations
+// opened after NG Setup, and the answer of the AMF is not passed on. Each
+// association has its own send queue, opened and drained by a writer so that
+// the dispatcher never waits for the AMF.
+var _ context.NF = &SctpServer{}
+
+type SctpServer struct {
+	address     string
+	port        int
+	state       backendState
+	drainPinned atomic.Bool     // drained by the operator, kept DRAINING across reconnects
+	weight      int             // static weight of the service
+	snssais     []config.Snssai // slices served by the service
+	plmnIds     []config.PlmnId // PLMNs served by the service
+	overflow    string          // overflow policy of the send queues
+	transport   sctpTransport
+	// NG Setup data of the AMF
+	setup atomic.Pointer[amfSetup]
+	// associations of the gNBs, by RAN
+	mu           sync.Mutex
+	associations map[*context.Ran]*n2Association
+	// signalled when an association can no longer be opened, or fails
+	broken   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type n2Association struct {
+	// set by the writer once the association is open
+	conn  net.Conn
+	queue *sendQueue
+	// the NG Setup Request of the gNB was replayed, its outcome is dropped
+	replayed atomic.Bool
+}
+
+func newSctpServer(address string, svc config.Service) *SctpServer {
+	return &SctpServer{
+		address:      address,
+		weight:       svc.Weight,
+		snssais:      svc.Snssais,
+		plmnIds:      svc.PlmnIds,
+		overflow:     sendQueueOverflow,
+		transport:    n2Transport,
+		associations: make(map[*context.Ran]*n2Association),
+		broken:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// ConnectToServer runs the lifecycle of the backend: the AMF is READY once it
+// accepts an association, and probed again with a jittered exponential
+// backoff when an association to it can no longer be opened, or one of its
+// open associations fails. The backend is
+// deleted once the AMF could not be reached for reconnectFailAfter.
+func (b *SctpServer) ConnectToServer(port int) {
+	b.mu.Lock()
+	b.port = port
+	b.mu.Unlock()
+	logger.AppLog.Infof("connecting to N2 target %v:%d", b.address, port)
+
+	retry := newBackoff(reconnectInitialBackoff, reconnectMaxBackoff)
+	downSince := time.Now()
+	for {
+		err := b.probe()
+		if err == nil {
+			state := stateReady
+			if b.drainPinned.Load() {
+				state = stateDraining
+			}
+			if previous := b.state.store(state); previous != state {
+				logger.SctpLog.Infof("server %v %v -> %v", b.address, previous, state)
+				resetOverload(b)
+				ngSetupChanged()
+			}
+			retry.reset()
+			select {
+			case <-b.done:
+				return
+			case <-b.broken:
+			}
+			downSince = time.Now()
+			err = errAssociationBroken
+		}
+		if b.stopped() {
+			return
+		}
+		logger.SctpLog.Warnf("server %v unreachable: %v", b.address, err)
+		if time.Since(downSince) >= reconnectFailAfter {
+			logger.SctpLog.Errorf("server %v unreachable for %v", b.address, reconnectFailAfter)
+			b.state.store(stateFailed)
+			deleteBackendNF(b)
+			return
+		}
+		b.state.store(stateConnecting)
+		delay := retry.next()
+		logger.SctpLog.Infof("reconnecting to server %v in %v", b.address, delay)
+		select {
+		case <-b.done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// probe checks that the AMF accepts associations
+func (b *SctpServer) probe() error {
+	conn, err := b.transport.Dial(b.address, b.port)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Send queues a message of a gNB for the AMF on the association of the gNB,
+// and closes the association once the gNB is gone
+func (b *SctpServer) Send(msg []byte, end bool, ran *context.Ran) error {
+	if end {
+		b.closeAssociation(ran)
+		return nil
+	}
+	association, err := b.association(ran, msg)
+	if err != nil {
+		return err
+	}
+	return b.enqueue(association, msg)
+}
+
+// enqueue hands a message to the writer of an association
+func (b *SctpServer) enqueue(association *n2Association, msg []byte) error {
+	dropped, err := association.queue.push(&gClient.SctplbMessage{Msg: msg})
+	if dropped {
+		logger.SctpLog.Warnf("send queue of server %v full, dropped oldest message", b.address)
+	}
+	return err
+}
+
+func (b *SctpServer) waitsForRoom() bool {
+	return b.overflow == overflowBlock
+}
+
+// sendWait sends a message of a gNB, waiting for room in the full send queue
+// of its association. Must not be called with the context lock held.
+func (b *SctpServer) sendWait(msg []byte, ran *context.Ran) error {
+	b.mu.Lock()
+	association, ok := b.associations[ran]
+	b.mu.Unlock()
+	if !ok {
+		return errAssociationBroken
+	}
+	return association.queue.pushWait(&gClient.SctplbMessage{Msg: msg})
+}
+
+// association returns the association of a gNB, starting the writer opening
+// it for the first message of the gNB
+func (b *SctpServer) association(ran *context.Ran, msg []byte) (*n2Association, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if association, ok := b.associations[ran]; ok {
+		return association, nil
+	}
+	if b.stopped() {
+		return nil, errBackendStopped
+	}
+	association := &n2Association{queue: newSendQueue(sendQueueDepth, b.overflow)}
+	var replay []byte
+	if ran.SetupRequest != nil && !bytes.Equal(msg, ran.SetupRequest) {
+		replay = ran.SetupRequest
+	}
+	b.associations[ran] = association
+	go b.writeAssociation(ran, association, replay)
+	return association, nil
+}
+
+// writeAssociation opens the association of a gNB, replaying its NG Setup
+// Request if any, then drains the send queue of the association into it
+// until the association is closed. An association which does not take a
+// message within sendTimeout is wedged and closed.
+func (b *SctpServer) writeAssociation(ran *context.Ran, association *n2Association, replay []byte) {
+	defer association.queue.attach()()
+	conn, err := b.transport.Dial(b.address, b.port)
+	if err != nil {
+		ran.Log.Warnf("can not open N2 association to server %v: %v", b.address, err)
+		b.failAssociation(ran, association)
+		return
+	}
+	defer conn.Close()
+	if replay != nil {
+		association.replayed.Store(true)
+		if _, err := conn.Write(replay); err != nil {
+			ran.Log.Warnf("can not replay NG Setup Request to server %v: %v", b.address, err)
+			b.failAssociation(ran, association)
+			return
+		}
+	}
+	association.conn = conn
+	ran.Log.Infof("N2 association to server %v opened", b.address)
+	go b.readAssociation(ran, association)
+
+	for {
+		select {
+		case <-association.queue.done:
+			return
+		case message := <-association.queue.messages:
+			deadline := time.AfterFunc(sendTimeout, func() {
+				ran.Log.Errorf("send to server %v timed out after %v, closing the association", b.address, sendTimeout)
+				conn.Close()
+			})
+			_, err := conn.Write(message.Msg)
+			deadline.Stop()
+			if err != nil {
+				ran.Log.Warnf("can not send to server %v: %v", b.address, err)
+				b.failAssociation(ran, association)
+				return
+			}
+		}
+	}
+}
+
+// readAssociation passes the messages of the AMF on to the gNB until the
+// association is closed
+func (b *SctpServer) readAssociation(ran *context.Ran, association *n2Association) {
+	buf := make([]byte, n2ReadBufSize)
+	for {
+		n, err := association.conn.Read(buf)
+		if err != nil {
+			ran.Log.Infof("N2 association to server %v closed: %v", b.address, err)
+			b.failAssociation(ran, association)
+			return
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		amfMsg, err := ngap.Decoder(msg)
+		if err != nil {
+			logger.SctpLog.Errorf("NGAP decode error of AMF message: %+v", err)
+		} else {
+			changed := learnAMFSetup(&b.setup, amfMsg)
+			if localNGSetup && isLocalNGSetupProcedure(amfMsg) {
+				b.answerLocalNGSetupProcedure(ran, association, amfMsg)
+				if changed {
+					ngSetupChanged()
+				}
+				continue
+			}
+			if association.replayed.Load() && isNGSetupOutcome(amfMsg) {
+				association.replayed.Store(false)
+				ran.Log.Debugf("dropped NG Setup outcome of the replayed request from server %v", b.address)
+				continue
+			}
+			learnDownlinkUEAssociation(b, ran, amfMsg)
+			overloadLearned := learnOverload(b, amfMsg)
+			if handleDownlinkNGReset(b, ran, amfMsg) || handleBroadcastOutcome(b, ran, amfMsg, msg) ||
+				handleOverload(ran, amfMsg, overloadLearned) {
+				continue
+			}
+		}
+		if _, err := ran.Conn.Write(msg); err != nil {
+			ran.Log.Infof("err %+v", err)
+		}
+	}
+}
+
+// answerLocalNGSetupProcedure acknowledges the AMF Configuration Updates of
+// the AMF in local NG Setup mode, the gNBs are told the merged NG Setup data
+// of the backends by sctplb instead
+func (b *SctpServer) answerLocalNGSetupProcedure(ran *context.Ran, association *n2Association,
+	amfMsg *ngapType.NGAPPDU,
+) {
+	association.replayed.Store(false)
+	if !isProcedure(amfMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeAMFConfigurationUpdate) {
+		return
+	}
+	ack, err := amfConfigurationUpdateAcknowledge()
+	if err == nil {
+		_, err = association.conn.Write(ack)
+	}
+	if err != nil {
+		ran.Log.Warnf("can not acknowledge AMF Configuration Update of server %v: %v", b.address, err)
+	}
+}
+
+// NotifyGnbSetup sends the NG Setup Request of a gNB set up by sctplb to the
+// AMF, which answers with its NG Setup data
+func (b *SctpServer) NotifyGnbSetup(ran *context.Ran) error {
+	if ran.SetupRequest == nil {
+		return nil
+	}
+	b.mu.Lock()
+	association, ok := b.associations[ran]
+	b.mu.Unlock()
+	if !ok {
+		// a new association starts with the NG Setup Request
+		return b.Send(ran.SetupRequest, false, ran)
+	}
+	association.replayed.Store(true)
+	return b.enqueue(association, ran.SetupRequest)
+}
+
+// AMFSetup returns the NG Setup data of the AMF, nil until it told them
+func (b *SctpServer) AMFSetup() *amfSetup {
+	return b.setup.Load()
+}
+
+// failAssociation ends an association which failed, and has the AMF probed
+// again unless sctplb closed the association itself
+func (b *SctpServer) failAssociation(ran *context.Ran, association *n2Association) {
+	b.mu.Lock()
+	open := b.associations[ran] == association
+	if open {
+		delete(b.associations, ran)
+	}
+	b.mu.Unlock()
+	association.queue.stop()
+	if !open {
+		return
+	}
+	select {
+	case b.broken <- struct{}{}:
+	default:
+	}
+}
+
+func (b *SctpServer) closeAssociation(ran *context.Ran) {
+	b.mu.Lock()
+	association, ok := b.associations[ran]
+	delete(b.associations, ran)
+	b.mu.Unlock()
+	if ok {
+		association.queue.stop()
+	}
+}
+
+// stop closes the associations of a deleted backend
+func (b *SctpServer) stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+	})
+	b.mu.Lock()
+	associations := b.associations
+	b.associations = make(map[*context.Ran]*n2Association)
+	b.mu.Unlock()
+	for _, association := range associations {
+		association.queue.stop()
+	}
+}
+
+// stopped returns true once the backend is deleted
+func (b *SctpServer) stopped() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// State returns true if the backend takes new UEs
+func (b *SctpServer) State() bool {
+	return b.state.load() == stateReady
+}
+
+// Draining returns true if the backend takes no new UEs, but still serves
+// its sticky UEs until they are released or expire
+func (b *SctpServer) Draining() bool {
+	return b.state.load() == stateDraining
+}
+
+// Drain stops sending new UEs to the backend until Undrain, even across
+// reconnects
+func (b *SctpServer) Drain() {
+	b.drainPinned.Store(true)
+	if b.state.compareAndSwap(stateReady, stateDraining) {
+		logger.SctpLog.Infof("server %v %v -> %v", b.address, stateReady, stateDraining)
+		ngSetupChanged()
+	}
+}
+
+// Undrain lets the backend take new UEs again
+func (b *SctpServer) Undrain() {
+	b.drainPinned.Store(false)
+	if b.state.compareAndSwap(stateDraining, stateReady) {
+		logger.SctpLog.Infof("server %v %v -> %v", b.address, stateDraining, stateReady)
+		ngSetupChanged()
+	}
+}
+
+// Reachable returns true unless the backend FAILED
+func (b *SctpServer) Reachable() bool {
+	return b.state.load() != stateFailed
+}
+
+// Snssais returns the slices served by the service of the backend
+func (b *SctpServer) Snssais() []config.Snssai {
+	return b.snssais
+}
+
+// PlmnIds returns the PLMNs served by the service of the backend
+func (b *SctpServer) PlmnIds() []config.PlmnId {
+	return b.plmnIds
+}
+
+// Weight returns the configured weight of the backend, 0 if unknown
+func (b *SctpServer) Weight() int {
+	return b.weight
+}
+
+func (b *SctpServer) Address() string {
+	return b.address
+}
+
+// learnRanSetup keeps the NG Setup Request of a RAN, replayed to the AMFs it
+// opens N2 associations to later on
+func learnRanSetup(ran *context.Ran, ranMsg *ngapType.NGAPPDU, msg []byte) {
+	if !isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGSetup) {
+		return
+	}
+	ran.SetupRequest = append([]byte(nil), msg...)
+}
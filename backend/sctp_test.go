@@ -0,0 +1,409 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+)
+
+// fakeN2Transport hands the AMF end of every association it opens to the
+// test, or fails with err
+type fakeN2Transport struct {
+	amf chan net.Conn
+	mu  sync.Mutex
+	err error
+}
+
+func (f *fakeN2Transport) Dial(string, int) (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	client, server := net.Pipe()
+	f.amf <- server
+	return client, nil
+}
+
+func newFakeN2Transport() *fakeN2Transport {
+	return &fakeN2Transport{amf: make(chan net.Conn, 10)}
+}
+
+func readN2(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline() error: %v", err)
+	}
+	buf := make([]byte, n2ReadBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	return buf[:n]
+}
+
+// sendAsync sends a message while the test plays the AMF, the associations
+// being synchronous pipes
+func sendAsync(b *SctpServer, msg []byte, ran *context.Ran) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- b.Send(msg, false, ran)
+	}()
+	return result
+}
+
+func encodeNGAP(t *testing.T, pdu *ngapType.NGAPPDU) []byte {
+	msg, err := ngap.Encoder(*pdu)
+	if err != nil {
+		t.Fatalf("NGAP encode error: %v", err)
+	}
+	return msg
+}
+
+func Test_SctpServer(t *testing.T) {
+	saved := stickySessions
+	defer func() { stickySessions = saved }()
+	stickySessions = newMemoryStore(time.Minute, 0)
+
+	gnb, gnbConn := net.Pipe()
+	defer gnb.Close()
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412", Conn: gnbConn, Log: logger.RanLog}
+
+	setupRequest := []byte("NG Setup Request")
+	learnRanSetup(ran, ngSetupRequest([]byte{0x02, 0xf8, 0x39}), setupRequest)
+	setupResponse := encodeNGAP(t, ngSetupResponse(ngapType.GUAMI{
+		PLMNIdentity: ngapType.PLMNIdentity{Value: aper.OctetString{0x02, 0xf8, 0x39}},
+		AMFRegionID:  ngapType.AMFRegionID{Value: aper.BitString{Bytes: []byte{0x01}, BitLength: 8}},
+		AMFSetID:     testAMFSetID,
+		AMFPointer:   testAMFPointer,
+	}))
+	ueMessage := encodeNGAP(t, initialUEMessage(nil))
+
+	transport := newFakeN2Transport()
+	first := newSctpServer("127.0.0.1", config.Service{})
+	first.transport = transport
+	second := newSctpServer("127.0.0.2", config.Service{})
+	second.transport = transport
+
+	// NG Setup on the association to the first AMF
+	sent := sendAsync(first, setupRequest, ran)
+	firstAMF := <-transport.amf
+	if got := readN2(t, firstAMF); !bytes.Equal(got, setupRequest) {
+		t.Errorf("first AMF message mismatch. got = %q, want = %q", got, setupRequest)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if _, err := firstAMF.Write(setupResponse); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if got := readN2(t, gnb); !bytes.Equal(got, setupResponse) {
+		t.Errorf("gNB message mismatch. got = %x, want = %x", got, setupResponse)
+	}
+
+	// the second AMF gets the NG Setup Request before the first UE message
+	sent = sendAsync(second, ueMessage, ran)
+	secondAMF := <-transport.amf
+	if got := readN2(t, secondAMF); !bytes.Equal(got, setupRequest) {
+		t.Errorf("replayed message mismatch. got = %q, want = %q", got, setupRequest)
+	}
+	if got := readN2(t, secondAMF); !bytes.Equal(got, ueMessage) {
+		t.Errorf("second AMF message mismatch. got = %x, want = %x", got, ueMessage)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	// and its NG Setup Response is not passed on
+	for _, msg := range [][]byte{setupResponse, ueMessage} {
+		if _, err := secondAMF.Write(msg); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+	}
+	if got := readN2(t, gnb); !bytes.Equal(got, ueMessage) {
+		t.Errorf("gNB message mismatch. got = %x, want = %x", got, ueMessage)
+	}
+
+	// the association is closed with the gNB
+	if err := second.Send(nil, true, ran); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if _, err := secondAMF.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("closed association Read() error = %v, want EOF", err)
+	}
+	first.stop()
+	if _, err := firstAMF.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("stopped backend association Read() error = %v, want EOF", err)
+	}
+}
+
+func Test_SctpServerLifecycle(t *testing.T) {
+	savedInitial, savedFailAfter := reconnectInitialBackoff, reconnectFailAfter
+	defer func() { reconnectInitialBackoff, reconnectFailAfter = savedInitial, savedFailAfter }()
+	reconnectInitialBackoff = 10 * time.Millisecond
+	reconnectFailAfter = 200 * time.Millisecond
+
+	transport := newFakeN2Transport()
+	go func() {
+		// the AMF accepts the probes
+		for conn := range transport.amf {
+			conn.Close()
+		}
+	}()
+	defer close(transport.amf)
+
+	ctx := context.Sctplb_Self()
+	b := newSctpServer("127.0.0.220", config.Service{})
+	b.transport = transport
+	ctx.Lock()
+	ctx.AddNF(b)
+	ctx.Unlock()
+	go b.ConnectToServer(38412)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.State() {
+		if time.Now().After(deadline) {
+			t.Fatalf("server not READY, state: %v", b.state.load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the AMF no longer accepts associations
+	transport.mu.Lock()
+	transport.err = errors.New("connection refused")
+	transport.mu.Unlock()
+	gnbId := "208:93:000001"
+	ran := &context.Ran{RanId: &gnbId, Log: logger.RanLog}
+	// the association is opened by its writer, which finds the AMF gone
+	if err := b.Send([]byte{1}, false, ran); err != nil {
+		t.Errorf("Send() error: %v", err)
+	}
+	for b.state.load() != stateFailed {
+		if time.Now().After(deadline) {
+			t.Fatalf("unreachable server not FAILED, state: %v", b.state.load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx.Lock()
+	defer ctx.Unlock()
+	for _, instance := range ctx.Backends {
+		if instance == context.NF(b) {
+			t.Errorf("failed server %v not deleted", b.address)
+		}
+	}
+}
+
+// stalledN2Transport opens no association until released
+type stalledN2Transport struct {
+	release chan struct{}
+}
+
+func (f *stalledN2Transport) Dial(string, int) (net.Conn, error) {
+	<-f.release
+	return nil, errors.New("connection timed out")
+}
+
+func Test_SctpServerStalledAMF(t *testing.T) {
+	transport := &stalledN2Transport{release: make(chan struct{})}
+	defer close(transport.release)
+	stalled := newSctpServer("127.0.0.1", config.Service{})
+	stalled.transport = transport
+	defer stalled.stop()
+	fake := newFakeN2Transport()
+	other := newSctpServer("127.0.0.2", config.Service{})
+	other.transport = fake
+	defer other.stop()
+
+	newRan := func(gnbId string) *context.Ran {
+		return &context.Ran{RanId: &gnbId, Conn: &recordingConn{}, Log: logger.RanLog}
+	}
+	first, second := newRan("gnb-1"), newRan("gnb-2")
+
+	// the AMF not answering the association of the first gNB holds up
+	// neither the dispatcher nor the second gNB
+	ctx := context.Sctplb_Self()
+	done := make(chan error, 2)
+	go func() {
+		ctx.Lock()
+		defer ctx.Unlock()
+		done <- stalled.Send([]byte("first"), false, first)
+		done <- other.Send([]byte("second"), false, second)
+	}()
+	for range 2 {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Send() error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Send() waits for the association to the AMF")
+		}
+	}
+	amf := <-fake.amf
+	defer amf.Close()
+	if got := readN2(t, amf); string(got) != "second" {
+		t.Errorf("AMF message mismatch. got = %q, want = %q", got, "second")
+	}
+}
+
+func Test_SctpServerAMFFailure(t *testing.T) {
+	transport := newFakeN2Transport()
+	b := newSctpServer("127.0.0.1", config.Service{})
+	b.transport = transport
+	defer b.stop()
+	go b.ConnectToServer(38412)
+	// the AMF accepts the probe
+	(<-transport.amf).Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.State() {
+		if time.Now().After(deadline) {
+			t.Fatalf("server not READY, state: %v", b.state.load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	newRan := func(gnbId string) *context.Ran {
+		return &context.Ran{RanId: &gnbId, Conn: &recordingConn{}, Log: logger.RanLog}
+	}
+	first, second := newRan("gnb-1"), newRan("gnb-2")
+	if err := b.Send([]byte("first"), false, first); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	firstAMF := <-transport.amf
+	readN2(t, firstAMF)
+	if err := b.Send([]byte("second"), false, second); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	readN2(t, <-transport.amf)
+
+	// the association of a gNB gone is closed by sctplb, the AMF is fine
+	if err := b.Send(nil, true, second); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !b.State() {
+		t.Errorf("server not READY once a gNB is gone, state: %v", b.state.load())
+	}
+
+	// the AMF fails the open association of the first gNB
+	transport.mu.Lock()
+	transport.err = errors.New("connection refused")
+	transport.mu.Unlock()
+	firstAMF.Close()
+	for b.state.load() != stateConnecting {
+		if time.Now().After(deadline) {
+			t.Fatalf("server not reconnecting once its association failed, state: %v", b.state.load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_SctpServerDrain(t *testing.T) {
+	savedInitial := reconnectInitialBackoff
+	defer func() { reconnectInitialBackoff = savedInitial }()
+	reconnectInitialBackoff = 10 * time.Millisecond
+
+	transport := newFakeN2Transport()
+	go func() {
+		for conn := range transport.amf {
+			conn.Close()
+		}
+	}()
+	defer close(transport.amf)
+	b := newSctpServer("127.0.0.1", config.Service{})
+	b.transport = transport
+	defer b.stop()
+	waitForState := func(want backendState) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for b.state.load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("server state mismatch. got = %v, want = %v", b.state.load(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	go b.ConnectToServer(38412)
+	waitForState(stateReady)
+
+	var d drainer = b
+	d.Drain()
+	if b.State() || !d.Draining() {
+		t.Errorf("drained server takes new UEs")
+	}
+	if !reachable(b) {
+		t.Errorf("drained server does not serve its sticky UEs")
+	}
+
+	// still DRAINING once the association broke and was reopened
+	transport.mu.Lock()
+	transport.err = errors.New("connection refused")
+	transport.mu.Unlock()
+	b.broken <- struct{}{}
+	waitForState(stateConnecting)
+	transport.mu.Lock()
+	transport.err = nil
+	transport.mu.Unlock()
+	waitForState(stateDraining)
+
+	d.Undrain()
+	if !b.State() || d.Draining() {
+		t.Errorf("undrained server takes no new UEs")
+	}
+}
+
+func Test_KernelSCTPTransport(t *testing.T) {
+	addr := &sctp.SCTPAddr{IPAddrs: []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}}
+	listener, err := sctp.ListenSCTP("sctp", addr)
+	if err != nil {
+		t.Skipf("SCTP not supported: %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*sctp.SCTPAddr).Port
+
+	accepted := make(chan *sctp.SCTPConn, 1)
+	go func() {
+		conn, err := listener.AcceptSCTP()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := kernelSCTPTransport{}.Dial("127.0.0.1", port)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+	amf := <-accepted
+	defer amf.Close()
+	if err := amf.SubscribeEvents(sctp.SCTP_EVENT_DATA_IO); err != nil {
+		t.Fatalf("SubscribeEvents() error: %v", err)
+	}
+
+	if _, err := conn.Write([]byte("NGAP")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	buf := make([]byte, n2ReadBufSize)
+	n, info, err := amf.SCTPRead(buf)
+	if err != nil {
+		t.Fatalf("SCTPRead() error: %v", err)
+	}
+	if string(buf[:n]) != "NGAP" || info == nil || info.PPID != ngap.PPID {
+		t.Errorf("received %q with %+v, want NGAP with PPID %v", buf[:n], info, ngap.PPID)
+	}
+}
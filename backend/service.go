@@ -15,6 +15,7 @@ import (
 
 	"github.com/ishidawataru/sctp"
 	"github.com/omec-project/ngap"
+	sctplbcontext "github.com/omec-project/sctplb/context"
 	"github.com/omec-project/sctplb/logger"
 )
 
@@ -206,6 +207,13 @@ func handleConnection(conn *sctp.SCTPConn, bufsize uint32, handler SCTPHandler)
 	defer func() {
 		connections.Delete(conn)
 
+		ctx := sctplbcontext.Sctplb_Self()
+		ctx.Lock()
+		if ran, ok := ctx.RanFindByConn(conn); ok {
+			releaseRan(ran)
+		}
+		ctx.Unlock()
+
 		// if AMF call Stop(), then conn.Close() will return EBADF because conn has been closed inside Stop()
 		if err := conn.Close(); err != nil && err != syscall.EBADF {
 			logger.SctpLog.Errorf("close connection error: %+v", err)
@@ -0,0 +1,378 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/logger"
+)
+
+const (
+	defaultSessionIdleTimeout   = time.Hour
+	defaultSessionSweepInterval = time.Minute
+)
+
+// failover policies applied to the sessions of a deleted backend
+const (
+	failoverDrop  = "drop"
+	failoverRepin = "repin"
+)
+
+var failoverPolicy = failoverDrop
+
+// stickyDisabled is set when the sticky sessions are turned off: the UEs are
+// then placed by the consistent-hash scheduler only, so that their messages
+// reach the same backend
+var stickyDisabled bool
+
+// sticky session store types
+const (
+	storeMemory     = "memory"
+	storeReplicated = "replicated"
+)
+
+// SessionStore holds the UE to backend affinity. Keys are built by stickyKey
+// and amfStickyKey, values are backend addresses so that a store can be
+// shared between sctplb replicas.
+type SessionStore interface {
+	// Get returns the backend address of a session and marks the session as used
+	Get(key string) (string, bool)
+	// Put adds or updates a session
+	Put(key, backend string)
+	// Delete removes a session, returns true if it existed
+	Delete(key string) bool
+	// DeletePrefix removes every session whose key starts with prefix
+	DeletePrefix(prefix string) int
+	// Reassign moves every session of backend from to backend to, or removes
+	// them when to is empty. Returns the keys of the affected sessions.
+	Reassign(from, to string) []string
+	// Sweep removes the sessions idle for longer than the idle timeout
+	Sweep() int
+	// Snapshot returns a copy of every session key and backend address
+	Snapshot() map[string]string
+	// Counts returns the number of sessions of each backend address
+	Counts() map[string]int
+	Len() int
+}
+
+// localPrefixDeleter is a SessionStore shared with other replicas which can
+// remove sessions from the copy of this replica only
+type localPrefixDeleter interface {
+	// DeleteLocalPrefix removes every session whose key starts with prefix
+	// from the copy of this replica
+	DeleteLocalPrefix(prefix string) int
+}
+
+// deleteLocalPrefix removes every session whose key starts with prefix,
+// without removing them from the other replicas sharing the store
+func deleteLocalPrefix(store SessionStore, prefix string) int {
+	if local, ok := store.(localPrefixDeleter); ok {
+		return local.DeleteLocalPrefix(prefix)
+	}
+	return store.DeletePrefix(prefix)
+}
+
+var (
+	_ SessionStore = &memoryStore{}
+	_ SessionStore = noStore{}
+)
+
+// noStore is the SessionStore of disabled sticky sessions, it keeps nothing
+type noStore struct{}
+
+func (noStore) Get(string) (string, bool)        { return "", false }
+func (noStore) Put(string, string)               {}
+func (noStore) Delete(string) bool               { return false }
+func (noStore) DeletePrefix(string) int          { return 0 }
+func (noStore) Reassign(string, string) []string { return nil }
+func (noStore) Sweep() int                       { return 0 }
+func (noStore) Snapshot() map[string]string      { return map[string]string{} }
+func (noStore) Counts() map[string]int           { return map[string]int{} }
+func (noStore) Len() int                         { return 0 }
+
+type stickySession struct {
+	key      string
+	backend  string
+	lastUsed time.Time
+}
+
+// memoryStore is the in-memory SessionStore. Entries idle for longer than
+// idleTimeout are removed by the sweeper, and once maxEntries is reached the
+// least recently used entry makes room for a new one.
+type memoryStore struct {
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List     // front is the most recently used session
+	counts      map[string]int // number of sessions per backend address
+	idleTimeout time.Duration
+	maxEntries  int
+	now         func() time.Time
+}
+
+func newMemoryStore(idleTimeout time.Duration, maxEntries int) *memoryStore {
+	return &memoryStore{
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		counts:      make(map[string]int),
+		idleTimeout: idleTimeout,
+		maxEntries:  maxEntries,
+		now:         time.Now,
+	}
+}
+
+func (t *memoryStore) Get(key string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, found := t.entries[key]
+	if !found {
+		return "", false
+	}
+	session := elem.Value.(*stickySession)
+	session.lastUsed = t.now()
+	t.lru.MoveToFront(elem)
+	return session.backend, true
+}
+
+// Put adds or updates a session, evicting the least recently used one when
+// the store is full
+func (t *memoryStore) Put(key, backend string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, found := t.entries[key]; found {
+		session := elem.Value.(*stickySession)
+		t.move(session, backend)
+		session.lastUsed = t.now()
+		t.lru.MoveToFront(elem)
+		return
+	}
+	if t.maxEntries > 0 && t.lru.Len() >= t.maxEntries {
+		session := t.remove(t.lru.Back())
+		logger.DispatchLog.Debugf("sticky session store full, evicted least recently used session %v", session.key)
+	}
+	t.entries[key] = t.lru.PushFront(&stickySession{
+		key:      key,
+		backend:  backend,
+		lastUsed: t.now(),
+	})
+	t.counts[backend]++
+}
+
+// remove drops a session from the store. Caller must hold t.mu.
+func (t *memoryStore) remove(elem *list.Element) *stickySession {
+	session := t.lru.Remove(elem).(*stickySession)
+	delete(t.entries, session.key)
+	t.decrement(session.backend)
+	return session
+}
+
+// move assigns a session to another backend. Caller must hold t.mu.
+func (t *memoryStore) move(session *stickySession, backend string) {
+	if session.backend == backend {
+		return
+	}
+	t.decrement(session.backend)
+	session.backend = backend
+	t.counts[backend]++
+}
+
+func (t *memoryStore) decrement(backend string) {
+	if t.counts[backend] <= 1 {
+		delete(t.counts, backend)
+		return
+	}
+	t.counts[backend]--
+}
+
+func (t *memoryStore) Delete(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, found := t.entries[key]
+	if !found {
+		return false
+	}
+	t.remove(elem)
+	return true
+}
+
+func (t *memoryStore) DeletePrefix(prefix string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var count int
+	for key, elem := range t.entries {
+		if strings.HasPrefix(key, prefix) {
+			t.remove(elem)
+			count++
+		}
+	}
+	return count
+}
+
+func (t *memoryStore) Reassign(from, to string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []string
+	for key, elem := range t.entries {
+		session := elem.Value.(*stickySession)
+		if session.backend != from {
+			continue
+		}
+		if to == "" {
+			t.remove(elem)
+		} else {
+			t.move(session, to)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (t *memoryStore) Snapshot() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sessions := make(map[string]string, len(t.entries))
+	for key, elem := range t.entries {
+		sessions[key] = elem.Value.(*stickySession).backend
+	}
+	return sessions
+}
+
+func (t *memoryStore) Counts() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int, len(t.counts))
+	for backend, count := range t.counts {
+		counts[backend] = count
+	}
+	return counts
+}
+
+func (t *memoryStore) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lru.Len()
+}
+
+func (t *memoryStore) Sweep() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idleTimeout <= 0 {
+		return 0
+	}
+	deadline := t.now().Add(-t.idleTimeout)
+	var count int
+	for elem := t.lru.Back(); elem != nil; {
+		session := elem.Value.(*stickySession)
+		if session.lastUsed.After(deadline) {
+			break
+		}
+		prev := elem.Prev()
+		t.remove(elem)
+		count++
+		elem = prev
+	}
+	return count
+}
+
+func runSweeper(store SessionStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownCtx.Done():
+			return
+		case <-ticker.C:
+			if count := store.Sweep(); count > 0 {
+				logger.DispatchLog.Infof("removed %d idle sticky sessions, %d left", count, store.Len())
+			}
+		}
+	}
+}
+
+// InitStickySessions sets up the sticky session store and its limits, restores
+// the persisted sessions and starts the idle session sweeper
+func InitStickySessions(configuration *config.Configuration) error {
+	cfg := configuration.StickySession
+	idleTimeout := defaultSessionIdleTimeout
+	sweepInterval := defaultSessionSweepInterval
+	storeType := storeMemory
+	var maxEntries int
+	if cfg != nil {
+		if cfg.IdleTimeout > 0 {
+			idleTimeout = cfg.IdleTimeout
+		}
+		if cfg.SweepInterval > 0 {
+			sweepInterval = cfg.SweepInterval
+		}
+		maxEntries = cfg.MaxEntries
+		switch cfg.FailoverPolicy {
+		case "", failoverDrop:
+			failoverPolicy = failoverDrop
+		case failoverRepin:
+			failoverPolicy = failoverRepin
+		default:
+			logger.AppLog.Warnf("unsupported sticky session failover policy %v, using %v", cfg.FailoverPolicy, failoverDrop)
+			failoverPolicy = failoverDrop
+		}
+		if cfg.Store != "" {
+			storeType = cfg.Store
+		}
+	}
+	logger.AppLog.Infof("sticky sessions store: %v idle timeout: %v sweep interval: %v max entries: %d failover policy: %v",
+		storeType, idleTimeout, sweepInterval, maxEntries, failoverPolicy)
+
+	disabled := cfg != nil && cfg.Disabled
+	stickyDisabled = disabled
+	var local SessionStore = newMemoryStore(idleTimeout, maxEntries)
+	switch {
+	case disabled:
+		logger.AppLog.Infoln("sticky sessions disabled, no GUAMI routing nor overload steering of the new UEs")
+		local = noStore{}
+	case storeType == storeMemory:
+	case storeType == storeReplicated:
+		if cfg.Replication == nil || cfg.Replication.ListenAddr == "" {
+			return errors.New("replicated sticky session store requires replication listenAddr")
+		}
+	default:
+		return fmt.Errorf("unsupported sticky session store: %v", storeType)
+	}
+
+	// the local copy of a replicated store is the one persisted, so that the
+	// updates of the peers reach the write-ahead log as well
+	if configuration.Persistence != nil && configuration.Persistence.Path != "" {
+		store, err := openPersistentStore(configuration.Persistence.Path,
+			configuration.Persistence.CompactThreshold, local)
+		if err != nil {
+			return fmt.Errorf("sticky session persistence error: %w", err)
+		}
+		persistence = store
+		local = store
+	}
+	stickySessions = local
+	if !disabled && storeType == storeReplicated {
+		lis, err := net.Listen("tcp", cfg.Replication.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("sticky session replication listen error: %w", err)
+		}
+		store := newReplicatedStore(shutdownCtx, os.Getenv("HOSTNAME"), local, cfg.Replication.Peers)
+		// a deleted session idle on a peer for that long is swept there anyway
+		store.tombstoneTTL = idleTimeout
+		if _, err := store.Serve(lis); err != nil {
+			lis.Close()
+			return fmt.Errorf("sticky session replication error: %w", err)
+		}
+		stickySessions = store
+	}
+	go runSweeper(stickySessions, sweepInterval)
+	return nil
+}
@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_MemoryStoreSweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	table := newMemoryStore(time.Minute, 0)
+	table.now = func() time.Time { return now }
+
+	table.Put("ran_1", "127.0.0.1")
+	table.Put("ran_2", "127.0.0.1")
+	now = now.Add(45 * time.Second)
+	table.Put("ran_3", "127.0.0.1")
+	if _, found := table.Get("ran_1"); !found {
+		t.Fatalf("session ran_1 not found")
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    int
+		wantLen int
+	}{
+		{
+			name:    "Nothing idle",
+			advance: 0,
+			want:    0,
+			wantLen: 3,
+		},
+		{
+			name:    "Idle session removed",
+			advance: 30 * time.Second,
+			want:    1,
+			wantLen: 2,
+		},
+		{
+			name:    "All sessions idle",
+			advance: time.Minute,
+			want:    2,
+			wantLen: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				now = now.Add(tt.advance)
+				if got := table.Sweep(); got != tt.want {
+					t.Errorf("Sweep() = %d, want %d", got, tt.want)
+				}
+				if table.Len() != tt.wantLen {
+					t.Errorf("Len() mismatch. got = %d, want = %d", table.Len(), tt.wantLen)
+				}
+			},
+		)
+	}
+}
+
+func Test_MemoryStoreMaxEntries(t *testing.T) {
+	table := newMemoryStore(time.Minute, 2)
+
+	table.Put("ran_1", "127.0.0.1")
+	table.Put("ran_2", "127.0.0.1")
+	table.Get("ran_1")
+	table.Put("ran_3", "127.0.0.1")
+
+	tests := []struct {
+		key       string
+		wantFound bool
+	}{
+		{key: "ran_1", wantFound: true},
+		{key: "ran_2", wantFound: false},
+		{key: "ran_3", wantFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.key, func(t *testing.T) {
+				if _, found := table.Get(tt.key); found != tt.wantFound {
+					t.Errorf("Get(%q) found = %v, want %v", tt.key, found, tt.wantFound)
+				}
+			},
+		)
+	}
+	if table.Len() != 2 {
+		t.Errorf("Len() mismatch. got = %d, want = 2", table.Len())
+	}
+}
+
+func Test_MemoryStoreReassign(t *testing.T) {
+	failed := "127.0.0.1"
+	other := "127.0.0.2"
+	replacement := "127.0.0.3"
+
+	tests := []struct {
+		name     string
+		to       string
+		wantKeys int
+		wantLen  int
+	}{
+		{
+			name:     "Drop sessions",
+			to:       "",
+			wantKeys: 2,
+			wantLen:  1,
+		},
+		{
+			name:     "Repin sessions",
+			to:       replacement,
+			wantKeys: 2,
+			wantLen:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				table := newMemoryStore(time.Minute, 0)
+				table.Put("ran_1", failed)
+				table.Put("ran_2", other)
+				table.Put("ran_amf_3", failed)
+
+				keys := table.Reassign(failed, tt.to)
+				if len(keys) != tt.wantKeys {
+					t.Errorf("Reassign() affected %d sessions, want %d", len(keys), tt.wantKeys)
+				}
+				if table.Len() != tt.wantLen {
+					t.Errorf("Len() mismatch. got = %d, want = %d", table.Len(), tt.wantLen)
+				}
+				for _, key := range keys {
+					backend, found := table.Get(key)
+					if found != (tt.to != "") || (found && backend != tt.to) {
+						t.Errorf("session %v not reassigned. got = %v, found = %v", key, backend, found)
+					}
+				}
+				if backend, _ := table.Get("ran_2"); backend != other {
+					t.Errorf("session of another backend was reassigned")
+				}
+			},
+		)
+	}
+}
+
+func Test_MemoryStoreCounts(t *testing.T) {
+	table := newMemoryStore(time.Minute, 2)
+
+	tests := []struct {
+		name   string
+		update func()
+		want   map[string]int
+	}{
+		{
+			name: "Put",
+			update: func() {
+				table.Put("ran_1", "127.0.0.1")
+				table.Put("ran_2", "127.0.0.2")
+			},
+			want: map[string]int{"127.0.0.1": 1, "127.0.0.2": 1},
+		},
+		{
+			name:   "Update",
+			update: func() { table.Put("ran_2", "127.0.0.1") },
+			want:   map[string]int{"127.0.0.1": 2},
+		},
+		{
+			name:   "Least recently used evicted",
+			update: func() { table.Put("ran_3", "127.0.0.3") },
+			want:   map[string]int{"127.0.0.1": 1, "127.0.0.3": 1},
+		},
+		{
+			name:   "Reassign",
+			update: func() { table.Reassign("127.0.0.3", "127.0.0.1") },
+			want:   map[string]int{"127.0.0.1": 2},
+		},
+		{
+			name:   "Delete",
+			update: func() { table.DeletePrefix("ran_") },
+			want:   map[string]int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				tt.update()
+				if got := table.Counts(); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Counts() mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/omec-project/ngap/logger"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+)
+
+// sliceServer is implemented by the backends which serve a configured list
+// of network slices. A backend without slices belongs to the default pool.
+type sliceServer interface {
+	Snssais() []config.Snssai
+}
+
+// servesSlice returns true if one of the configured slices matches the
+// S-NSSAI of an NGAP message
+func servesSlice(snssais []config.Snssai, snssai *ngapType.SNSSAI) bool {
+	if len(snssai.SST.Value) == 0 {
+		return false
+	}
+	sst := int32(snssai.SST.Value[0])
+	var sd string
+	if snssai.SD != nil {
+		sd = hex.EncodeToString(snssai.SD.Value)
+	}
+	for _, served := range snssais {
+		if served.Sst == sst && (served.Sd == "" || strings.EqualFold(served.Sd, sd)) {
+			return true
+		}
+	}
+	return false
+}
+
+func backendSnssais(instance context.NF) []config.Snssai {
+	if server, ok := instance.(sliceServer); ok {
+		return server.Snssais()
+	}
+	return nil
+}
+
+// extractAllowedNSSAI returns the Allowed NSSAI an InitialUEMessage carries
+// when the UE is rerouted, nil for any other PDU or when it is absent. The
+// gNB sends no slice in the InitialUEMessage of a UE which is not rerouted:
+// the Requested NSSAI of the UE is in its NAS message, which may be ciphered.
+func extractAllowedNSSAI(ranMsg *ngapType.NGAPPDU) *ngapType.AllowedNSSAI {
+	if ranMsg.Present != ngapType.NGAPPDUPresentInitiatingMessage {
+		return nil
+	}
+	initiatingMessage := ranMsg.InitiatingMessage
+	if initiatingMessage == nil || initiatingMessage.ProcedureCode.Value != ngapType.ProcedureCodeInitialUEMessage {
+		return nil
+	}
+	ngapMsg := initiatingMessage.Value.InitialUEMessage
+	if ngapMsg == nil {
+		logger.NgapLog.Errorln("InitialUEMessage is nil")
+		return nil
+	}
+	for _, ie := range ngapMsg.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDAllowedNSSAI {
+			return ie.Value.AllowedNSSAI
+		}
+	}
+	return nil
+}
+
+// slicePool returns the backends a message may be scheduled on: the backends
+// serving one of the slices of its Allowed NSSAI, or else the default pool of
+// the backends without slices. When the default pool is empty every backend
+// is a candidate.
+func slicePool(ranMsg *ngapType.NGAPPDU, backends []context.NF) []context.NF {
+	if ranMsg != nil {
+		if allowed := extractAllowedNSSAI(ranMsg); allowed != nil {
+			var pool []context.NF
+			for _, instance := range backends {
+				snssais := backendSnssais(instance)
+				for i := range allowed.List {
+					if servesSlice(snssais, &allowed.List[i].SNSSAI) {
+						pool = append(pool, instance)
+						break
+					}
+				}
+			}
+			if len(pool) > 0 {
+				return pool
+			}
+			logger.NgapLog.Warnln("no backend serves the Allowed NSSAI, using the default pool")
+		}
+	}
+
+	var pool []context.NF
+	for _, instance := range backends {
+		if len(backendSnssais(instance)) == 0 {
+			pool = append(pool, instance)
+		}
+	}
+	if len(pool) == 0 {
+		return backends
+	}
+	return pool
+}
@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omec-project/ngap/aper"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+)
+
+func withAllowedNSSAI(msg *ngapType.NGAPPDU, snssais ...ngapType.SNSSAI) *ngapType.NGAPPDU {
+	allowed := &ngapType.AllowedNSSAI{}
+	for _, snssai := range snssais {
+		allowed.List = append(allowed.List, ngapType.AllowedNSSAIItem{SNSSAI: snssai})
+	}
+	ies := &msg.InitiatingMessage.Value.InitialUEMessage.ProtocolIEs
+	ies.List = append(ies.List, ngapType.InitialUEMessageIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDAllowedNSSAI},
+		Value: ngapType.InitialUEMessageIEsValue{
+			Present:      ngapType.InitialUEMessageIEsPresentAllowedNSSAI,
+			AllowedNSSAI: allowed,
+		},
+	})
+	return msg
+}
+
+func snssai(sst byte, sd []byte) ngapType.SNSSAI {
+	s := ngapType.SNSSAI{SST: ngapType.SST{Value: aper.OctetString{sst}}}
+	if sd != nil {
+		s.SD = &ngapType.SD{Value: sd}
+	}
+	return s
+}
+
+func addresses(backends []context.NF) []string {
+	var got []string
+	for _, instance := range backends {
+		got = append(got, instance.Address())
+	}
+	return got
+}
+
+func Test_SlicePool(t *testing.T) {
+	embb := &GrpcServer{address: "127.0.0.1", snssais: []config.Snssai{{Sst: 1, Sd: "010203"}}}
+	urllc := &GrpcServer{address: "127.0.0.2", snssais: []config.Snssai{{Sst: 2}}}
+	defaultPool := &GrpcServer{address: "127.0.0.3"}
+	all := []context.NF{embb, urllc, defaultPool}
+
+	tests := []struct {
+		name     string
+		msg      *ngapType.NGAPPDU
+		backends []context.NF
+		want     []string
+	}{
+		{
+			name:     "No slice hint",
+			msg:      initialUEMessage(nil),
+			backends: all,
+			want:     []string{"127.0.0.3"},
+		},
+		{
+			name:     "Slice with SD",
+			msg:      withAllowedNSSAI(initialUEMessage(nil), snssai(1, []byte{0x01, 0x02, 0x03})),
+			backends: all,
+			want:     []string{"127.0.0.1"},
+		},
+		{
+			name:     "Slice with another SD",
+			msg:      withAllowedNSSAI(initialUEMessage(nil), snssai(1, []byte{0x01, 0x02, 0x04})),
+			backends: all,
+			want:     []string{"127.0.0.3"},
+		},
+		{
+			name:     "Service slice without SD",
+			msg:      withAllowedNSSAI(initialUEMessage(nil), snssai(2, []byte{0x0a, 0x0b, 0x0c})),
+			backends: all,
+			want:     []string{"127.0.0.2"},
+		},
+		{
+			name:     "Any allowed slice",
+			msg:      withAllowedNSSAI(initialUEMessage(nil), snssai(1, []byte{0x01, 0x02, 0x03}), snssai(2, nil)),
+			backends: all,
+			want:     []string{"127.0.0.1", "127.0.0.2"},
+		},
+		{
+			name:     "No default pool",
+			msg:      initialUEMessage(nil),
+			backends: []context.NF{embb, urllc},
+			want:     []string{"127.0.0.1", "127.0.0.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if got := addresses(slicePool(tt.msg, tt.backends)); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("slicePool() mismatch. got = %v, want = %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
@@ -1,17 +1,17 @@
 package backend
 
 import (
+	"fmt"
+
 	"github.com/omec-project/ngap/logger"
 	"github.com/omec-project/ngap/ngapType"
 	"github.com/omec-project/sctplb/context"
 )
 
-var (
-	stickySessions map[string]Backend
-)
+var stickySessions SessionStore
 
 func init() {
-	stickySessions = make(map[string]Backend)
+	stickySessions = newMemoryStore(defaultSessionIdleTimeout, 0)
 }
 
 func getRanID(ran *context.Ran) string {
@@ -22,6 +22,151 @@ func getRanID(ran *context.Ran) string {
 	return id
 }
 
+// stickyKey returns the stickySessions key of a UE: <ranID>_<RAN-UE-NGAP-ID>
+func stickyKey(ran *context.Ran, ngapID *ngapType.RANUENGAPID) string {
+	return fmt.Sprintf("%v_%v", getRanID(ran), ngapID.Value)
+}
+
+// amfStickyKey returns the stickySessions key of a UE learned from its
+// AMF-UE-NGAP-ID: <ranID>_amf_<AMF-UE-NGAP-ID>
+func amfStickyKey(ran *context.Ran, amfUeNgapID *ngapType.AMFUENGAPID) string {
+	return fmt.Sprintf("%v_amf_%v", getRanID(ran), amfUeNgapID.Value)
+}
+
+// lookupStickySession finds the backend owning a UE, first by its
+// RAN-UE-NGAP-ID and then by its AMF-UE-NGAP-ID. Either identifier may be nil.
+// Caller must hold the context lock.
+func lookupStickySession(ran *context.Ran, ngapID *ngapType.RANUENGAPID,
+	amfUeNgapID *ngapType.AMFUENGAPID,
+) (Backend, bool) {
+	var address string
+	var found bool
+	if ngapID != nil {
+		address, found = stickySessions.Get(stickyKey(ran, ngapID))
+	}
+	if !found && amfUeNgapID != nil {
+		address, found = stickySessions.Get(amfStickyKey(ran, amfUeNgapID))
+	}
+	if !found {
+		return nil, false
+	}
+	backend := findBackend(address)
+	if backend == nil {
+		logger.NgapLog.Infof("sticky backend %v is not available", address)
+		return nil, false
+	}
+	return backend, true
+}
+
+// findBackend returns the backend NF with the given address, nil if there is
+// none. Caller must hold the context lock.
+func findBackend(address string) Backend {
+	for _, instance := range context.Sctplb_Self().Backends {
+		if instance.Address() == address {
+			return instance
+		}
+	}
+	return nil
+}
+
+// pinStickySession records the backend owning a UE. A UE already owned by
+// the backend is only marked as used, so that the replicated and persistent
+// stores are not written on every message of the UE.
+func pinStickySession(key string, backend Backend) {
+	if current, found := stickySessions.Get(key); found && current == backend.Address() {
+		return
+	}
+	stickySessions.Put(key, backend.Address())
+}
+
+// evictStickySession removes the sticky session of a single UE of the given gNB.
+// Returns true if an entry was removed.
+func evictStickySession(ran *context.Ran, ngapID *ngapType.RANUENGAPID) bool {
+	if ran == nil || ngapID == nil {
+		return false
+	}
+	key := stickyKey(ran, ngapID)
+	if !stickySessions.Delete(key) {
+		return false
+	}
+	logger.NgapLog.Debugf("evicted sticky session %v", key)
+	return true
+}
+
+// evictAMFStickySession removes the sticky session of a UE learned from its
+// AMF-UE-NGAP-ID. Returns true if an entry was removed.
+func evictAMFStickySession(ran *context.Ran, amfUeNgapID *ngapType.AMFUENGAPID) bool {
+	if ran == nil || amfUeNgapID == nil {
+		return false
+	}
+	return stickySessions.Delete(amfStickyKey(ran, amfUeNgapID))
+}
+
+// evictRanStickySessions removes every sticky session of the given gNB, used
+// when its association goes away. The sessions are only removed from this
+// replica, the gNB may be reconnecting to another one.
+func evictRanStickySessions(ran *context.Ran) int {
+	if ran == nil {
+		return 0
+	}
+	return deleteLocalPrefix(stickySessions, getRanID(ran)+"_")
+}
+
+// evictNGResetStickySessions removes the sticky sessions reset by an NG Reset
+// of the given gNB. A reset of the whole NG interface evicts all sessions of
+// the gNB, a partial reset only those listed in the UE-associated logical
+// NG-connection list.
+func evictNGResetStickySessions(ran *context.Ran, ngReset *ngapType.NGReset) int {
+	if ran == nil || ngReset == nil {
+		return 0
+	}
+	resetType := ngResetType(ngReset)
+	if resetType == nil {
+		logger.NgapLog.Errorln("ResetType is nil")
+		return 0
+	}
+
+	switch resetType.Present {
+	case ngapType.ResetTypePresentNGInterface:
+		return stickySessions.DeletePrefix(getRanID(ran) + "_")
+	case ngapType.ResetTypePresentPartOfNGInterface:
+		if resetType.PartOfNGInterface == nil {
+			logger.NgapLog.Errorln("PartOfNGInterface is nil")
+			return 0
+		}
+		var count int
+		for _, item := range resetType.PartOfNGInterface.List {
+			evictAMFStickySession(ran, item.AMFUENGAPID)
+			if evictStickySession(ran, item.RANUENGAPID) {
+				count++
+			}
+		}
+		return count
+	}
+	return 0
+}
+
+// evictReleasedStickySessions removes the sticky sessions ended by an uplink
+// PDU: UE Context Release Complete ends one UE, NG Reset one or all of them.
+func evictReleasedStickySessions(ran *context.Ran, ranMsg *ngapType.NGAPPDU, ngapID *ngapType.RANUENGAPID) int {
+	switch ranMsg.Present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		initiatingMessage := ranMsg.InitiatingMessage
+		if initiatingMessage != nil && initiatingMessage.ProcedureCode.Value == ngapType.ProcedureCodeNGReset {
+			return evictNGResetStickySessions(ran, initiatingMessage.Value.NGReset)
+		}
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		successfulOutcome := ranMsg.SuccessfulOutcome
+		if successfulOutcome != nil && successfulOutcome.ProcedureCode.Value == ngapType.ProcedureCodeUEContextRelease {
+			evictAMFStickySession(ran, extractAMFUEIdentifier(ranMsg))
+			if evictStickySession(ran, ngapID) {
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
 func extractUEIdentifier(ranMsg *ngapType.NGAPPDU) *ngapType.RANUENGAPID {
 	var rANUENGAPID *ngapType.RANUENGAPID
 
@@ -107,6 +252,16 @@ func extractUEIdentifier(ranMsg *ngapType.NGAPPDU) *ngapType.RANUENGAPID {
 			}
 		case ngapType.ProcedureCodeLocationReportingFailureIndication:
 		case ngapType.ProcedureCodeErrorIndication:
+			ngapMsg := initiatingMessage.Value.ErrorIndication
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("ErrorIndication is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDRANUENGAPID {
+					rANUENGAPID = ie.Value.RANUENGAPID
+				}
+			}
 		case ngapType.ProcedureCodeUERadioCapabilityInfoIndication:
 			ngapMsg := initiatingMessage.Value.UERadioCapabilityInfoIndication
 			for i := 0; i < len(ngapMsg.ProtocolIEs.List); i++ {
@@ -347,3 +502,301 @@ func extractUEIdentifier(ranMsg *ngapType.NGAPPDU) *ngapType.RANUENGAPID {
 	}
 	return rANUENGAPID
 }
+
+// extractAMFUEIdentifier returns the AMF-UE-NGAP-ID of a UE-associated PDU
+// sent by a gNB. Used to route the UEs whose RAN-UE-NGAP-ID is unknown to the
+// LB, e.g. a Handover Failure which carries the AMF-UE-NGAP-ID only.
+func extractAMFUEIdentifier(ranMsg *ngapType.NGAPPDU) *ngapType.AMFUENGAPID {
+	var aMFUENGAPID *ngapType.AMFUENGAPID
+
+	switch ranMsg.Present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		initiatingMessage := ranMsg.InitiatingMessage
+		if initiatingMessage == nil {
+			return nil
+		}
+		switch initiatingMessage.ProcedureCode.Value {
+		case ngapType.ProcedureCodeUplinkNASTransport:
+			ngapMsg := initiatingMessage.Value.UplinkNASTransport
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UplinkNASTransport is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeErrorIndication:
+			ngapMsg := initiatingMessage.Value.ErrorIndication
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("ErrorIndication is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeHandoverCancel:
+			ngapMsg := initiatingMessage.Value.HandoverCancel
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverCancel is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUEContextReleaseRequest:
+			ngapMsg := initiatingMessage.Value.UEContextReleaseRequest
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UEContextReleaseRequest is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeNASNonDeliveryIndication:
+			ngapMsg := initiatingMessage.Value.NASNonDeliveryIndication
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("NASNonDeliveryIndication is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUERadioCapabilityInfoIndication:
+			ngapMsg := initiatingMessage.Value.UERadioCapabilityInfoIndication
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UERadioCapabilityInfoIndication is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeHandoverNotification:
+			ngapMsg := initiatingMessage.Value.HandoverNotify
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverNotify is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeHandoverPreparation:
+			ngapMsg := initiatingMessage.Value.HandoverRequired
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverRequired is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceNotify:
+			ngapMsg := initiatingMessage.Value.PDUSessionResourceNotify
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceNotify is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceModifyIndication:
+			ngapMsg := initiatingMessage.Value.PDUSessionResourceModifyIndication
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceModifyIndication is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUplinkRANStatusTransfer:
+			ngapMsg := initiatingMessage.Value.UplinkRANStatusTransfer
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UplinkRANStatusTransfer is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeLocationReport:
+			ngapMsg := initiatingMessage.Value.LocationReport
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("LocationReport is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeRRCInactiveTransitionReport:
+			ngapMsg := initiatingMessage.Value.RRCInactiveTransitionReport
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("RRCInactiveTransitionReport is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		}
+
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		successfulOutcome := ranMsg.SuccessfulOutcome
+		if successfulOutcome == nil {
+			return nil
+		}
+		switch successfulOutcome.ProcedureCode.Value {
+		case ngapType.ProcedureCodeUEContextRelease:
+			ngapMsg := successfulOutcome.Value.UEContextReleaseComplete
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UEContextReleaseComplete is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceRelease:
+			ngapMsg := successfulOutcome.Value.PDUSessionResourceReleaseResponse
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceReleaseResponse is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeInitialContextSetup:
+			ngapMsg := successfulOutcome.Value.InitialContextSetupResponse
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("InitialContextSetupResponse is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUEContextModification:
+			ngapMsg := successfulOutcome.Value.UEContextModificationResponse
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UEContextModificationResponse is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceSetup:
+			ngapMsg := successfulOutcome.Value.PDUSessionResourceSetupResponse
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceSetupResponse is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodePDUSessionResourceModify:
+			ngapMsg := successfulOutcome.Value.PDUSessionResourceModifyResponse
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("PDUSessionResourceModifyResponse is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeHandoverResourceAllocation:
+			ngapMsg := successfulOutcome.Value.HandoverRequestAcknowledge
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverRequestAcknowledge is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUERadioCapabilityCheck:
+			ngapMsg := successfulOutcome.Value.UERadioCapabilityCheckResponse
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UERadioCapabilityCheckResponse is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		}
+
+	case ngapType.NGAPPDUPresentUnsuccessfulOutcome:
+		unsuccessfulOutcome := ranMsg.UnsuccessfulOutcome
+		if unsuccessfulOutcome == nil {
+			return nil
+		}
+		switch unsuccessfulOutcome.ProcedureCode.Value {
+		case ngapType.ProcedureCodeInitialContextSetup:
+			ngapMsg := unsuccessfulOutcome.Value.InitialContextSetupFailure
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("InitialContextSetupFailure is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeUEContextModification:
+			ngapMsg := unsuccessfulOutcome.Value.UEContextModificationFailure
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("UEContextModificationFailure is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		case ngapType.ProcedureCodeHandoverResourceAllocation:
+			ngapMsg := unsuccessfulOutcome.Value.HandoverFailure
+			if ngapMsg == nil {
+				logger.NgapLog.Errorln("HandoverFailure is nil")
+				return nil
+			}
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+					aMFUENGAPID = ie.Value.AMFUENGAPID
+				}
+			}
+		}
+	}
+	return aMFUENGAPID
+}
@@ -0,0 +1,274 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+)
+
+func ueContextReleaseComplete(ranUeNgapID int64) *ngapType.NGAPPDU {
+	ngapMsg := &ngapType.UEContextReleaseComplete{}
+	ngapMsg.ProtocolIEs.List = append(ngapMsg.ProtocolIEs.List, ngapType.UEContextReleaseCompleteIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDRANUENGAPID},
+		Value: ngapType.UEContextReleaseCompleteIEsValue{
+			Present:     ngapType.UEContextReleaseCompleteIEsPresentRANUENGAPID,
+			RANUENGAPID: &ngapType.RANUENGAPID{Value: ranUeNgapID},
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentSuccessfulOutcome,
+		SuccessfulOutcome: &ngapType.SuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeUEContextRelease},
+			Value: ngapType.SuccessfulOutcomeValue{
+				Present:                  ngapType.SuccessfulOutcomePresentUEContextReleaseComplete,
+				UEContextReleaseComplete: ngapMsg,
+			},
+		},
+	}
+}
+
+func ngReset(resetType *ngapType.ResetType) *ngapType.NGAPPDU {
+	ngapMsg := &ngapType.NGReset{}
+	ngapMsg.ProtocolIEs.List = append(ngapMsg.ProtocolIEs.List, ngapType.NGResetIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDResetType},
+		Value: ngapType.NGResetIEsValue{
+			Present:   ngapType.NGResetIEsPresentResetType,
+			ResetType: resetType,
+		},
+	})
+	return &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeNGReset},
+			Value: ngapType.InitiatingMessageValue{
+				Present: ngapType.InitiatingMessagePresentNGReset,
+				NGReset: ngapMsg,
+			},
+		},
+	}
+}
+
+func initStickySessions(ran *context.Ran, ids ...int64) {
+	stickySessions = newMemoryStore(defaultSessionIdleTimeout, 0)
+	for _, id := range ids {
+		stickySessions.Put(stickyKey(ran, &ngapType.RANUENGAPID{Value: id}), "127.0.0.1")
+	}
+}
+
+func Test_EvictStickySession(t *testing.T) {
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412"}
+	other := &context.Ran{GnbIp: "10.0.0.2:38412"}
+
+	tests := []struct {
+		name      string
+		ueID      int64
+		wantFound bool
+		wantLen   int
+	}{
+		{
+			name:      "Release known UE",
+			ueID:      1,
+			wantFound: true,
+			wantLen:   2,
+		},
+		{
+			name:      "Release unknown UE",
+			ueID:      7,
+			wantFound: false,
+			wantLen:   3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				initStickySessions(ran, 1, 2)
+				stickySessions.Put(stickyKey(other, &ngapType.RANUENGAPID{Value: 1}), "127.0.0.2")
+
+				ngapID := extractUEIdentifier(ueContextReleaseComplete(tt.ueID))
+				if ngapID == nil {
+					t.Fatalf("extractUEIdentifier() returned nil")
+				}
+				if got := evictStickySession(ran, ngapID); got != tt.wantFound {
+					t.Errorf("evictStickySession() = %v, want %v", got, tt.wantFound)
+				}
+				if stickySessions.Len() != tt.wantLen {
+					t.Errorf("stickySessions length mismatch. got = %d, want = %d", stickySessions.Len(), tt.wantLen)
+				}
+				if _, found := stickySessions.Get(stickyKey(other, &ngapType.RANUENGAPID{Value: 1})); !found {
+					t.Errorf("sticky session of another gNB was evicted")
+				}
+			},
+		)
+	}
+}
+
+func Test_EvictReleasedStickySessions(t *testing.T) {
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412"}
+
+	tests := []struct {
+		name    string
+		pdu     *ngapType.NGAPPDU
+		want    int
+		wantLen int
+	}{
+		{
+			name:    "UE Context Release Complete",
+			pdu:     ueContextReleaseComplete(2),
+			want:    1,
+			wantLen: 2,
+		},
+		{
+			name: "NG Reset of the NG interface",
+			pdu: ngReset(&ngapType.ResetType{
+				Present:     ngapType.ResetTypePresentNGInterface,
+				NGInterface: &ngapType.ResetAll{Value: ngapType.ResetAllPresentResetAll},
+			}),
+			want:    3,
+			wantLen: 0,
+		},
+		{
+			name: "NG Reset of part of the NG interface",
+			pdu: ngReset(&ngapType.ResetType{
+				Present: ngapType.ResetTypePresentPartOfNGInterface,
+				PartOfNGInterface: &ngapType.UEAssociatedLogicalNGConnectionList{
+					List: []ngapType.UEAssociatedLogicalNGConnectionItem{
+						{RANUENGAPID: &ngapType.RANUENGAPID{Value: 1}},
+						{RANUENGAPID: &ngapType.RANUENGAPID{Value: 3}},
+						{AMFUENGAPID: &ngapType.AMFUENGAPID{Value: 9}},
+					},
+				},
+			}),
+			want:    2,
+			wantLen: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				initStickySessions(ran, 1, 2, 3)
+				got := evictReleasedStickySessions(ran, tt.pdu, extractUEIdentifier(tt.pdu))
+				if got != tt.want {
+					t.Errorf("evictReleasedStickySessions() = %d, want %d", got, tt.want)
+				}
+				if stickySessions.Len() != tt.wantLen {
+					t.Errorf("stickySessions length mismatch. got = %d, want = %d", stickySessions.Len(), tt.wantLen)
+				}
+			},
+		)
+	}
+}
+
+func Test_LookupStickySessionByAMFUENGAPID(t *testing.T) {
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412"}
+	owner := &GrpcServer{address: "127.0.0.200"}
+	stickySessions = newMemoryStore(defaultSessionIdleTimeout, 0)
+	ctx := context.Sctplb_Self()
+	ctx.AddNF(owner)
+	defer ctx.DeleteNF(owner)
+
+	releaseCommand := &ngapType.UEContextReleaseCommand{}
+	releaseCommand.ProtocolIEs.List = append(releaseCommand.ProtocolIEs.List, ngapType.UEContextReleaseCommandIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDUENGAPIDs},
+		Value: ngapType.UEContextReleaseCommandIEsValue{
+			Present: ngapType.UEContextReleaseCommandIEsPresentUENGAPIDs,
+			UENGAPIDs: &ngapType.UENGAPIDs{
+				Present: ngapType.UENGAPIDsPresentUENGAPIDPair,
+				UENGAPIDPair: &ngapType.UENGAPIDPair{
+					AMFUENGAPID: ngapType.AMFUENGAPID{Value: 100},
+					RANUENGAPID: ngapType.RANUENGAPID{Value: 5},
+				},
+			},
+		},
+	})
+	amfUeNgapID, ranUeNgapID := extractDownlinkUEIdentifiers(&ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentInitiatingMessage,
+		InitiatingMessage: &ngapType.InitiatingMessage{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeUEContextRelease},
+			Value: ngapType.InitiatingMessageValue{
+				Present:                 ngapType.InitiatingMessagePresentUEContextReleaseCommand,
+				UEContextReleaseCommand: releaseCommand,
+			},
+		},
+	})
+	if amfUeNgapID == nil || amfUeNgapID.Value != 100 || ranUeNgapID == nil || ranUeNgapID.Value != 5 {
+		t.Fatalf("extractDownlinkUEIdentifiers() = %v, %v", amfUeNgapID, ranUeNgapID)
+	}
+	stickySessions.Put(amfStickyKey(ran, amfUeNgapID), owner.Address())
+
+	handoverFailure := &ngapType.HandoverFailure{}
+	handoverFailure.ProtocolIEs.List = append(handoverFailure.ProtocolIEs.List, ngapType.HandoverFailureIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDAMFUENGAPID},
+		Value: ngapType.HandoverFailureIEsValue{
+			Present:     ngapType.HandoverFailureIEsPresentAMFUENGAPID,
+			AMFUENGAPID: &ngapType.AMFUENGAPID{Value: 100},
+		},
+	})
+	pdu := &ngapType.NGAPPDU{
+		Present: ngapType.NGAPPDUPresentUnsuccessfulOutcome,
+		UnsuccessfulOutcome: &ngapType.UnsuccessfulOutcome{
+			ProcedureCode: ngapType.ProcedureCode{Value: ngapType.ProcedureCodeHandoverResourceAllocation},
+			Value: ngapType.UnsuccessfulOutcomeValue{
+				Present:         ngapType.UnsuccessfulOutcomePresentHandoverFailure,
+				HandoverFailure: handoverFailure,
+			},
+		},
+	}
+
+	if ngapID := extractUEIdentifier(pdu); ngapID != nil {
+		t.Errorf("extractUEIdentifier() = %v, want nil", ngapID)
+	}
+	backend, found := lookupStickySession(ran, nil, extractAMFUEIdentifier(pdu))
+	if !found {
+		t.Fatalf("lookupStickySession() found no backend")
+	}
+	if backend != owner {
+		t.Errorf("lookupStickySession() backend mismatch. got = %v, want = %v", backend, owner)
+	}
+}
+
+// countingStore counts the writes to a SessionStore
+type countingStore struct {
+	SessionStore
+	puts int
+}
+
+func (s *countingStore) Put(key, backend string) {
+	s.puts++
+	s.SessionStore.Put(key, backend)
+}
+
+func Test_PinStickySession(t *testing.T) {
+	saved := stickySessions
+	defer func() { stickySessions = saved }()
+	store := &countingStore{SessionStore: newMemoryStore(time.Minute, 0)}
+	stickySessions = store
+
+	first := &GrpcServer{address: "127.0.0.1"}
+	second := &GrpcServer{address: "127.0.0.2"}
+	ran := &context.Ran{GnbIp: "10.0.0.1:38412"}
+	key := stickyKey(ran, &ngapType.RANUENGAPID{Value: 1})
+
+	// every message of the UE
+	for i := 0; i < 3; i++ {
+		pinStickySession(key, first)
+	}
+	if got, _ := stickySessions.Get(key); got != first.address {
+		t.Errorf("sticky session mismatch. got = %q, want = %q", got, first.address)
+	}
+	if store.puts != 1 {
+		t.Errorf("sticky session written %d times, want once", store.puts)
+	}
+	pinStickySession(key, second)
+	if got, _ := stickySessions.Get(key); got != second.address || store.puts != 2 {
+		t.Errorf("sticky session mismatch once moved. got = %q after %d writes, want = %q", got, store.puts,
+			second.address)
+	}
+}
@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	"github.com/omec-project/sctplb/logger"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+)
+
+// taiString returns a TAI as <Mcc>:<Mnc>:<Tac>, Tac in lowercase hex
+func taiString(mcc, mnc, tac string) string {
+	return mcc + ":" + mnc + ":" + strings.ToLower(tac)
+}
+
+// extractSupportedTAs returns the TAIs of the Supported TA List of an
+// NGSetupRequest or RANConfigurationUpdate, nil for any other PDU or when it
+// is absent
+func extractSupportedTAs(ranMsg *ngapType.NGAPPDU) []string {
+	var list *ngapType.SupportedTAList
+	switch {
+	case isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeNGSetup):
+		if ngapMsg := ranMsg.InitiatingMessage.Value.NGSetupRequest; ngapMsg != nil {
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDSupportedTAList {
+					list = ie.Value.SupportedTAList
+				}
+			}
+		}
+	case isProcedure(ranMsg, ngapType.NGAPPDUPresentInitiatingMessage, ngapType.ProcedureCodeRANConfigurationUpdate):
+		if ngapMsg := ranMsg.InitiatingMessage.Value.RANConfigurationUpdate; ngapMsg != nil {
+			for _, ie := range ngapMsg.ProtocolIEs.List {
+				if ie.Id.Value == ngapType.ProtocolIEIDSupportedTAList {
+					list = ie.Value.SupportedTAList
+				}
+			}
+		}
+	}
+	if list == nil {
+		return nil
+	}
+	tais := make([]string, 0, len(list.List))
+	for _, item := range list.List {
+		tac := hex.EncodeToString(item.TAC.Value)
+		for _, plmn := range item.BroadcastPLMNList.List {
+			plmnId := plmnIdString(&plmn.PLMNIdentity)
+			if plmnId == "" {
+				continue
+			}
+			mcc, mnc, _ := strings.Cut(plmnId, ":")
+			tais = append(tais, taiString(mcc, mnc, tac))
+		}
+	}
+	return tais
+}
+
+// learnRanTAs keeps the tracking areas a RAN supports when it sends
+// NGSetupRequest or updates them with RANConfigurationUpdate. Caller must
+// hold the context lock.
+func learnRanTAs(ran *context.Ran, ranMsg *ngapType.NGAPPDU) {
+	tais := extractSupportedTAs(ranMsg)
+	if tais == nil {
+		return
+	}
+	ran.Log.Infof("supported TAs: %v", tais)
+	ran.SupportedTAs = tais
+}
+
+// downlinkTargets returns the RANs an AMF message is delivered to: ran, the
+// RANs of its target list and the RANs supporting one of its TAIs
+func downlinkTargets(ran *context.Ran, response *gClient.AmfMessage) []*context.Ran {
+	var targets []*context.Ran
+	seen := make(map[*context.Ran]bool)
+	add := func(target *context.Ran) {
+		if target != nil && !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	add(ran)
+	self := context.Sctplb_Self()
+	for _, gnbId := range response.TargetGnbIds {
+		target, _ := self.RanFindByGnbId(gnbId)
+		if target == nil {
+			logger.RanLog.Infof("couldn't fetch sctp connection with GnbId: %v", gnbId)
+		}
+		add(target)
+	}
+	if len(response.Tais) == 0 {
+		return targets
+	}
+	tais := make(map[string]bool, len(response.Tais))
+	for _, tai := range response.Tais {
+		tais[taiString(tai.Mcc, tai.Mnc, tai.Tac)] = true
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.RanPool.Range(func(key, value any) bool {
+		candidate := value.(*context.Ran)
+		for _, tai := range candidate.SupportedTAs {
+			if tais[tai] {
+				add(candidate)
+				break
+			}
+		}
+		return true
+	})
+	return targets
+}
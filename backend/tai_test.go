@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/sctplb/context"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+)
+
+// ngSetupRequestWithTAs returns an NGSetupRequest supporting a TAC in each of
+// the PLMNs
+func ngSetupRequestWithTAs(tac []byte, plmns ...[]byte) *ngapType.NGAPPDU {
+	pdu := ngSetupRequest(plmns[0])
+	item := ngapType.SupportedTAItem{TAC: ngapType.TAC{Value: tac}}
+	for _, plmn := range plmns {
+		item.BroadcastPLMNList.List = append(item.BroadcastPLMNList.List, ngapType.BroadcastPLMNItem{
+			PLMNIdentity: ngapType.PLMNIdentity{Value: plmn},
+		})
+	}
+	request := pdu.InitiatingMessage.Value.NGSetupRequest
+	request.ProtocolIEs.List = append(request.ProtocolIEs.List, ngapType.NGSetupRequestIEs{
+		Id: ngapType.ProtocolIEID{Value: ngapType.ProtocolIEIDSupportedTAList},
+		Value: ngapType.NGSetupRequestIEsValue{
+			Present:         ngapType.NGSetupRequestIEsPresentSupportedTAList,
+			SupportedTAList: &ngapType.SupportedTAList{List: []ngapType.SupportedTAItem{item}},
+		},
+	})
+	return pdu
+}
+
+func Test_ExtractSupportedTAs(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranMsg *ngapType.NGAPPDU
+		want   []string
+	}{
+		{
+			name:   "NGSetupRequest",
+			ranMsg: ngSetupRequestWithTAs([]byte{0x00, 0x00, 0x01}, []byte{0x02, 0xf8, 0x39}, []byte{0x13, 0x40, 0x01}),
+			want:   []string{"208:93:000001", "310:410:000001"},
+		},
+		{
+			name:   "NGSetupRequest without TAs",
+			ranMsg: ngSetupRequest([]byte{0x02, 0xf8, 0x39}),
+		},
+		{
+			name:   "Other procedure",
+			ranMsg: initialUEMessage(nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if got := extractSupportedTAs(tt.ranMsg); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("extractSupportedTAs() = %v, want %v", got, tt.want)
+				}
+			},
+		)
+	}
+}
+
+func Test_DownlinkTargets(t *testing.T) {
+	ctx := context.Sctplb_Self()
+	newRan := func(gnbId string, tais ...string) *context.Ran {
+		ran := ctx.NewRan(&recordingConn{})
+		ran.SetRanId(gnbId)
+		ran.SupportedTAs = tais
+		return ran
+	}
+	first := newRan("gnb-1", "208:93:000001")
+	second := newRan("gnb-2", "208:93:000001", "208:93:000002")
+	third := newRan("gnb-3", "208:93:000003")
+	// not yet set up
+	unknown := ctx.NewRan(&recordingConn{})
+	defer func() {
+		for _, ran := range []*context.Ran{first, second, third, unknown} {
+			ran.Remove()
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		ran      *context.Ran
+		response *gClient.AmfMessage
+		want     []*context.Ran
+	}{
+		{
+			name:     "Single gNB",
+			ran:      first,
+			response: &gClient.AmfMessage{},
+			want:     []*context.Ran{first},
+		},
+		{
+			name:     "Target list",
+			ran:      first,
+			response: &gClient.AmfMessage{TargetGnbIds: []string{"gnb-3", "gnb-1", "gnb-4"}},
+			want:     []*context.Ran{first, third},
+		},
+		{
+			name: "Tracking areas",
+			response: &gClient.AmfMessage{Tais: []*gClient.Tai{
+				{Mcc: "208", Mnc: "93", Tac: "000002"},
+				{Mcc: "208", Mnc: "93", Tac: "00000A"},
+			}},
+			want: []*context.Ran{second},
+		},
+		{
+			name: "Tracking area of several gNBs",
+			response: &gClient.AmfMessage{
+				TargetGnbIds: []string{"gnb-3"},
+				Tais:         []*gClient.Tai{{Mcc: "208", Mnc: "93", Tac: "000001"}},
+			},
+			want: []*context.Ran{third, first, second},
+		},
+		{
+			name:     "No gNB",
+			response: &gClient.AmfMessage{Tais: []*gClient.Tai{{Mcc: "310", Mnc: "410", Tac: "000001"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				got := downlinkTargets(tt.ran, tt.response)
+				if len(got) != len(tt.want) {
+					t.Fatalf("downlinkTargets() length mismatch. got = %d, want = %d", len(got), len(tt.want))
+				}
+				// the RAN pool is not ordered
+				for _, want := range tt.want {
+					found := false
+					for _, ran := range got {
+						found = found || ran == want
+					}
+					if !found {
+						t.Errorf("downlinkTargets() misses gNB %v", *want.RanId)
+					}
+				}
+			},
+		)
+	}
+}
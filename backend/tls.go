@@ -0,0 +1,254 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	ctxt "context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/logger"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// transportCredentials secure the gRPC channel to the backends, and the
+// sticky session replication between the sctplb replicas
+var transportCredentials = insecure.NewCredentials()
+
+// SetTLS sets the credentials of the gRPC channel to the backends created
+// from now on. The channel is in plaintext unless TLS is enabled.
+func SetTLS(cfg *config.TLS) error {
+	transportCredentials = insecure.NewCredentials()
+	if cfg == nil || !cfg.Enabled {
+		logger.GrpcLog.Warnln("TLS to the backends disabled, NGAP messages are sent in plaintext")
+		return nil
+	}
+	if _, err := tlsMinVersion(cfg.MinVersion); err != nil {
+		return err
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("TLS client certificate and key must be set together")
+	}
+	reloader := &tlsReloader{cfg: *cfg}
+	if _, err := reloader.config(); err != nil {
+		return err
+	}
+	transportCredentials = &reloadingCredentials{reloader: reloader}
+	logger.GrpcLog.Infof("TLS to the backends enabled, mutual: %v server name: %q min version: %q",
+		cfg.CertFile != "", cfg.ServerName, cfg.MinVersion)
+	return nil
+}
+
+func tlsMinVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS min version %v", version)
+}
+
+// tlsReloader builds the TLS config of the channel to the backends from the
+// configured files, and rebuilds it once any of them changed on disk so that
+// rotated certificates are used by the next connection
+type tlsReloader struct {
+	cfg      config.TLS
+	mu       sync.Mutex
+	modTimes []time.Time
+	current  *tls.Config
+}
+
+func (r *tlsReloader) files() []string {
+	var files []string
+	for _, file := range []string{r.cfg.CaFile, r.cfg.CertFile, r.cfg.KeyFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// config returns the TLS config of the files on disk. If they cannot be
+// loaded, in the middle of a rotation for instance, the last loaded config is
+// kept.
+func (r *tlsReloader) config() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.stat()
+	if err == nil && r.current != nil && equalTimes(modTimes, r.modTimes) {
+		return r.current, nil
+	}
+	var cfg *tls.Config
+	if err == nil {
+		cfg, err = r.load()
+	}
+	if err != nil {
+		if r.current != nil {
+			logger.GrpcLog.Warnf("failed to reload TLS files, keeping the previous ones: %v", err)
+			return r.current, nil
+		}
+		return nil, err
+	}
+	if r.current != nil {
+		logger.GrpcLog.Infoln("TLS files reloaded")
+	}
+	r.current = cfg
+	r.modTimes = modTimes
+	return cfg, nil
+}
+
+func (r *tlsReloader) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	minVersion, err := tlsMinVersion(r.cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: r.cfg.ServerName,
+	}
+	if r.cfg.CaFile != "" {
+		pem, err := os.ReadFile(r.cfg.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate found in %v", r.cfg.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if r.cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadingCredentials are TLS credentials taking the TLS config of every
+// handshake from the reloader. As a server, as the replicas accept the
+// sticky session replication of their peers, they present the client
+// certificate and verify the client certificates against the CAs.
+type reloadingCredentials struct {
+	reloader *tlsReloader
+}
+
+func (c *reloadingCredentials) ClientHandshake(ctx ctxt.Context, authority string, rawConn net.Conn) (
+	net.Conn, credentials.AuthInfo, error,
+) {
+	cfg, err := c.reloader.config()
+	if err != nil {
+		return nil, nil, err
+	}
+	return credentials.NewTLS(cfg).ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *reloadingCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	cfg, err := c.serverConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	return credentials.NewTLS(cfg).ServerHandshake(rawConn)
+}
+
+// serverConfig returns the TLS config serving with the client certificate,
+// verifying the client certificates against the CAs if any
+func (c *reloadingCredentials) serverConfig() (*tls.Config, error) {
+	cfg, err := c.reloader.config()
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Certificates) == 0 {
+		return nil, errors.New("TLS server handshake requires a certificate")
+	}
+	cfg = cfg.Clone()
+	if cfg.RootCAs != nil {
+		cfg.ClientCAs = cfg.RootCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serverCredentials returns the credentials of the gRPC servers of sctplb,
+// in plaintext unless TLS is enabled with a certificate
+func serverCredentials() (credentials.TransportCredentials, error) {
+	creds, ok := transportCredentials.(*reloadingCredentials)
+	if !ok {
+		return insecure.NewCredentials(), nil
+	}
+	if creds.reloader.cfg.CertFile == "" {
+		return nil, errors.New("TLS enabled without a certificate to serve with")
+	}
+	return creds.Clone(), nil
+}
+
+// adminTLSConfig returns the TLS config of the admin API, nil unless TLS is
+// enabled. The operators must present a client certificate issued by the
+// CAs the backend certificates are verified against.
+func adminTLSConfig() (*tls.Config, error) {
+	creds, ok := transportCredentials.(*reloadingCredentials)
+	if !ok {
+		return nil, nil
+	}
+	if creds.reloader.cfg.CertFile == "" || creds.reloader.cfg.CaFile == "" {
+		return nil, errors.New("admin API over TLS requires a certificate and a CA to verify the clients with")
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return creds.serverConfig()
+		},
+	}, nil
+}
+
+func (c *reloadingCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+		ServerName:       c.reloader.cfg.ServerName,
+	}
+}
+
+func (c *reloadingCredentials) Clone() credentials.TransportCredentials {
+	return &reloadingCredentials{reloader: c.reloader}
+}
+
+func (c *reloadingCredentials) OverrideServerName(string) error {
+	return errors.New("server name is set in the TLS configuration")
+}
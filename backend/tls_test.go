@@ -0,0 +1,296 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omec-project/sctplb/config"
+	"github.com/omec-project/sctplb/context"
+	gClient "github.com/omec-project/sctplb/sdcoreAmfServer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCA is a local CA issuing the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of name
+func (ca *testCA) issue(t *testing.T, name string, serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeTestFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("failed to touch %v: %v", path, err)
+	}
+}
+
+func Test_SetTLS(t *testing.T) {
+	saved := transportCredentials
+	defer func() { transportCredentials = saved }()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "sctplb", 2)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestFile(t, caFile, ca.pem, time.Now())
+	writeTestFile(t, certFile, cert, time.Now())
+	writeTestFile(t, keyFile, key, time.Now())
+
+	tests := []struct {
+		name     string
+		cfg      *config.TLS
+		wantErr  bool
+		protocol string
+	}{
+		{
+			name:     "No TLS",
+			protocol: "insecure",
+		},
+		{
+			name:     "TLS disabled",
+			cfg:      &config.TLS{CaFile: caFile},
+			protocol: "insecure",
+		},
+		{
+			name:     "Mutual TLS",
+			cfg:      &config.TLS{Enabled: true, CaFile: caFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"},
+			protocol: "tls",
+		},
+		{
+			name:    "Missing CA file",
+			cfg:     &config.TLS{Enabled: true, CaFile: filepath.Join(dir, "missing.pem")},
+			wantErr: true,
+		},
+		{
+			name:    "Certificate without key",
+			cfg:     &config.TLS{Enabled: true, CaFile: caFile, CertFile: certFile},
+			wantErr: true,
+		},
+		{
+			name:    "Unsupported min version",
+			cfg:     &config.TLS{Enabled: true, CaFile: caFile, MinVersion: "1.0"},
+			wantErr: true,
+		},
+		{
+			name:    "CA file without certificate",
+			cfg:     &config.TLS{Enabled: true, CaFile: keyFile},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				err := SetTLS(tt.cfg)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("SetTLS() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err == nil && transportCredentials.Info().SecurityProtocol != tt.protocol {
+					t.Errorf("SetTLS() protocol mismatch. got = %v, want = %v",
+						transportCredentials.Info().SecurityProtocol, tt.protocol)
+				}
+			},
+		)
+	}
+}
+
+func Test_TLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	reloader := &tlsReloader{cfg: config.TLS{Enabled: true, CertFile: certFile, KeyFile: keyFile}}
+	serial := func() int64 {
+		cfg, err := reloader.config()
+		if err != nil {
+			t.Fatalf("config() error: %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+
+	modTime := time.Now().Add(-time.Minute)
+	cert, key := ca.issue(t, "sctplb", 2)
+	writeTestFile(t, certFile, cert, modTime)
+	writeTestFile(t, keyFile, key, modTime)
+	if got := serial(); got != 2 {
+		t.Errorf("certificate serial mismatch. got = %v, want = 2", got)
+	}
+
+	// rotated certificate
+	modTime = modTime.Add(time.Second)
+	cert, key = ca.issue(t, "sctplb", 3)
+	writeTestFile(t, certFile, cert, modTime)
+	writeTestFile(t, keyFile, key, modTime)
+	if got := serial(); got != 3 {
+		t.Errorf("rotated certificate serial mismatch. got = %v, want = 3", got)
+	}
+
+	// half written rotation keeps the previous certificate
+	modTime = modTime.Add(time.Second)
+	writeTestFile(t, certFile, []byte("partial"), modTime)
+	if got := serial(); got != 3 {
+		t.Errorf("certificate serial mismatch after failed reload. got = %v, want = 3", got)
+	}
+}
+
+func Test_GrpcServerTLS(t *testing.T) {
+	saved := transportCredentials
+	defer func() { transportCredentials = saved }()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	otherCA := newTestCA(t, "other ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, caFile, ca.pem, time.Now())
+
+	serverCert, serverKey := ca.issue(t, "amf.test", 2)
+	serverPair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("failed to load server certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	serverCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	tests := []struct {
+		name      string
+		issuer    *testCA
+		wantReady bool
+	}{
+		{
+			name:      "Trusted client certificate",
+			issuer:    ca,
+			wantReady: true,
+		},
+		{
+			name:   "Untrusted client certificate",
+			issuer: otherCA,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				clientCert, clientKey := tt.issuer.issue(t, "sctplb", int64(10+i))
+				certFile := filepath.Join(dir, tt.name+"-cert.pem")
+				keyFile := filepath.Join(dir, tt.name+"-key.pem")
+				writeTestFile(t, certFile, clientCert, time.Now())
+				writeTestFile(t, keyFile, clientKey, time.Now())
+				err := SetTLS(&config.TLS{
+					Enabled: true, CaFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "amf.test",
+				})
+				if err != nil {
+					t.Fatalf("SetTLS() error: %v", err)
+				}
+
+				lis, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatalf("listen failed: %v", err)
+				}
+				address := lis.Addr().String()
+				port := lis.Addr().(*net.TCPAddr).Port
+				lis.Close()
+				amf := &fakeAMF{received: make(chan *gClient.SctplbMessage, 10)}
+				server := startFakeAMF(t, amf, address, grpc.Creds(serverCreds))
+				defer server.Stop()
+
+				ctx := context.Sctplb_Self()
+				b := newGrpcServer("127.0.0.1", config.Service{})
+				ctx.Lock()
+				ctx.AddNF(b)
+				ctx.Unlock()
+				defer deleteBackendNF(b)
+				go b.ConnectToServer(port)
+
+				if !tt.wantReady {
+					time.Sleep(500 * time.Millisecond)
+					if b.State() {
+						t.Errorf("server with untrusted client certificate is READY")
+					}
+					return
+				}
+				waitForState(t, b, stateReady)
+				gnbId := "208:93:000001"
+				if err := b.Send([]byte{1}, false, &context.Ran{RanId: &gnbId}); err != nil {
+					t.Fatalf("Send() error: %v", err)
+				}
+				waitForMessage(t, amf, gnbId)
+			},
+		)
+	}
+}
@@ -5,6 +5,8 @@
 package backend
 
 import (
+	"sync/atomic"
+
 	"github.com/ishidawataru/sctp"
 	"github.com/omec-project/sctplb/config"
 	"github.com/omec-project/sctplb/context"
@@ -25,9 +27,23 @@ type BackendSvc struct {
 var _ context.NF = &GrpcServer{}
 
 type GrpcServer struct {
-	address string
-	conn    *grpc.ClientConn
-	gc      gClient.NgapServiceClient
-	state   bool
-	stream  gClient.NgapService_HandleMessageClient
+	address  string
+	conn     *grpc.ClientConn
+	gc       gClient.NgapServiceClient
+	state    backendState
+	stream   gClient.NgapService_HandleMessageClient
+	weight   int             // static weight of the service, overrides capacity
+	snssais  []config.Snssai // slices served by the service
+	plmnIds  []config.PlmnId // PLMNs served by the service
+	capacity atomic.Int64    // RelativeAMFCapacity learned from the AMF
+	inFlight atomic.Int64    // messages queued or being written to the stream
+	queue    *sendQueue
+	// AMF Set ID and AMF Pointer of the GUAMIs served by the AMF
+	servedAMFs atomic.Pointer[[]amfIdentity]
+	// reported NOT_SERVING by the health check of the backend
+	notServing atomic.Bool
+	// drained by the operator, DRAINING again after a reconnect
+	drainPinned atomic.Bool
+	// NG Setup data of the AMF
+	setup atomic.Pointer[amfSetup]
 }
@@ -6,7 +6,9 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/omec-project/sctplb/logger"
 	"go.yaml.in/yaml/v4"
@@ -25,16 +27,190 @@ type Info struct {
 	Description string `yaml:"description,omitempty"`
 }
 
+// Service is a backend NF service discovered through DNS. A non-zero Weight
+// is used by the weighted round robin scheduler for each of its instances in
+// place of the RelativeAMFCapacity they advertise. Snssais lists the network
+// slices the service serves; services without Snssais form the default pool
+// of the UEs which give no slice hint. The slice hint is the Allowed NSSAI a
+// gNB only sends in the InitialUEMessage of a UE rerouted by an AMF, so the
+// slice pools only take rerouted UEs and every other UE goes to the default
+// pool. PlmnIds lists the PLMNs whose gNBs the
+// service serves; a service without PlmnIds serves every PLMN.
 type Service struct {
-	Uri string `yaml:"uri,omitempty"`
+	Uri     string   `yaml:"uri,omitempty"`
+	Weight  int      `yaml:"weight,omitempty"`
+	Snssais []Snssai `yaml:"snssais,omitempty"`
+	PlmnIds []PlmnId `yaml:"plmnIds,omitempty"`
 }
 
+// PlmnId is a PLMN, Mnc has 2 or 3 digits
+type PlmnId struct {
+	Mcc string `yaml:"mcc"`
+	Mnc string `yaml:"mnc"`
+}
+
+// Snssai is a network slice. An empty Sd matches any slice differentiator of
+// the Sst.
+type Snssai struct {
+	Sst int32  `yaml:"sst"`
+	Sd  string `yaml:"sd,omitempty"`
+}
+
+// StickySession limits the UE to backend affinity table. Sessions idle for
+// longer than IdleTimeout are removed every SweepInterval, and once MaxEntries
+// sessions exist the least recently used one is evicted (0 means unlimited).
+// FailoverPolicy decides what happens to the sessions of a deleted backend:
+// "drop" removes them, "repin" moves them to a single replacement backend.
+// Store selects the "memory" store of a single replica, or the "replicated"
+// store shared with the peer replicas listed under Replication. Disabled
+// turns the sessions off, relying on the consistent-hash scheduler to keep
+// the UEs on their backends: it requires the consistent-hash scheduler and
+// services without Snssais, and the new UEs are then neither routed by the
+// GUAMI of their 5G-S-TMSI nor steered around overloaded backends. The UEs of
+// a drained backend move to the other backends, and the messages carrying
+// only an AMF-UE-NGAP-ID may reach another backend than the UE's.
+type StickySession struct {
+	Disabled       bool          `yaml:"disabled,omitempty"`
+	IdleTimeout    time.Duration `yaml:"idleTimeout,omitempty"`
+	SweepInterval  time.Duration `yaml:"sweepInterval,omitempty"`
+	MaxEntries     int           `yaml:"maxEntries,omitempty"`
+	FailoverPolicy string        `yaml:"failoverPolicy,omitempty" valid:"in(drop|repin)"`
+	Store          string        `yaml:"store,omitempty" valid:"in(memory|replicated)"`
+	Replication    *Replication  `yaml:"replication,omitempty"`
+}
+
+// Replication holds the gRPC address the replicated sticky session store
+// listens on, and the replication addresses of the peer replicas
+type Replication struct {
+	ListenAddr string   `yaml:"listenAddr,omitempty"`
+	Peers      []string `yaml:"peers,omitempty"`
+}
+
+// Persistence keeps the sticky sessions and the gNB IDs learned per gNB
+// address in Path across restarts. The write-ahead log is compacted into a
+// snapshot every CompactThreshold records.
+type Persistence struct {
+	Path             string `yaml:"path,omitempty"`
+	CompactThreshold int    `yaml:"compactThreshold,omitempty"`
+}
+
+// SendQueue bounds the outbound queue of every backend to Depth messages.
+// Overflow decides what happens to a message for a full queue: "block" waits
+// for room, "drop-oldest" drops the oldest queued message, "reroute" sends
+// the message of a UE without sticky session to another backend and drops
+// any other. A stream which cannot take a message within Timeout is
+// considered wedged and reopened.
+type SendQueue struct {
+	Depth    int           `yaml:"depth,omitempty"`
+	Overflow string        `yaml:"overflow,omitempty" valid:"in(block|drop-oldest|reroute)"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Reconnect sets how a backend whose stream broke is reconnected: the delay
+// between attempts starts at InitialBackoff and doubles up to MaxBackoff. The
+// backend is deleted once it could not be reached for FailAfter.
+type Reconnect struct {
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff,omitempty"`
+	FailAfter      time.Duration `yaml:"failAfter,omitempty"`
+}
+
+// Keepalive sets the gRPC keepalive pings to the backends: a ping is sent
+// after Time without activity, and the connection is closed if it is not
+// answered within Timeout. The backends must permit pings that often.
+type Keepalive struct {
+	Time                time.Duration `yaml:"time,omitempty"`
+	Timeout             time.Duration `yaml:"timeout,omitempty"`
+	PermitWithoutStream bool          `yaml:"permitWithoutStream,omitempty"`
+}
+
+// HealthCheck polls the grpc.health.v1 service of the backends every
+// Interval for the status of Service, the whole server when empty. A backend
+// which is NOT_SERVING, or does not answer within Timeout, takes no new UEs.
+type HealthCheck struct {
+	Disabled bool          `yaml:"disabled,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Service  string        `yaml:"service,omitempty"`
+}
+
+// TLS secures the gRPC channel to the backends. CaFile is the PEM bundle of
+// the CAs the backend certificates are verified against, CertFile and KeyFile
+// the client certificate presented for mutual TLS. ServerName overrides the
+// name the backend certificates are verified for, MinVersion is "1.2" or
+// "1.3". The files are reloaded when they change on disk. The sticky session
+// replication between the sctplb replicas is secured the same way, each
+// replica serving its peers with the client certificate.
+type TLS struct {
+	Enabled    bool   `yaml:"enabled,omitempty"`
+	CaFile     string `yaml:"caFile,omitempty"`
+	CertFile   string `yaml:"certFile,omitempty"`
+	KeyFile    string `yaml:"keyFile,omitempty"`
+	ServerName string `yaml:"serverName,omitempty"`
+	MinVersion string `yaml:"minVersion,omitempty" valid:"in(1.2|1.3)"`
+}
+
+// Admin is the HTTP API the operators drain the backends with, listening on
+// ListenAddr. When TLS is enabled the API is served with the TLS certificate,
+// and the operators must present a client certificate issued by the TLS CAs.
+// Without TLS anyone reaching the API can drain the backends, so ListenAddr
+// must be a loopback address, e.g. "127.0.0.1:9090".
+type Admin struct {
+	ListenAddr string `yaml:"listenAddr,omitempty"`
+}
+
+// NgSetup makes sctplb answer the NG Setup Requests of the gNBs itself when
+// Local is set, presenting the backends as the single AMF AmfName
+type NgSetup struct {
+	Local   bool   `yaml:"local,omitempty"`
+	AmfName string `yaml:"amfName,omitempty"`
+}
+
+// ProcedureRouting routes the non-UE-associated procedures of the gNBs:
+// "broadcast" sends them to every backend and merges the responses into one,
+// "first-ready" to the first READY backend, "owner" to the backend the gNB is
+// assigned to as in per-gNB dispatch mode. RAN Configuration Update and Error
+// Indication are broadcast and Uplink RAN Configuration Transfer sent to the
+// first READY backend by default.
+type ProcedureRouting struct {
+	RanConfigurationUpdate         string `yaml:"ranConfigurationUpdate,omitempty" valid:"in(broadcast|first-ready|owner)"`
+	ErrorIndication                string `yaml:"errorIndication,omitempty" valid:"in(broadcast|first-ready|owner)"`
+	UplinkRanConfigurationTransfer string `yaml:"uplinkRanConfigurationTransfer,omitempty" valid:"in(broadcast|first-ready|owner)"`
+}
+
+// NoBackend sets the answers of sctplb to the gNBs when no backend can take
+// their messages: an NG Setup Failure with SetupFailureCause and TimeToWait,
+// rounded up to an NGAP TimeToWait, for an NG Setup Request, and an Error
+// Indication with ErrorIndicationCause for a UE-associated message. Causes
+// default to "unspecified" and TimeToWait to 10s.
+type NoBackend struct {
+	SetupFailureCause    string        `yaml:"setupFailureCause,omitempty" valid:"in(control-processing-overload|not-enough-user-plane-processing-resources|hardware-failure|om-intervention|unknown-plmn|unspecified|transport-resource-unavailable|message-not-compatible-with-receiver-state)"`
+	TimeToWait           time.Duration `yaml:"timeToWait,omitempty"`
+	ErrorIndicationCause string        `yaml:"errorIndicationCause,omitempty" valid:"in(control-processing-overload|not-enough-user-plane-processing-resources|hardware-failure|om-intervention|unknown-plmn|unspecified|transport-resource-unavailable|message-not-compatible-with-receiver-state)"`
+}
+
+// Configuration of sctplb. The backends of the grpc Type are connected to on
+// SctpGrpcPort, the AMFs of the sctp Type on their N2Port, 38412 by default.
 type Configuration struct {
-	Type         string    `yaml:"type,omitempty" valid:"required,in(grpc)"`
-	Services     []Service `yaml:"services,omitempty"`
-	NgapIpList   []string  `yaml:"ngapIpList,omitempty"`
-	NgapPort     int       `yaml:"ngappPort,omitempty"`
-	SctpGrpcPort int       `yaml:"sctpGrpcPort,omitempty"`
+	Type          string            `yaml:"type,omitempty" valid:"required,in(grpc|sctp)"`
+	Services      []Service         `yaml:"services,omitempty"`
+	NgapIpList    []string          `yaml:"ngapIpList,omitempty"`
+	NgapPort      int               `yaml:"ngappPort,omitempty"`
+	SctpGrpcPort  int               `yaml:"sctpGrpcPort,omitempty"`
+	N2Port        int               `yaml:"n2Port,omitempty"`
+	DispatchMode  string            `yaml:"dispatchMode,omitempty" valid:"in(per-ue|per-gnb)"`
+	Scheduler     string            `yaml:"scheduler,omitempty" valid:"in(round-robin|weighted-round-robin|least-active-ues|least-in-flight|power-of-two-choices|consistent-hash)"`
+	StickySession *StickySession    `yaml:"stickySession,omitempty"`
+	Persistence   *Persistence      `yaml:"persistence,omitempty"`
+	SendQueue     *SendQueue        `yaml:"sendQueue,omitempty"`
+	Reconnect     *Reconnect        `yaml:"reconnect,omitempty"`
+	Keepalive     *Keepalive        `yaml:"keepalive,omitempty"`
+	HealthCheck   *HealthCheck      `yaml:"healthCheck,omitempty"`
+	TLS           *TLS              `yaml:"tls,omitempty"`
+	Admin         *Admin            `yaml:"admin,omitempty"`
+	NgSetup       *NgSetup          `yaml:"ngSetup,omitempty"`
+	Routing       *ProcedureRouting `yaml:"procedureRouting,omitempty"`
+	NoBackend     *NoBackend        `yaml:"noBackend,omitempty"`
 }
 
 func InitConfigFactory(f string) (Config, error) {
@@ -54,5 +230,26 @@ func InitConfigFactory(f string) (Config, error) {
 		logger.CfgLog.Errorf("configuration parsing failed %v", sctplbConfig.Configuration)
 		return sctplbConfig, errors.New("configuration parsing failed")
 	}
+	if err := sctplbConfig.Configuration.validate(); err != nil {
+		logger.CfgLog.Errorf("configuration validation failed %v", err)
+		return sctplbConfig, err
+	}
 	return sctplbConfig, nil
 }
+
+// validate rejects the settings the messages of a UE could not reach the
+// same backend with
+func (c *Configuration) validate() error {
+	if c.StickySession == nil || !c.StickySession.Disabled {
+		return nil
+	}
+	if c.Scheduler != "consistent-hash" {
+		return errors.New("sticky sessions can only be disabled with the consistent-hash scheduler")
+	}
+	for _, svc := range c.Services {
+		if len(svc.Snssais) > 0 {
+			return fmt.Errorf("sticky sessions can not be disabled with the slice pool of service %v", svc.Uri)
+		}
+	}
+	return nil
+}
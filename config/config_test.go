@@ -7,6 +7,7 @@ package config
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_InitConfigFactory(t *testing.T) {
@@ -26,6 +27,14 @@ func Test_InitConfigFactory(t *testing.T) {
 			NgapIpList:   []string{"0.0.0.0"},
 			NgapPort:     38416,
 			SctpGrpcPort: 5000,
+			Scheduler:    "round-robin",
+			StickySession: &StickySession{
+				IdleTimeout:    time.Hour,
+				SweepInterval:  time.Minute,
+				MaxEntries:     100000,
+				FailoverPolicy: "drop",
+				Store:          "memory",
+			},
 		},
 	}
 
@@ -41,3 +50,48 @@ func Test_InitConfigFactory(t *testing.T) {
 	},
 	)
 }
+
+func Test_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Configuration
+		wantErr bool
+	}{
+		{
+			name: "Sticky sessions enabled",
+			cfg:  Configuration{Scheduler: "round-robin", StickySession: &StickySession{}},
+		},
+		{
+			name: "Sticky sessions disabled with consistent-hash",
+			cfg: Configuration{
+				Scheduler:     "consistent-hash",
+				Services:      []Service{{Uri: "amf"}},
+				StickySession: &StickySession{Disabled: true},
+			},
+		},
+		{
+			name:    "Sticky sessions disabled with another scheduler",
+			cfg:     Configuration{Scheduler: "round-robin", StickySession: &StickySession{Disabled: true}},
+			wantErr: true,
+		},
+		{
+			name: "Sticky sessions disabled with slice pools",
+			cfg: Configuration{
+				Scheduler:     "consistent-hash",
+				Services:      []Service{{Uri: "amf", Snssais: []Snssai{{Sst: 1}}}},
+				StickySession: &StickySession{Disabled: true},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(
+			tt.name, func(t *testing.T) {
+				if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+					t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			},
+		)
+	}
+}
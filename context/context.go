@@ -32,6 +32,17 @@ type Ran struct {
 	RanId *string
 	Name  string
 	GnbIp string
+	// PLMN of the Global RAN Node ID as <Mcc>:<Mnc>, pins the gNB to the
+	// backends serving it
+	PlmnId string
+	// TAIs of the Supported TA List of the gNB as <Mcc>:<Mnc>:<Tac>, Tac in
+	// hex, targets of the AMF messages sent to tracking areas
+	SupportedTAs []string
+	// backend handling every message of the gNB in per-gNB dispatch mode
+	Backend NF `json:"-"`
+	// NG Setup Request of the gNB, replayed on the N2 associations to the
+	// AMFs of the sctp backends
+	SetupRequest []byte `json:"-"`
 	/* socket Connect*/
 	Conn net.Conn `json:"-"`
 
@@ -79,7 +90,7 @@ func (context *SctplbContext) RanFindByConn(conn net.Conn) (*Ran, bool) {
 func (context *SctplbContext) RanFindByGnbId(gnbId string) (ran *Ran, ok bool) {
 	context.RanPool.Range(func(key, value any) bool {
 		candidate := value.(*Ran)
-		if ok = (*candidate.RanId == gnbId); ok {
+		if ok = (candidate.RanId != nil && *candidate.RanId == gnbId); ok {
 			ran = candidate
 			return false
 		}
@@ -114,6 +125,7 @@ type NF interface {
 	ConnectToServer(int)
 	Send([]byte, bool, *Ran) error
 	State() bool
+	Address() string
 }
 
 func (context *SctplbContext) DeleteNF(target NF) {
@@ -49,13 +49,35 @@ func action(ctx context.Context, c *cli.Command) error {
 		return err
 	}
 
-	// Read messages from SCTP Sockets and push it on channel
-	logger.AppLog.Infof("sctp port: %d grpc port: %d", sctplbConfig.Configuration.NgapPort, sctplbConfig.Configuration.SctpGrpcPort)
-	backend.ServiceRun(sctplbConfig.Configuration.NgapIpList, sctplbConfig.Configuration.NgapPort)
-
 	b := backend.BackendSvc{
 		Cfg: sctplbConfig,
 	}
+	// Read messages from SCTP Sockets and push it on channel
+	logger.AppLog.Infof("sctp port: %d %v backend port: %d", sctplbConfig.Configuration.NgapPort,
+		sctplbConfig.Configuration.Type, b.BackendPort())
+	backend.SetDispatchMode(sctplbConfig.Configuration.DispatchMode)
+	backend.SetScheduler(sctplbConfig.Configuration.Scheduler)
+	backend.SetSendQueue(sctplbConfig.Configuration.SendQueue)
+	backend.SetReconnect(sctplbConfig.Configuration.Reconnect)
+	backend.SetKeepalive(sctplbConfig.Configuration.Keepalive)
+	backend.SetHealthCheck(sctplbConfig.Configuration.HealthCheck)
+	backend.SetNGSetup(sctplbConfig.Configuration.NgSetup)
+	backend.SetProcedureRouting(sctplbConfig.Configuration.Routing)
+	backend.SetNoBackend(sctplbConfig.Configuration.NoBackend)
+	if err := backend.SetTLS(sctplbConfig.Configuration.TLS); err != nil {
+		logger.AppLog.Errorf("failed to initialize TLS: %v", err)
+		return err
+	}
+	if err := backend.InitStickySessions(sctplbConfig.Configuration); err != nil {
+		logger.AppLog.Errorf("failed to initialize sticky sessions: %v", err)
+		return err
+	}
+	if _, err := backend.ServeAdmin(sctplbConfig.Configuration.Admin); err != nil {
+		logger.AppLog.Errorf("failed to start admin API: %v", err)
+		return err
+	}
+	backend.ServiceRun(sctplbConfig.Configuration.NgapIpList, sctplbConfig.Configuration.NgapPort)
+
 	b.DispatchAddServer()
 
 	return nil
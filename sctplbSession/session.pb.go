@@ -0,0 +1,468 @@
+// SPDX-FileCopyrightText: 2023 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        v5.28.2
+// source: session.proto
+
+package sctplbSession
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type UpdateType int32
+
+const (
+	UpdateType_UNKNOWN       UpdateType = 0
+	UpdateType_PUT           UpdateType = 1
+	UpdateType_DELETE        UpdateType = 2
+	UpdateType_DELETE_PREFIX UpdateType = 3
+	UpdateType_REASSIGN      UpdateType = 4
+)
+
+// Enum value maps for UpdateType.
+var (
+	UpdateType_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "PUT",
+		2: "DELETE",
+		3: "DELETE_PREFIX",
+		4: "REASSIGN",
+	}
+	UpdateType_value = map[string]int32{
+		"UNKNOWN":       0,
+		"PUT":           1,
+		"DELETE":        2,
+		"DELETE_PREFIX": 3,
+		"REASSIGN":      4,
+	}
+)
+
+func (x UpdateType) Enum() *UpdateType {
+	p := new(UpdateType)
+	*p = x
+	return p
+}
+
+func (x UpdateType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (UpdateType) Descriptor() protoreflect.EnumDescriptor {
+	return file_session_proto_enumTypes[0].Descriptor()
+}
+
+func (UpdateType) Type() protoreflect.EnumType {
+	return &file_session_proto_enumTypes[0]
+}
+
+func (x UpdateType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use UpdateType.Descriptor instead.
+func (UpdateType) EnumDescriptor() ([]byte, []int) {
+	return file_session_proto_rawDescGZIP(), []int{0}
+}
+
+// SessionUpdate replicates one change of a sticky session store. Key holds
+// the session key, or the key prefix of DELETE_PREFIX. Backend holds the
+// backend address of PUT, or the new backend of REASSIGN (empty to drop).
+// Version orders the changes of a session across the replicas, the latest
+// one wins.
+type SessionUpdate struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SctplbId      string                 `protobuf:"bytes,1,opt,name=SctplbId,proto3" json:"SctplbId,omitempty"`
+	Type          UpdateType             `protobuf:"varint,2,opt,name=Type,proto3,enum=sctplbSession.UpdateType" json:"Type,omitempty"`
+	Key           string                 `protobuf:"bytes,3,opt,name=Key,proto3" json:"Key,omitempty"`
+	Backend       string                 `protobuf:"bytes,4,opt,name=Backend,proto3" json:"Backend,omitempty"`
+	FromBackend   string                 `protobuf:"bytes,5,opt,name=FromBackend,proto3" json:"FromBackend,omitempty"`
+	Version       int64                  `protobuf:"varint,6,opt,name=Version,proto3" json:"Version,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SessionUpdate) Reset() {
+	*x = SessionUpdate{}
+	mi := &file_session_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionUpdate) ProtoMessage() {}
+
+func (x *SessionUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_session_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionUpdate.ProtoReflect.Descriptor instead.
+func (*SessionUpdate) Descriptor() ([]byte, []int) {
+	return file_session_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SessionUpdate) GetSctplbId() string {
+	if x != nil {
+		return x.SctplbId
+	}
+	return ""
+}
+
+func (x *SessionUpdate) GetType() UpdateType {
+	if x != nil {
+		return x.Type
+	}
+	return UpdateType_UNKNOWN
+}
+
+func (x *SessionUpdate) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *SessionUpdate) GetBackend() string {
+	if x != nil {
+		return x.Backend
+	}
+	return ""
+}
+
+func (x *SessionUpdate) GetFromBackend() string {
+	if x != nil {
+		return x.FromBackend
+	}
+	return ""
+}
+
+func (x *SessionUpdate) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+// SessionEntry is a session of a snapshot, or the tombstone of a deleted
+// session when Deleted is set
+type SessionEntry struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           string                 `protobuf:"bytes,1,opt,name=Key,proto3" json:"Key,omitempty"`
+	Backend       string                 `protobuf:"bytes,2,opt,name=Backend,proto3" json:"Backend,omitempty"`
+	Version       int64                  `protobuf:"varint,3,opt,name=Version,proto3" json:"Version,omitempty"`
+	Deleted       bool                   `protobuf:"varint,4,opt,name=Deleted,proto3" json:"Deleted,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SessionEntry) Reset() {
+	*x = SessionEntry{}
+	mi := &file_session_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionEntry) ProtoMessage() {}
+
+func (x *SessionEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_session_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionEntry.ProtoReflect.Descriptor instead.
+func (*SessionEntry) Descriptor() ([]byte, []int) {
+	return file_session_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SessionEntry) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *SessionEntry) GetBackend() string {
+	if x != nil {
+		return x.Backend
+	}
+	return ""
+}
+
+func (x *SessionEntry) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *SessionEntry) GetDeleted() bool {
+	if x != nil {
+		return x.Deleted
+	}
+	return false
+}
+
+type SnapshotRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	SctplbId      string                 `protobuf:"bytes,1,opt,name=SctplbId,proto3" json:"SctplbId,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotRequest) Reset() {
+	*x = SnapshotRequest{}
+	mi := &file_session_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotRequest) ProtoMessage() {}
+
+func (x *SnapshotRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_session_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotRequest.ProtoReflect.Descriptor instead.
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return file_session_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SnapshotRequest) GetSctplbId() string {
+	if x != nil {
+		return x.SctplbId
+	}
+	return ""
+}
+
+type Snapshot struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Entries       []*SessionEntry        `protobuf:"bytes,1,rep,name=Entries,proto3" json:"Entries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Snapshot) Reset() {
+	*x = Snapshot{}
+	mi := &file_session_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Snapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Snapshot) ProtoMessage() {}
+
+func (x *Snapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_session_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Snapshot.ProtoReflect.Descriptor instead.
+func (*Snapshot) Descriptor() ([]byte, []int) {
+	return file_session_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Snapshot) GetEntries() []*SessionEntry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+type ReplicateResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Applied       uint64                 `protobuf:"varint,1,opt,name=Applied,proto3" json:"Applied,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReplicateResponse) Reset() {
+	*x = ReplicateResponse{}
+	mi := &file_session_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReplicateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReplicateResponse) ProtoMessage() {}
+
+func (x *ReplicateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_session_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReplicateResponse.ProtoReflect.Descriptor instead.
+func (*ReplicateResponse) Descriptor() ([]byte, []int) {
+	return file_session_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ReplicateResponse) GetApplied() uint64 {
+	if x != nil {
+		return x.Applied
+	}
+	return 0
+}
+
+var File_session_proto protoreflect.FileDescriptor
+
+const file_session_proto_rawDesc = "" +
+	"\n" +
+	"\rsession.proto\x12\rsctplbSession\"\xc2\x01\n" +
+	"\rSessionUpdate\x12\x1a\n" +
+	"\bSctplbId\x18\x01 \x01(\tR\bSctplbId\x12-\n" +
+	"\x04Type\x18\x02 \x01(\x0e2\x19.sctplbSession.updateTypeR\x04Type\x12\x10\n" +
+	"\x03Key\x18\x03 \x01(\tR\x03Key\x12\x18\n" +
+	"\aBackend\x18\x04 \x01(\tR\aBackend\x12 \n" +
+	"\vFromBackend\x18\x05 \x01(\tR\vFromBackend\x12\x18\n" +
+	"\aVersion\x18\x06 \x01(\x03R\aVersion\"n\n" +
+	"\fSessionEntry\x12\x10\n" +
+	"\x03Key\x18\x01 \x01(\tR\x03Key\x12\x18\n" +
+	"\aBackend\x18\x02 \x01(\tR\aBackend\x12\x18\n" +
+	"\aVersion\x18\x03 \x01(\x03R\aVersion\x12\x18\n" +
+	"\aDeleted\x18\x04 \x01(\bR\aDeleted\"-\n" +
+	"\x0fSnapshotRequest\x12\x1a\n" +
+	"\bSctplbId\x18\x01 \x01(\tR\bSctplbId\"A\n" +
+	"\bSnapshot\x125\n" +
+	"\aEntries\x18\x01 \x03(\v2\x1b.sctplbSession.SessionEntryR\aEntries\"-\n" +
+	"\x11ReplicateResponse\x12\x18\n" +
+	"\aApplied\x18\x01 \x01(\x04R\aApplied*O\n" +
+	"\n" +
+	"updateType\x12\v\n" +
+	"\aUNKNOWN\x10\x00\x12\a\n" +
+	"\x03PUT\x10\x01\x12\n" +
+	"\n" +
+	"\x06DELETE\x10\x02\x12\x11\n" +
+	"\rDELETE_PREFIX\x10\x03\x12\f\n" +
+	"\bREASSIGN\x10\x042\xab\x01\n" +
+	"\x0eSessionService\x12O\n" +
+	"\tReplicate\x12\x1c.sctplbSession.SessionUpdate\x1a .sctplbSession.ReplicateResponse\"\x00(\x01\x12H\n" +
+	"\vGetSnapshot\x12\x1e.sctplbSession.SnapshotRequest\x1a\x17.sctplbSession.Snapshot\"\x00B\x11Z\x0f./sctplbSessionb\x06proto3"
+
+var (
+	file_session_proto_rawDescOnce sync.Once
+	file_session_proto_rawDescData []byte
+)
+
+func file_session_proto_rawDescGZIP() []byte {
+	file_session_proto_rawDescOnce.Do(func() {
+		file_session_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_session_proto_rawDesc), len(file_session_proto_rawDesc)))
+	})
+	return file_session_proto_rawDescData
+}
+
+var file_session_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_session_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_session_proto_goTypes = []any{
+	(UpdateType)(0),           // 0: sctplbSession.updateType
+	(*SessionUpdate)(nil),     // 1: sctplbSession.SessionUpdate
+	(*SessionEntry)(nil),      // 2: sctplbSession.SessionEntry
+	(*SnapshotRequest)(nil),   // 3: sctplbSession.SnapshotRequest
+	(*Snapshot)(nil),          // 4: sctplbSession.Snapshot
+	(*ReplicateResponse)(nil), // 5: sctplbSession.ReplicateResponse
+}
+var file_session_proto_depIdxs = []int32{
+	0, // 0: sctplbSession.SessionUpdate.Type:type_name -> sctplbSession.updateType
+	2, // 1: sctplbSession.Snapshot.Entries:type_name -> sctplbSession.SessionEntry
+	1, // 2: sctplbSession.SessionService.Replicate:input_type -> sctplbSession.SessionUpdate
+	3, // 3: sctplbSession.SessionService.GetSnapshot:input_type -> sctplbSession.SnapshotRequest
+	5, // 4: sctplbSession.SessionService.Replicate:output_type -> sctplbSession.ReplicateResponse
+	4, // 5: sctplbSession.SessionService.GetSnapshot:output_type -> sctplbSession.Snapshot
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_session_proto_init() }
+func file_session_proto_init() {
+	if File_session_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_session_proto_rawDesc), len(file_session_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_session_proto_goTypes,
+		DependencyIndexes: file_session_proto_depIdxs,
+		EnumInfos:         file_session_proto_enumTypes,
+		MessageInfos:      file_session_proto_msgTypes,
+	}.Build()
+	File_session_proto = out.File
+	file_session_proto_goTypes = nil
+	file_session_proto_depIdxs = nil
+}
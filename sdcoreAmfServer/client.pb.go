@@ -34,6 +34,7 @@ const (
 	MsgType_REDIRECT_MSG MsgType = 4
 	MsgType_GNB_DISC     MsgType = 5
 	MsgType_GNB_CONN     MsgType = 6
+	MsgType_AMF_DRAIN    MsgType = 7
 )
 
 // Enum value maps for MsgType.
@@ -46,6 +47,7 @@ var (
 		4: "REDIRECT_MSG",
 		5: "GNB_DISC",
 		6: "GNB_CONN",
+		7: "AMF_DRAIN",
 	}
 	MsgType_value = map[string]int32{
 		"UNKNOWN":      0,
@@ -55,6 +57,7 @@ var (
 		"REDIRECT_MSG": 4,
 		"GNB_DISC":     5,
 		"GNB_CONN":     6,
+		"AMF_DRAIN":    7,
 	}
 )
 
@@ -170,6 +173,68 @@ func (x *SctplbMessage) GetGnbId() string {
 	return ""
 }
 
+// Tracking Area Identity, Tac in hex
+type Tai struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Mcc string `protobuf:"bytes,1,opt,name=Mcc,proto3" json:"Mcc,omitempty"`
+	Mnc string `protobuf:"bytes,2,opt,name=Mnc,proto3" json:"Mnc,omitempty"`
+	Tac string `protobuf:"bytes,3,opt,name=Tac,proto3" json:"Tac,omitempty"`
+}
+
+func (x *Tai) Reset() {
+	*x = Tai{}
+	mi := &file_client_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Tai) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Tai) ProtoMessage() {}
+
+func (x *Tai) ProtoReflect() protoreflect.Message {
+	mi := &file_client_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Tai.ProtoReflect.Descriptor instead.
+func (*Tai) Descriptor() ([]byte, []int) {
+	return file_client_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Tai) GetMcc() string {
+	if x != nil {
+		return x.Mcc
+	}
+	return ""
+}
+
+func (x *Tai) GetMnc() string {
+	if x != nil {
+		return x.Mnc
+	}
+	return ""
+}
+
+func (x *Tai) GetTac() string {
+	if x != nil {
+		return x.Tac
+	}
+	return ""
+}
+
 type AmfMessage struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -182,11 +247,16 @@ type AmfMessage struct {
 	GnbId      string  `protobuf:"bytes,5,opt,name=GnbId,proto3" json:"GnbId,omitempty"`
 	VerboseMsg string  `protobuf:"bytes,6,opt,name=VerboseMsg,proto3" json:"VerboseMsg,omitempty"`
 	Msg        []byte  `protobuf:"bytes,7,opt,name=Msg,proto3" json:"Msg,omitempty"`
+	// further gNBs an AMF_MSG is delivered to, by GnbId
+	TargetGnbIds []string `protobuf:"bytes,8,rep,name=TargetGnbIds,proto3" json:"TargetGnbIds,omitempty"`
+	// an AMF_MSG is also delivered to every gNB supporting one of the Tais,
+	// e.g. Paging
+	Tais []*Tai `protobuf:"bytes,9,rep,name=Tais,proto3" json:"Tais,omitempty"`
 }
 
 func (x *AmfMessage) Reset() {
 	*x = AmfMessage{}
-	mi := &file_client_proto_msgTypes[1]
+	mi := &file_client_proto_msgTypes[2]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -198,7 +268,7 @@ func (x *AmfMessage) String() string {
 func (*AmfMessage) ProtoMessage() {}
 
 func (x *AmfMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_client_proto_msgTypes[1]
+	mi := &file_client_proto_msgTypes[2]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -211,7 +281,7 @@ func (x *AmfMessage) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use AmfMessage.ProtoReflect.Descriptor instead.
 func (*AmfMessage) Descriptor() ([]byte, []int) {
-	return file_client_proto_rawDescGZIP(), []int{1}
+	return file_client_proto_rawDescGZIP(), []int{2}
 }
 
 func (x *AmfMessage) GetAmfId() string {
@@ -263,6 +333,20 @@ func (x *AmfMessage) GetMsg() []byte {
 	return nil
 }
 
+func (x *AmfMessage) GetTargetGnbIds() []string {
+	if x != nil {
+		return x.TargetGnbIds
+	}
+	return nil
+}
+
+func (x *AmfMessage) GetTais() []*Tai {
+	if x != nil {
+		return x.Tais
+	}
+	return nil
+}
+
 var File_client_proto protoreflect.FileDescriptor
 
 var file_client_proto_rawDesc = []byte{
@@ -280,36 +364,45 @@ var file_client_proto_rawDesc = []byte{
 	0x01, 0x28, 0x09, 0x52, 0x0a, 0x56, 0x65, 0x72, 0x62, 0x6f, 0x73, 0x65, 0x4d, 0x73, 0x67, 0x12,
 	0x10, 0x0a, 0x03, 0x4d, 0x73, 0x67, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x4d, 0x73,
 	0x67, 0x12, 0x14, 0x0a, 0x05, 0x47, 0x6e, 0x62, 0x49, 0x64, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x05, 0x47, 0x6e, 0x62, 0x49, 0x64, 0x22, 0xdc, 0x01, 0x0a, 0x0a, 0x41, 0x6d, 0x66, 0x4d,
-	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x41, 0x6d, 0x66, 0x49, 0x64, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x41, 0x6d, 0x66, 0x49, 0x64, 0x12, 0x1e, 0x0a, 0x0a,
-	0x52, 0x65, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x49, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x0a, 0x52, 0x65, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x49, 0x64, 0x12, 0x32, 0x0a, 0x07,
-	0x4d, 0x73, 0x67, 0x74, 0x79, 0x70, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x18, 0x2e,
-	0x73, 0x64, 0x63, 0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2e,
-	0x6d, 0x73, 0x67, 0x54, 0x79, 0x70, 0x65, 0x52, 0x07, 0x4d, 0x73, 0x67, 0x74, 0x79, 0x70, 0x65,
-	0x12, 0x1c, 0x0a, 0x09, 0x47, 0x6e, 0x62, 0x49, 0x70, 0x41, 0x64, 0x64, 0x72, 0x18, 0x04, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x09, 0x47, 0x6e, 0x62, 0x49, 0x70, 0x41, 0x64, 0x64, 0x72, 0x12, 0x14,
-	0x0a, 0x05, 0x47, 0x6e, 0x62, 0x49, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x47,
-	0x6e, 0x62, 0x49, 0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x56, 0x65, 0x72, 0x62, 0x6f, 0x73, 0x65, 0x4d,
-	0x73, 0x67, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x56, 0x65, 0x72, 0x62, 0x6f, 0x73,
-	0x65, 0x4d, 0x73, 0x67, 0x12, 0x10, 0x0a, 0x03, 0x4d, 0x73, 0x67, 0x18, 0x07, 0x20, 0x01, 0x28,
-	0x0c, 0x52, 0x03, 0x4d, 0x73, 0x67, 0x2a, 0x6c, 0x0a, 0x07, 0x6d, 0x73, 0x67, 0x54, 0x79, 0x70,
-	0x65, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x00, 0x12, 0x0c,
-	0x0a, 0x08, 0x49, 0x4e, 0x49, 0x54, 0x5f, 0x4d, 0x53, 0x47, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07,
-	0x47, 0x4e, 0x42, 0x5f, 0x4d, 0x53, 0x47, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x41, 0x4d, 0x46,
-	0x5f, 0x4d, 0x53, 0x47, 0x10, 0x03, 0x12, 0x10, 0x0a, 0x0c, 0x52, 0x45, 0x44, 0x49, 0x52, 0x45,
-	0x43, 0x54, 0x5f, 0x4d, 0x53, 0x47, 0x10, 0x04, 0x12, 0x0c, 0x0a, 0x08, 0x47, 0x4e, 0x42, 0x5f,
-	0x44, 0x49, 0x53, 0x43, 0x10, 0x05, 0x12, 0x0c, 0x0a, 0x08, 0x47, 0x4e, 0x42, 0x5f, 0x43, 0x4f,
-	0x4e, 0x4e, 0x10, 0x06, 0x32, 0x61, 0x0a, 0x0b, 0x4e, 0x67, 0x61, 0x70, 0x53, 0x65, 0x72, 0x76,
-	0x69, 0x63, 0x65, 0x12, 0x52, 0x0a, 0x0d, 0x48, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x4d, 0x65, 0x73,
-	0x73, 0x61, 0x67, 0x65, 0x12, 0x1e, 0x2e, 0x73, 0x64, 0x63, 0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66,
-	0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2e, 0x53, 0x63, 0x74, 0x70, 0x6c, 0x62, 0x4d, 0x65, 0x73,
-	0x73, 0x61, 0x67, 0x65, 0x1a, 0x1b, 0x2e, 0x73, 0x64, 0x63, 0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66,
-	0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2e, 0x41, 0x6d, 0x66, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67,
-	0x65, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x13, 0x5a, 0x11, 0x2e, 0x2f, 0x73, 0x64, 0x63,
-	0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x62, 0x06, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x33,
+	0x52, 0x05, 0x47, 0x6e, 0x62, 0x49, 0x64, 0x22, 0x3b, 0x0a, 0x03, 0x54, 0x61, 0x69, 0x12, 0x10,
+	0x0a, 0x03, 0x4d, 0x63, 0x63, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x4d, 0x63, 0x63,
+	0x12, 0x10, 0x0a, 0x03, 0x4d, 0x6e, 0x63, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x4d,
+	0x6e, 0x63, 0x12, 0x10, 0x0a, 0x03, 0x54, 0x61, 0x63, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x03, 0x54, 0x61, 0x63, 0x22, 0xaa, 0x02, 0x0a, 0x0a, 0x41, 0x6d, 0x66, 0x4d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x41, 0x6d, 0x66, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x05, 0x41, 0x6d, 0x66, 0x49, 0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x52, 0x65, 0x64,
+	0x69, 0x72, 0x65, 0x63, 0x74, 0x49, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x52,
+	0x65, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x49, 0x64, 0x12, 0x32, 0x0a, 0x07, 0x4d, 0x73, 0x67,
+	0x74, 0x79, 0x70, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x18, 0x2e, 0x73, 0x64, 0x63,
+	0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2e, 0x6d, 0x73, 0x67,
+	0x54, 0x79, 0x70, 0x65, 0x52, 0x07, 0x4d, 0x73, 0x67, 0x74, 0x79, 0x70, 0x65, 0x12, 0x1c, 0x0a,
+	0x09, 0x47, 0x6e, 0x62, 0x49, 0x70, 0x41, 0x64, 0x64, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x09, 0x47, 0x6e, 0x62, 0x49, 0x70, 0x41, 0x64, 0x64, 0x72, 0x12, 0x14, 0x0a, 0x05, 0x47,
+	0x6e, 0x62, 0x49, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x47, 0x6e, 0x62, 0x49,
+	0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x56, 0x65, 0x72, 0x62, 0x6f, 0x73, 0x65, 0x4d, 0x73, 0x67, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x56, 0x65, 0x72, 0x62, 0x6f, 0x73, 0x65, 0x4d, 0x73,
+	0x67, 0x12, 0x10, 0x0a, 0x03, 0x4d, 0x73, 0x67, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03,
+	0x4d, 0x73, 0x67, 0x12, 0x22, 0x0a, 0x0c, 0x54, 0x61, 0x72, 0x67, 0x65, 0x74, 0x47, 0x6e, 0x62,
+	0x49, 0x64, 0x73, 0x18, 0x08, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0c, 0x54, 0x61, 0x72, 0x67, 0x65,
+	0x74, 0x47, 0x6e, 0x62, 0x49, 0x64, 0x73, 0x12, 0x28, 0x0a, 0x04, 0x54, 0x61, 0x69, 0x73, 0x18,
+	0x09, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x73, 0x64, 0x63, 0x6f, 0x72, 0x65, 0x41, 0x6d,
+	0x66, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2e, 0x54, 0x61, 0x69, 0x52, 0x04, 0x54, 0x61, 0x69,
+	0x73, 0x2a, 0x7b, 0x0a, 0x07, 0x6d, 0x73, 0x67, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b, 0x0a, 0x07,
+	0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x00, 0x12, 0x0c, 0x0a, 0x08, 0x49, 0x4e, 0x49,
+	0x54, 0x5f, 0x4d, 0x53, 0x47, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x47, 0x4e, 0x42, 0x5f, 0x4d,
+	0x53, 0x47, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x41, 0x4d, 0x46, 0x5f, 0x4d, 0x53, 0x47, 0x10,
+	0x03, 0x12, 0x10, 0x0a, 0x0c, 0x52, 0x45, 0x44, 0x49, 0x52, 0x45, 0x43, 0x54, 0x5f, 0x4d, 0x53,
+	0x47, 0x10, 0x04, 0x12, 0x0c, 0x0a, 0x08, 0x47, 0x4e, 0x42, 0x5f, 0x44, 0x49, 0x53, 0x43, 0x10,
+	0x05, 0x12, 0x0c, 0x0a, 0x08, 0x47, 0x4e, 0x42, 0x5f, 0x43, 0x4f, 0x4e, 0x4e, 0x10, 0x06, 0x12,
+	0x0d, 0x0a, 0x09, 0x41, 0x4d, 0x46, 0x5f, 0x44, 0x52, 0x41, 0x49, 0x4e, 0x10, 0x07, 0x32, 0x61,
+	0x0a, 0x0b, 0x4e, 0x67, 0x61, 0x70, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x52, 0x0a,
+	0x0d, 0x48, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x1e,
+	0x2e, 0x73, 0x64, 0x63, 0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72,
+	0x2e, 0x53, 0x63, 0x74, 0x70, 0x6c, 0x62, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x1a, 0x1b,
+	0x2e, 0x73, 0x64, 0x63, 0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72,
+	0x2e, 0x41, 0x6d, 0x66, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x00, 0x28, 0x01, 0x30,
+	0x01, 0x42, 0x13, 0x5a, 0x11, 0x2e, 0x2f, 0x73, 0x64, 0x63, 0x6f, 0x72, 0x65, 0x41, 0x6d, 0x66,
+	0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -325,22 +418,24 @@ func file_client_proto_rawDescGZIP() []byte {
 }
 
 var file_client_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_client_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_client_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_client_proto_goTypes = []any{
 	(MsgType)(0),          // 0: sdcoreAmfServer.msgType
 	(*SctplbMessage)(nil), // 1: sdcoreAmfServer.SctplbMessage
-	(*AmfMessage)(nil),    // 2: sdcoreAmfServer.AmfMessage
+	(*Tai)(nil),           // 2: sdcoreAmfServer.Tai
+	(*AmfMessage)(nil),    // 3: sdcoreAmfServer.AmfMessage
 }
 var file_client_proto_depIdxs = []int32{
 	0, // 0: sdcoreAmfServer.SctplbMessage.Msgtype:type_name -> sdcoreAmfServer.msgType
 	0, // 1: sdcoreAmfServer.AmfMessage.Msgtype:type_name -> sdcoreAmfServer.msgType
-	1, // 2: sdcoreAmfServer.NgapService.HandleMessage:input_type -> sdcoreAmfServer.SctplbMessage
-	2, // 3: sdcoreAmfServer.NgapService.HandleMessage:output_type -> sdcoreAmfServer.AmfMessage
-	3, // [3:4] is the sub-list for method output_type
-	2, // [2:3] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	2, // 2: sdcoreAmfServer.AmfMessage.Tais:type_name -> sdcoreAmfServer.Tai
+	1, // 3: sdcoreAmfServer.NgapService.HandleMessage:input_type -> sdcoreAmfServer.SctplbMessage
+	3, // 4: sdcoreAmfServer.NgapService.HandleMessage:output_type -> sdcoreAmfServer.AmfMessage
+	4, // [4:5] is the sub-list for method output_type
+	3, // [3:4] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_client_proto_init() }
@@ -354,7 +449,7 @@ func file_client_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_client_proto_rawDesc,
 			NumEnums:      1,
-			NumMessages:   2,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   1,
 		},